@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"path/filepath"
 
+	"github.com/codecrafters-io/redis-starter-go/cluster"
 	"github.com/codecrafters-io/redis-starter-go/config"
 	"github.com/codecrafters-io/redis-starter-go/protocol"
+	"github.com/codecrafters-io/redis-starter-go/sentinel"
 	"github.com/codecrafters-io/redis-starter-go/storage"
 	"github.com/jessevdk/go-flags"
 )
@@ -27,48 +29,66 @@ func main() {
 		os.Exit(1)
 	}
 
-	if opts.Dir != "" && opts.DbFilename != "" {
-		// TODO: At this point, we don't care about the file read failure.
-		storage.ReadRDBToCache(opts.Dir, opts.DbFilename, storage.GetCache())
+	if opts.Sentinel {
+		// a sentinel serves no data: it only monitors the masters.
+		s, err := sentinel.New(&opts)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		s.Start()
+
+		runSentinel(opts, s)
+		return
 	}
 
-	if opts.Role != "master" {
-		go connectMaster(opts)
+	var aof *storage.AOF
+	if opts.AOFEnabled {
+		aof, err = storage.OpenAOF(filepath.Join(opts.Dir, opts.AppendFilename), opts.AppendFsync)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
 	}
 
-	runServer(opts)
-}
+	// the replication state can be changed at runtime with REPLICAOF.
+	repl := protocol.NewReplication(&opts, storage.GetCache(), aof)
 
-func connectMaster(opts config.Opts) {
-	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.MasterIP, opts.MasterPort))
-	if err != nil {
-		log.Fatalf("net.Dial failed: %v", err)
+	// the rest of the state shared by the handlers, such as the channel subscribers.
+	state := protocol.NewState()
+
+	// the data set comes from the AOF with appendonly, and from the RDB file otherwise.
+	if err := protocol.LoadData(&opts, storage.GetCache(), repl, state); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
 	}
 
-	client := protocol.NewClient(
-		protocol.NewConnection(c),
-		&opts,
-		storage.GetCache(),
-	)
+	if opts.ClusterMode {
+		c, err := cluster.New(&opts)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
 
-	// TODO: if connection to master fails, we should retry, instread of killing entire thing
-	if err = client.Handle(); err != nil {
-		fmt.Fprintf(os.Stderr, "[slave] handler.Handle failed: %v", err)
+		if err := c.Start(); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		state.SetCluster(c)
 	}
+
+	repl.Start(state)
+
+	runServer(opts, repl, state)
 }
 
-func runServer(opts config.Opts) {
+func runServer(opts config.Opts, repl *protocol.Replication, state *protocol.State) {
 	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", opts.Port))
 	if err != nil {
 		fmt.Println("Failed to bind to port 6379")
 		os.Exit(1)
 	}
 
-	var masterConfig *protocol.MasterConfig
-	if opts.Role == "master" {
-		masterConfig = protocol.NewMasterConfig()
-	}
-
 	for {
 		c, err := l.Accept()
 		if err != nil {
@@ -80,9 +100,28 @@ func runServer(opts config.Opts) {
 			protocol.NewConnection(c),
 			&opts,
 			storage.GetCache(),
-			masterConfig,
+			repl,
+			state,
 		)
 
 		go server.Handle()
 	}
 }
+
+func runSentinel(opts config.Opts, s *sentinel.Sentinel) {
+	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", opts.Port))
+	if err != nil {
+		fmt.Printf("Failed to bind to port %d\n", opts.Port)
+		os.Exit(1)
+	}
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection: ", err.Error())
+			os.Exit(1)
+		}
+
+		go s.Handle(protocol.NewConnection(c))
+	}
+}
@@ -0,0 +1,478 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// cronInterval is how often the node pings the other nodes and checks their failures.
+	cronInterval = 100 * time.Millisecond
+
+	// pingPeriod is how often each node is pinged, unless the node timeout is shorter.
+	pingPeriod = time.Second
+
+	// busTimeout bounds connecting to, and writing to the bus of another node.
+	busTimeout = time.Second
+)
+
+// busMessage is a message on the cluster bus. Messages are sent as JSON lines.
+type busMessage struct {
+	Type    string      `json:"type"` // meet, ping, pong or fail.
+	Sender  busNode     `json:"sender"`
+	Gossip  []busGossip `json:"gossip,omitempty"`
+	Failing string      `json:"failing,omitempty"` // only for fail: the ID of the node in FAIL.
+}
+
+// busNode is the sender's own config. Its IP is the one the receiver sees the connection from.
+type busNode struct {
+	ID          string   `json:"id"`
+	Port        int      `json:"port"`
+	BusPort     int      `json:"busPort"`
+	ConfigEpoch uint64   `json:"configEpoch"`
+	Slots       [][2]int `json:"slots,omitempty"` // ranges of the slots owned by the sender, both ends inclusive.
+}
+
+// busGossip is what the sender knows about another node.
+type busGossip struct {
+	ID      string `json:"id"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	BusPort int    `json:"busPort"`
+	Flags   string `json:"flags,omitempty"` // pfail, fail, or empty if the node is healthy.
+}
+
+// link is a connection on the cluster bus. Outbound links carry our PINGs (and MEETs) and their PONGs,
+// while inbound links carry the PINGs of other nodes and our PONGs.
+type link struct {
+	conn net.Conn
+	node *node // only for outbound links: the node we connected to.
+
+	lock sync.Mutex // serializes writes.
+	enc  *json.Encoder
+}
+
+func newLink(conn net.Conn, n *node) *link {
+	return &link{
+		conn: conn,
+		node: n,
+		enc:  json.NewEncoder(conn),
+	}
+}
+
+func (l *link) send(msg *busMessage) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.conn.SetWriteDeadline(time.Now().Add(busTimeout)); err != nil {
+		return fmt.Errorf("conn.SetWriteDeadline failed: %w", err)
+	}
+
+	if err := l.enc.Encode(msg); err != nil {
+		return fmt.Errorf("enc.Encode failed: %w", err)
+	}
+
+	return nil
+}
+
+// Start starts listening on the cluster bus, and gossiping with the other nodes.
+func (c *Cluster) Start() error {
+	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", c.opts.ClusterBusPort))
+	if err != nil {
+		return fmt.Errorf("net.Listen failed: %w", err)
+	}
+	c.listener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c.lock.Lock()
+			if c.isClosed() {
+				c.lock.Unlock()
+				conn.Close()
+				return
+			}
+			in := newLink(conn, nil)
+			c.inbound[in] = struct{}{}
+			c.lock.Unlock()
+
+			go c.serveLink(in)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(cronInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-ticker.C:
+				c.cron()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the cluster bus. It can be called more than once.
+func (c *Cluster) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed() {
+		return
+	}
+
+	close(c.closed)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+
+	for _, n := range c.nodes {
+		if n.link != nil {
+			n.link.conn.Close()
+		}
+	}
+
+	for in := range c.inbound {
+		in.conn.Close()
+	}
+}
+
+type outgoing struct {
+	link *link
+	msg  *busMessage
+}
+
+// cron pings the other nodes, and detects their failures.
+func (c *Cluster) cron() {
+	c.lock.Lock()
+
+	now := time.Now()
+	period := min(pingPeriod, c.nodeTimeout/2)
+	sends := make([]outgoing, 0)
+
+	for id, n := range c.nodes {
+		if n.myself {
+			continue
+		}
+
+		if n.handshake && now.Sub(n.created) > max(c.nodeTimeout, time.Second) {
+			// the node never replied to our MEET.
+			if n.link != nil {
+				n.link.conn.Close()
+			}
+			delete(c.nodes, id)
+			continue
+		}
+
+		if n.link == nil && !n.connecting {
+			n.connecting = true
+			go c.connect(n)
+		}
+
+		if now.Sub(n.lastPing) >= period {
+			// a node we cannot even connect to counts as not replying to PING.
+			n.lastPing = now
+			if n.pingSent.IsZero() {
+				n.pingSent = now
+			}
+
+			if n.link != nil {
+				typ := "ping"
+				if n.handshake {
+					typ = "meet"
+				}
+				sends = append(sends, outgoing{n.link, c.message(typ)})
+			}
+		}
+
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > c.nodeTimeout && !n.pfail && !n.handshake {
+			fmt.Fprintf(os.Stderr, "[cluster] node %s is failing (PFAIL)\n", n.id)
+			n.pfail = true
+		}
+
+		if n.pfail && !n.fail && c.failureReported(n) {
+			fmt.Fprintf(os.Stderr, "[cluster] node %s is failing by the majority (FAIL)\n", n.id)
+			n.fail = true
+
+			fail := c.message("fail")
+			fail.Failing = n.id
+			for _, other := range c.nodes {
+				if other.link != nil {
+					sends = append(sends, outgoing{other.link, fail})
+				}
+			}
+		}
+	}
+
+	c.lock.Unlock()
+
+	for _, s := range sends {
+		if err := s.link.send(s.msg); err != nil {
+			// the reader of the link cleans it up.
+			s.link.conn.Close()
+		}
+	}
+}
+
+// failureReported returns true if the majority of the masters consider the node failing. It should be called
+// with the lock held.
+func (c *Cluster) failureReported(n *node) bool {
+	var masters, reports int
+	for _, other := range c.nodes {
+		if !c.ownsSlots(other) {
+			continue
+		}
+		masters++
+
+		if other.myself {
+			reports++ // we consider it failing as well.
+		} else if t, ok := n.failReports[other.id]; ok && time.Since(t) <= 2*c.nodeTimeout {
+			reports++
+		}
+	}
+
+	return masters > 0 && reports >= masters/2+1
+}
+
+// connect opens the outbound link to the node.
+func (c *Cluster) connect(n *node) {
+	c.lock.Lock()
+	addr := n.busAddr()
+	c.lock.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, busTimeout)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n.connecting = false
+	if err != nil {
+		return
+	}
+
+	if c.nodes[n.id] != n || c.isClosed() {
+		// the node is forgotten in the meantime.
+		conn.Close()
+		return
+	}
+
+	n.link = newLink(conn, n)
+	go c.serveLink(n.link)
+}
+
+// serveLink processes the messages arriving on the link until it's closed.
+func (c *Cluster) serveLink(l *link) {
+	defer func() {
+		l.conn.Close()
+
+		c.lock.Lock()
+		if l.node != nil && l.node.link == l {
+			l.node.link = nil
+		}
+		delete(c.inbound, l)
+		c.lock.Unlock()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(l.conn))
+	for {
+		var msg busMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+
+		if reply := c.process(l, &msg); reply != nil {
+			if err := l.send(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// process applies the message to our view of the cluster, and returns the reply to send back, if any.
+func (c *Cluster) process(l *link, msg *busMessage) *busMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	remoteIP := "127.0.0.1"
+	if addr, ok := l.conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = addr.IP.String()
+	}
+
+	sender := c.nodes[msg.Sender.ID]
+	switch {
+	case sender == nil && msg.Type == "meet":
+		// a new node joins the cluster through us. we also learn our own IP, the one the node connected to.
+		if addr, ok := l.conn.LocalAddr().(*net.TCPAddr); ok {
+			c.myself.ip = addr.IP.String()
+		}
+
+		sender = newNode(msg.Sender.ID, remoteIP, msg.Sender.Port, msg.Sender.BusPort)
+		c.nodes[sender.id] = sender
+
+	case sender == nil && l.node != nil && l.node.handshake && msg.Type == "pong":
+		// the node we MEET has replied, which tells us its real ID.
+		delete(c.nodes, l.node.id)
+		l.node.id = msg.Sender.ID
+		l.node.handshake = false
+		c.nodes[l.node.id] = l.node
+		sender = l.node
+
+	case sender == nil:
+		// we don't know the node yet: it should MEET us first, or be gossiped about by the nodes we know.
+		return nil
+	}
+
+	if sender.myself {
+		return nil
+	}
+
+	if msg.Type == "meet" || msg.Type == "ping" {
+		sender.ip = remoteIP
+	}
+	sender.port = msg.Sender.Port
+	sender.busPort = msg.Sender.BusPort
+
+	if msg.Type == "pong" {
+		sender.pingSent = time.Time{}
+		sender.pongReceived = time.Now()
+		sender.pfail = false
+		if sender.fail {
+			fmt.Fprintf(os.Stderr, "[cluster] node %s is reachable again: clearing FAIL\n", sender.id)
+			sender.fail = false
+		}
+		clear(sender.failReports)
+	}
+
+	c.updateSlots(sender, msg.Sender.Slots, msg.Sender.ConfigEpoch)
+	c.processGossip(sender, msg.Gossip)
+
+	if msg.Type == "fail" {
+		if n, ok := c.nodes[msg.Failing]; ok && !n.myself && !n.fail {
+			fmt.Fprintf(os.Stderr, "[cluster] node %s is in FAIL by %s\n", n.id, sender.id)
+			n.fail = true
+		}
+	}
+
+	if msg.Type == "meet" || msg.Type == "ping" {
+		return c.message("pong")
+	}
+	return nil
+}
+
+// updateSlots applies the slots claimed by the sender. A slot goes to the sender if it's unassigned, or if its owner
+// has a smaller config epoch. It should be called with the lock held.
+func (c *Cluster) updateSlots(sender *node, ranges [][2]int, configEpoch uint64) {
+	sender.configEpoch = configEpoch
+
+	var claimed [SlotCount]bool
+	for _, r := range ranges {
+		for slot := max(r[0], 0); slot <= min(r[1], SlotCount-1); slot++ {
+			claimed[slot] = true
+
+			owner := c.slots[slot]
+			if owner == nil || (owner != sender && owner.configEpoch < configEpoch) {
+				c.slots[slot] = sender
+
+				if owner == c.myself {
+					// the slot was moved out, by SETSLOT NODE on the other side.
+					delete(c.migrating, slot)
+				}
+			}
+		}
+	}
+
+	for slot, owner := range c.slots {
+		if owner == sender && !claimed[slot] {
+			c.slots[slot] = nil
+		}
+	}
+}
+
+// processGossip applies what the sender knows about the other nodes. It should be called with the lock held.
+func (c *Cluster) processGossip(sender *node, gossip []busGossip) {
+	senderIsMaster := c.ownsSlots(sender)
+
+	for _, g := range gossip {
+		if g.ID == c.myself.id {
+			continue
+		}
+
+		n, ok := c.nodes[g.ID]
+		if !ok {
+			if g.Flags == "" {
+				// a healthy node we don't know: the cron connects to it.
+				c.nodes[g.ID] = newNode(g.ID, g.IP, g.Port, g.BusPort)
+			}
+			continue
+		}
+
+		if !senderIsMaster || n.handshake {
+			continue
+		}
+
+		if g.Flags != "" {
+			n.failReports[sender.id] = time.Now()
+		} else {
+			delete(n.failReports, sender.id)
+		}
+	}
+}
+
+// message returns a message of the type with our own config and the gossip about the other nodes.
+// It should be called with the lock held.
+func (c *Cluster) message(typ string) *busMessage {
+	msg := &busMessage{
+		Type: typ,
+		Sender: busNode{
+			ID:          c.myself.id,
+			Port:        c.myself.port,
+			BusPort:     c.myself.busPort,
+			ConfigEpoch: c.myself.configEpoch,
+		},
+	}
+
+	for _, r := range c.slotRanges(c.myself) {
+		msg.Sender.Slots = append(msg.Sender.Slots, [2]int{r.Start, r.End})
+	}
+
+	for _, n := range c.nodes {
+		if n.myself || n.handshake {
+			continue
+		}
+
+		flags := ""
+		if n.fail {
+			flags = "fail"
+		} else if n.pfail {
+			flags = "pfail"
+		}
+
+		msg.Gossip = append(msg.Gossip, busGossip{ID: n.id, IP: n.ip, Port: n.port, BusPort: n.busPort, Flags: flags})
+	}
+
+	return msg
+}
+
+// isClosed should be called with the lock held.
+func (c *Cluster) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
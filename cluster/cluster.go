@@ -0,0 +1,402 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+)
+
+// Cluster is the view of the cluster from this node: the known nodes, and the owner of each hash slot.
+// The view is kept up to date by gossiping with the other nodes over the cluster bus.
+type Cluster struct {
+	lock sync.Mutex
+
+	opts        *config.Opts
+	nodeTimeout time.Duration
+
+	myself *node
+	nodes  map[string]*node // by node ID, including myself and the nodes in handshake.
+	slots  [SlotCount]*node // the owner of each slot, nil if unassigned.
+
+	// the slots being moved out of this node, and into this node, with the node on the other side.
+	migrating map[int]*node
+	importing map[int]*node
+
+	listener net.Listener
+	inbound  map[*link]struct{} // the links accepted from the other nodes.
+	closed   chan struct{}
+}
+
+// NodeInfo is the address of a node, as seen by the handlers.
+type NodeInfo struct {
+	ID      string
+	IP      string
+	Port    int
+	BusPort int
+	Myself  bool
+}
+
+// SlotRange is a range of slots owned by the same node, both ends inclusive.
+type SlotRange struct {
+	Start int
+	End   int
+	Node  NodeInfo
+}
+
+// node is a node of the cluster. It's guarded by the lock of the Cluster.
+type node struct {
+	id          string
+	ip          string
+	port        int
+	busPort     int
+	configEpoch uint64
+
+	myself    bool
+	handshake bool // true until the node replies to our MEET, which tells us its real ID.
+	pfail     bool // we consider the node failing (PFAIL).
+	fail      bool // the majority of the masters consider the node failing (FAIL).
+
+	created      time.Time
+	lastPing     time.Time // the time we last sent PING.
+	pingSent     time.Time // the time we sent the oldest PING not replied yet, zero if none.
+	pongReceived time.Time
+
+	// the time each master last reported this node as failing, by the master's ID.
+	failReports map[string]time.Time
+
+	link       *link // the outbound link to the node's bus.
+	connecting bool  // true while the outbound link is being connected.
+}
+
+// New returns the cluster with this node only, which doesn't own any slot yet.
+func New(opts *config.Opts) (*Cluster, error) {
+	id, err := newNodeID()
+	if err != nil {
+		return nil, fmt.Errorf("newNodeID failed: %w", err)
+	}
+
+	myself := &node{
+		id:          id,
+		ip:          "127.0.0.1", // updated with the address the other nodes see.
+		port:        opts.Port,
+		busPort:     opts.ClusterBusPort,
+		myself:      true,
+		created:     time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+
+	return &Cluster{
+		opts:        opts,
+		nodeTimeout: time.Duration(opts.ClusterNodeTimeout) * time.Millisecond,
+		myself:      myself,
+		nodes:       map[string]*node{id: myself},
+		migrating:   make(map[int]*node),
+		importing:   make(map[int]*node),
+		inbound:     make(map[*link]struct{}),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// MyID returns the ID of this node.
+func (c *Cluster) MyID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.myself.id
+}
+
+// Meet starts the handshake with the node at the given address, which joins this node to the node's cluster.
+func (c *Cluster) Meet(ip string, port, busPort int) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid node address: %s", ip)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id, err := newNodeID()
+	if err != nil {
+		return fmt.Errorf("newNodeID failed: %w", err)
+	}
+
+	n := newNode(id, ip, port, busPort)
+	n.handshake = true
+	c.nodes[id] = n
+
+	return nil
+}
+
+// AddSlots assigns the slots to this node. None of the slots should be assigned already.
+func (c *Cluster) AddSlots(slots []int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, slot := range slots {
+		if slot < 0 || slot >= SlotCount {
+			return fmt.Errorf("Invalid or out of range slot")
+		}
+
+		if c.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+
+	for _, slot := range slots {
+		c.slots[slot] = c.myself
+	}
+
+	return nil
+}
+
+// SlotOwner returns the node owning the slot. The returned boolean is false if the slot is unassigned.
+func (c *Cluster) SlotOwner(slot int) (NodeInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	owner := c.slots[slot]
+	if owner == nil {
+		return NodeInfo{}, false
+	}
+
+	return owner.info(), true
+}
+
+// StateOK returns true if every slot is assigned to a node which isn't failing.
+func (c *Cluster) StateOK() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.stateOK()
+}
+
+// stateOK should be called with the lock held.
+func (c *Cluster) stateOK() bool {
+	for _, owner := range c.slots {
+		if owner == nil || owner.fail {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SlotRanges returns the assigned slots, grouped into the ranges owned by the same node.
+func (c *Cluster) SlotRanges() []SlotRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.slotRanges(nil)
+}
+
+// slotRanges returns the ranges of the slots owned by the given node, or by any node if nil.
+// It should be called with the lock held.
+func (c *Cluster) slotRanges(owner *node) []SlotRange {
+	res := make([]SlotRange, 0)
+	for start := 0; start < SlotCount; {
+		n := c.slots[start]
+		end := start
+		for end+1 < SlotCount && c.slots[end+1] == n {
+			end++
+		}
+
+		if n != nil && (owner == nil || n == owner) {
+			res = append(res, SlotRange{Start: start, End: end, Node: n.info()})
+		}
+		start = end + 1
+	}
+
+	return res
+}
+
+// Shards returns the slot ranges of each node owning slots.
+func (c *Cluster) Shards() map[NodeInfo][]SlotRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	res := make(map[NodeInfo][]SlotRange)
+	for _, r := range c.slotRanges(nil) {
+		res[r.Node] = append(res[r.Node], r)
+	}
+
+	return res
+}
+
+// Nodes returns the CLUSTER NODES description of the cluster: one line for each node,
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func (c *Cluster) Nodes() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var sb strings.Builder
+	for _, id := range c.sortedNodeIDs() {
+		n := c.nodes[id]
+
+		flags := make([]string, 0)
+		if n.myself {
+			flags = append(flags, "myself")
+		}
+		flags = append(flags, "master")
+		if n.pfail && !n.fail {
+			flags = append(flags, "fail?")
+		}
+		if n.fail {
+			flags = append(flags, "fail")
+		}
+		if n.handshake {
+			flags = append(flags, "handshake")
+		}
+
+		linkState := "connected"
+		if !n.myself && n.link == nil {
+			linkState = "disconnected"
+		}
+
+		fields := []string{
+			n.id,
+			fmt.Sprintf("%s:%d@%d", n.ip, n.port, n.busPort),
+			strings.Join(flags, ","),
+			"-",
+			strconv.FormatInt(unixMilli(n.pingSent), 10),
+			strconv.FormatInt(unixMilli(n.pongReceived), 10),
+			strconv.FormatUint(n.configEpoch, 10),
+			linkState,
+		}
+		for _, r := range c.slotRanges(n) {
+			if r.Start == r.End {
+				fields = append(fields, strconv.Itoa(r.Start))
+			} else {
+				fields = append(fields, fmt.Sprintf("%d-%d", r.Start, r.End))
+			}
+		}
+		if n.myself {
+			for _, slot := range sortedSlots(c.migrating) {
+				fields = append(fields, fmt.Sprintf("[%d->-%s]", slot, c.migrating[slot].id))
+			}
+			for _, slot := range sortedSlots(c.importing) {
+				fields = append(fields, fmt.Sprintf("[%d-<-%s]", slot, c.importing[slot].id))
+			}
+		}
+
+		sb.WriteString(strings.Join(fields, " "))
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// Info returns the CLUSTER INFO description of the cluster.
+func (c *Cluster) Info() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state := "fail"
+	if c.stateOK() {
+		state = "ok"
+	}
+
+	var assigned, failing int
+	for _, owner := range c.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		if owner.fail {
+			failing++
+		}
+	}
+
+	var size int
+	var currentEpoch uint64
+	for _, n := range c.nodes {
+		if c.ownsSlots(n) {
+			size++
+		}
+		currentEpoch = max(currentEpoch, n.configEpoch)
+	}
+
+	return strings.Join([]string{
+		fmt.Sprintf("cluster_state:%s", state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-failing),
+		fmt.Sprintf("cluster_slots_fail:%d", failing),
+		fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)),
+		fmt.Sprintf("cluster_size:%d", size),
+		fmt.Sprintf("cluster_current_epoch:%d", currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", c.myself.configEpoch),
+	}, "\r\n") + "\r\n"
+}
+
+// ownsSlots should be called with the lock held.
+func (c *Cluster) ownsSlots(n *node) bool {
+	for _, owner := range c.slots {
+		if owner == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortedNodeIDs should be called with the lock held.
+func (c *Cluster) sortedNodeIDs() []string {
+	ids := make([]string, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func sortedSlots(m map[int]*node) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	return slots
+}
+
+func newNode(id, ip string, port, busPort int) *node {
+	return &node{
+		id:          id,
+		ip:          ip,
+		port:        port,
+		busPort:     busPort,
+		created:     time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func (n *node) info() NodeInfo {
+	return NodeInfo{ID: n.id, IP: n.ip, Port: n.port, BusPort: n.busPort, Myself: n.myself}
+}
+
+func (n *node) busAddr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+}
+
+// newNodeID returns a new random 40-character node ID.
+func newNodeID() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rand.Read failed: %w", err)
+	}
+
+	return fmt.Sprintf("%x", buf), nil
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// freePort returns a local port which isn't in use.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startTestNode(t *testing.T) *Cluster {
+	opts := &config.Opts{
+		Port:               freePort(t),
+		ClusterEnabled:     "yes",
+		ClusterPort:        freePort(t),
+		ClusterNodeTimeout: 500,
+	}
+	require.NoError(t, opts.Evaluate())
+
+	c, err := New(opts)
+	require.NoError(t, err)
+	require.NoError(t, c.Start())
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func slotsBetween(start, end int) []int {
+	slots := make([]int, 0, end-start+1)
+	for slot := start; slot <= end; slot++ {
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func TestCluster_GossipAndFailure(t *testing.T) {
+	nodes := []*Cluster{startTestNode(t), startTestNode(t), startTestNode(t)}
+
+	require.NoError(t, nodes[0].AddSlots(slotsBetween(0, 5460)))
+	require.NoError(t, nodes[1].AddSlots(slotsBetween(5461, 10922)))
+	require.NoError(t, nodes[2].AddSlots(slotsBetween(10923, 16383)))
+
+	// the first node meets the others, and they discover each other through the gossip.
+	for _, n := range nodes[1:] {
+		require.NoError(t, nodes[0].Meet("127.0.0.1", n.opts.Port, n.opts.ClusterBusPort))
+	}
+
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if !n.StateOK() {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	for _, n := range nodes {
+		for i, owner := range nodes {
+			slot := []int{0, 5461, 10923}[i]
+
+			info, ok := n.SlotOwner(slot)
+			require.True(t, ok)
+			assert.Equal(t, owner.MyID(), info.ID)
+			assert.Equal(t, owner.opts.Port, info.Port)
+			assert.Equal(t, n == owner, info.Myself)
+		}
+		assert.Len(t, n.SlotRanges(), 3)
+		assert.Contains(t, n.Info(), "cluster_known_nodes:3")
+	}
+
+	// the majority of the masters agree on the failure of the stopped node.
+	nodes[2].Close()
+
+	require.Eventually(t, func() bool {
+		return !nodes[0].StateOK() && !nodes[1].StateOK()
+	}, 10*time.Second, 50*time.Millisecond)
+
+	assert.Contains(t, nodes[0].Nodes(), "master,fail ")
+	assert.Contains(t, nodes[0].Info(), "cluster_state:fail")
+}
+
+func TestCluster_AddSlots(t *testing.T) {
+	c, err := New(&config.Opts{Port: 7000, ClusterBusPort: 17000, ClusterNodeTimeout: 500})
+	require.NoError(t, err)
+
+	require.NoError(t, c.AddSlots([]int{0, 1, 2, 100}))
+	assert.Error(t, c.AddSlots([]int{2}))
+	assert.Error(t, c.AddSlots([]int{SlotCount}))
+
+	ranges := c.SlotRanges()
+	require.Len(t, ranges, 2)
+	assert.Equal(t, 0, ranges[0].Start)
+	assert.Equal(t, 2, ranges[0].End)
+	assert.Equal(t, 100, ranges[1].Start)
+	assert.Equal(t, 100, ranges[1].End)
+
+	_, ok := c.SlotOwner(3)
+	assert.False(t, ok)
+	assert.False(t, c.StateOK())
+	assert.Contains(t, c.Nodes(), "myself,master - 0 0 0 connected 0-2 100\n")
+}
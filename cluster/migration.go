@@ -0,0 +1,117 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+)
+
+// SetSlotMigrating marks the slot as being moved out of this node to the given node. Until the migration ends,
+// the requests for the keys no longer here are redirected to the node with -ASK.
+func (c *Cluster) SetSlotMigrating(slot int, to string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.slots[slot] != c.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+
+	n, ok := c.nodes[to]
+	if !ok || n.handshake {
+		return fmt.Errorf("I don't know about node %s", to)
+	}
+	if n.myself {
+		return fmt.Errorf("Target node is myself")
+	}
+
+	c.migrating[slot] = n
+	return nil
+}
+
+// SetSlotImporting marks the slot as being moved into this node from the given node. Until the migration ends,
+// the requests for the slot are served here if they are preceded by ASKING.
+func (c *Cluster) SetSlotImporting(slot int, from string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.slots[slot] == c.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+
+	n, ok := c.nodes[from]
+	if !ok || n.handshake {
+		return fmt.Errorf("I don't know about node %s", from)
+	}
+	if n.myself {
+		return fmt.Errorf("Source node is myself")
+	}
+
+	c.importing[slot] = n
+	return nil
+}
+
+// SetSlotStable clears the migrating and importing states of the slot.
+func (c *Cluster) SetSlotStable(slot int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// SetSlotNode assigns the slot to the given node, which ends the migration of the slot. When the slot is assigned
+// to this node, the config epoch of this node is bumped, so that the rest of the cluster accepts the new owner.
+func (c *Cluster) SetSlotNode(slot int, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n, ok := c.nodes[id]
+	if !ok || n.handshake {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+
+	if n.myself {
+		if _, ok := c.importing[slot]; ok {
+			delete(c.importing, slot)
+			c.bumpConfigEpoch()
+		}
+	} else {
+		delete(c.migrating, slot)
+	}
+
+	c.slots[slot] = n
+	return nil
+}
+
+// Migrating returns the node the slot is being moved to. The returned boolean is false if the slot isn't migrating.
+func (c *Cluster) Migrating(slot int) (NodeInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n, ok := c.migrating[slot]
+	if !ok {
+		return NodeInfo{}, false
+	}
+
+	return n.info(), true
+}
+
+// Importing returns true if the slot is being moved into this node.
+func (c *Cluster) Importing(slot int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.importing[slot]
+	return ok
+}
+
+// bumpConfigEpoch makes the config epoch of this node the greatest in the cluster. It should be called with the
+// lock held.
+func (c *Cluster) bumpConfigEpoch() {
+	var greatest uint64
+	for _, n := range c.nodes {
+		greatest = max(greatest, n.configEpoch)
+	}
+
+	c.myself.configEpoch = greatest + 1
+	fmt.Fprintf(os.Stderr, "[cluster] config epoch bumped to %d\n", c.myself.configEpoch)
+}
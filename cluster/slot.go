@@ -0,0 +1,48 @@
+package cluster
+
+import "strings"
+
+// SlotCount is the number of hash slots that the keys are distributed to.
+const SlotCount = 16384
+
+var crc16Table = makeCRC16Table()
+
+// makeCRC16Table returns the table of CRC-16/XMODEM (polynomial 0x1021), which Redis Cluster uses for key hashing.
+func makeCRC16Table() [256]uint16 {
+	var table [256]uint16
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+
+	return table
+}
+
+// CRC16 returns the CRC-16/XMODEM checksum of the given string.
+func CRC16(str string) uint16 {
+	var crc uint16
+	for i := 0; i < len(str); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^str[i]]
+	}
+
+	return crc
+}
+
+// KeySlot returns the hash slot of the key. If the key contains a hash tag, that is, a non-empty substring between
+// the first { and the following }, only the tag is hashed, so that related keys can be put in the same slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(CRC16(key)) % SlotCount
+}
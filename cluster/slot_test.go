@@ -0,0 +1,31 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC16(t *testing.T) {
+	assert.Equal(t, uint16(0x31c3), CRC16("123456789"))
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "{user1000}.following", want: KeySlot("user1000")},
+		{key: "{user1000}.followers", want: KeySlot("user1000")},
+		{key: "foo{}{bar}", want: int(CRC16("foo{}{bar}")) % SlotCount}, // empty tag: the whole key is hashed.
+		{key: "foo{{bar}}zap", want: int(CRC16("{bar")) % SlotCount},
+		{key: "foo{bar}{zap}", want: int(CRC16("bar")) % SlotCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.want, KeySlot(tt.key))
+		})
+	}
+}
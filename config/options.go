@@ -6,6 +6,7 @@ import (
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/mazen160/go-random"
 )
@@ -22,13 +23,65 @@ type Opts struct {
 	Dir        string `long:"dir" description:"the path to the directory where the RDB file is stored (example: /tmp/redis-data)"`
 	DbFilename string `long:"dbfilename" description:"the name of the RDB file (example: rdbfile)"`
 
+	ReplTimeout           int `long:"repl-timeout" default:"60" description:"seconds after which a silent replica (or master) is considered dead"`
+	ReplPingReplicaPeriod int `long:"repl-ping-replica-period" default:"10" description:"seconds between the PINGs that the master sends to its replicas"`
+
+	AppendOnly     string `long:"appendonly" default:"no" description:"whether to log every write to the append-only file (yes or no)"`
+	AppendFilename string `long:"appendfilename" default:"appendonly.aof" description:"the name of the append-only file, in --dir"`
+	AppendFsync    string `long:"appendfsync" default:"everysec" description:"when to fsync the append-only file (always, everysec or no)"`
+
+	ReplBacklogSize int `long:"repl-backlog-size" default:"1048576" description:"bytes of the replication stream kept for the replicas continuing with PSYNC after a disconnection"`
+
+	ReplDisklessSync      string `long:"repl-diskless-sync" default:"no" description:"whether to stream the RDB directly to the replica sockets (yes or no)"`
+	ReplDisklessSyncDelay int    `long:"repl-diskless-sync-delay" default:"5" description:"seconds to wait for more replicas to share a diskless transfer"`
+
+	MinReplicasToWrite int `long:"min-replicas-to-write" default:"0" description:"the number of good replicas needed to accept writes (0 to disable)"`
+	MinReplicasMaxLag  int `long:"min-replicas-max-lag" default:"10" description:"seconds within which a replica should ACK to be counted as good"`
+
+	LuaTimeLimit int `long:"lua-time-limit" default:"5000" description:"milliseconds a script can run before the other clients are refused with -BUSY (0 to disable)"`
+
+	ReplicaReadOnly string `long:"replica-read-only" default:"yes" description:"whether replicas refuse writes from normal clients (yes or no)"`
+
+	ClientOutputBufferLimitReplica string `long:"client-output-buffer-limit-replica" default:"256mb 64mb 60" description:"<hard limit> <soft limit> <soft seconds> for the replication buffer of each replica"`
+
+	ClusterEnabled     string `long:"cluster-enabled" default:"no" description:"whether to run as a cluster node (yes or no)"`
+	ClusterPort        int    `long:"cluster-port" default:"0" description:"port of the cluster bus (0 for port+10000)"`
+	ClusterNodeTimeout int    `long:"cluster-node-timeout" default:"15000" description:"milliseconds after which a silent node is considered failing"`
+
+	Sentinel                bool     `long:"sentinel" description:"run as a sentinel monitoring the masters given with --sentinel-monitor"`
+	SentinelMonitor         []string `long:"sentinel-monitor" description:"<master name> <ip> <port> <quorum> (can be given multiple times)"`
+	SentinelDownAfter       int      `long:"sentinel-down-after-milliseconds" default:"30000" description:"milliseconds after which a silent instance is considered down"`
+	SentinelFailoverTimeout int      `long:"sentinel-failover-timeout" default:"180000" description:"milliseconds to wait for a failover step, and between two failover attempts"`
+
 	// The below are the read-only opts induced by the user-given config values.
 
-	Role              string
-	MasterIP          net.IP
-	MasterPort        int
-	ReplicationID     string
-	ReplicationOffset int
+	Role               string
+	MasterIP           net.IP
+	MasterPort         int
+	ReplicationID      string
+	ReplicationOffset  int
+	ReplicaBufferLimit OutputBufferLimit
+	AOFEnabled         bool
+	DisklessSync       bool
+	ReadOnlyReplica    bool
+	Monitors           []Monitor
+	ClusterMode        bool
+	ClusterBusPort     int
+}
+
+// Monitor is the parsed form of sentinel-monitor.
+type Monitor struct {
+	Name   string
+	IP     net.IP
+	Port   int
+	Quorum int
+}
+
+// OutputBufferLimit is the parsed form of client-output-buffer-limit. Zero means no limit.
+type OutputBufferLimit struct {
+	HardBytes   int
+	SoftBytes   int
+	SoftSeconds int
 }
 
 // Evaluate processes the given parameters, validates them, and populates induced read-only options.
@@ -38,9 +91,9 @@ func (o *Opts) Evaluate() error {
 	//
 
 	o.Role = "master" // default
-	rid, err := random.Random(40, replicationIdCharacterSet, true)
+	rid, err := NewReplicationID()
 	if err != nil {
-		return fmt.Errorf("random.Random failed: %v", err)
+		return fmt.Errorf("NewReplicationID failed: %v", err)
 	}
 	o.ReplicationID = rid
 
@@ -50,21 +103,254 @@ func (o *Opts) Evaluate() error {
 			return fmt.Errorf("wrong param to replicaof: %s", o.ReplicaOf)
 		}
 
-		// With LookupIP, you can handle strings line 'localhost' as well.
-		ip, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", tokens[0])
+		ip, port, err := ResolveMaster(tokens[0], tokens[1])
 		if err != nil {
-			return fmt.Errorf("not the valid IP address format: %s", tokens[0])
-		}
-		o.MasterIP = ip[0]
-
-		port, err := strconv.Atoi(tokens[1])
-		if err != nil {
-			return fmt.Errorf("not the valid port number: %v", err)
+			return err
 		}
 
+		o.MasterIP = ip
 		o.MasterPort = port
 		o.Role = "slave"
 		o.ReplicationID = "" // I am slave. I don't have a replicaton ID.
 	}
+
+	//
+	// Validate AppendOnly and AppendFsync
+	//
+
+	switch strings.ToLower(o.AppendOnly) {
+	case "yes":
+		o.AOFEnabled = true
+	case "no", "":
+		o.AOFEnabled = false
+	default:
+		return fmt.Errorf("wrong param to appendonly: %s", o.AppendOnly)
+	}
+
+	if o.AOFEnabled {
+		switch o.AppendFsync {
+		case "always", "everysec", "no":
+		default:
+			return fmt.Errorf("wrong param to appendfsync: %s", o.AppendFsync)
+		}
+	}
+
+	//
+	// Validate ReplDisklessSync
+	//
+
+	switch strings.ToLower(o.ReplDisklessSync) {
+	case "yes":
+		o.DisklessSync = true
+	case "no", "":
+		o.DisklessSync = false
+	default:
+		return fmt.Errorf("wrong param to repl-diskless-sync: %s", o.ReplDisklessSync)
+	}
+
+	//
+	// Validate ReplBacklogSize
+	//
+
+	if o.ReplBacklogSize < 0 {
+		return fmt.Errorf("wrong param to repl-backlog-size: %d", o.ReplBacklogSize)
+	}
+
+	//
+	// Validate MinReplicasToWrite and MinReplicasMaxLag
+	//
+
+	if o.MinReplicasToWrite < 0 {
+		return fmt.Errorf("wrong param to min-replicas-to-write: %d", o.MinReplicasToWrite)
+	}
+
+	if o.MinReplicasMaxLag < 0 {
+		return fmt.Errorf("wrong param to min-replicas-max-lag: %d", o.MinReplicasMaxLag)
+	}
+
+	//
+	// Validate LuaTimeLimit
+	//
+
+	if o.LuaTimeLimit < 0 {
+		return fmt.Errorf("wrong param to lua-time-limit: %d", o.LuaTimeLimit)
+	}
+
+	//
+	// Validate ReplicaReadOnly
+	//
+
+	switch strings.ToLower(o.ReplicaReadOnly) {
+	case "yes", "":
+		o.ReadOnlyReplica = true
+	case "no":
+		o.ReadOnlyReplica = false
+	default:
+		return fmt.Errorf("wrong param to replica-read-only: %s", o.ReplicaReadOnly)
+	}
+
+	//
+	// Validate ClientOutputBufferLimitReplica
+	//
+
+	if o.ClientOutputBufferLimitReplica != "" {
+		limit, err := ParseOutputBufferLimit(o.ClientOutputBufferLimitReplica)
+		if err != nil {
+			return err
+		}
+		o.ReplicaBufferLimit = limit
+	}
+
+	//
+	// Validate ClusterEnabled and ClusterPort
+	//
+
+	switch strings.ToLower(o.ClusterEnabled) {
+	case "yes":
+		o.ClusterMode = true
+	case "no", "":
+		o.ClusterMode = false
+	default:
+		return fmt.Errorf("wrong param to cluster-enabled: %s", o.ClusterEnabled)
+	}
+
+	if o.ClusterMode {
+		o.ClusterBusPort = o.ClusterPort
+		if o.ClusterBusPort == 0 {
+			o.ClusterBusPort = o.Port + 10000
+		}
+
+		if o.ClusterBusPort < 0 || o.ClusterBusPort > 65535 {
+			return fmt.Errorf("wrong cluster bus port: %d", o.ClusterBusPort)
+		}
+
+		if o.ClusterNodeTimeout <= 0 {
+			return fmt.Errorf("wrong param to cluster-node-timeout: %d", o.ClusterNodeTimeout)
+		}
+	}
+
+	//
+	// Validate Sentinel and SentinelMonitor
+	//
+
+	if o.Sentinel {
+		if len(o.SentinelMonitor) == 0 {
+			return fmt.Errorf("sentinel-monitor is required in the sentinel mode")
+		}
+
+		names := make(map[string]bool)
+		for _, str := range o.SentinelMonitor {
+			monitor, err := ParseMonitor(str)
+			if err != nil {
+				return err
+			}
+
+			if names[monitor.Name] {
+				return fmt.Errorf("duplicate master name in sentinel-monitor: %s", monitor.Name)
+			}
+			names[monitor.Name] = true
+
+			o.Monitors = append(o.Monitors, monitor)
+		}
+
+		if o.SentinelDownAfter <= 0 {
+			return fmt.Errorf("wrong param to sentinel-down-after-milliseconds: %d", o.SentinelDownAfter)
+		}
+
+		if o.SentinelFailoverTimeout <= 0 {
+			return fmt.Errorf("wrong param to sentinel-failover-timeout: %d", o.SentinelFailoverTimeout)
+		}
+	}
 	return nil
 }
+
+// ParseMonitor parses "<master name> <ip> <port> <quorum>".
+func ParseMonitor(str string) (Monitor, error) {
+	tokens := whitespace.Split(strings.TrimSpace(str), -1)
+	if len(tokens) != 4 {
+		return Monitor{}, fmt.Errorf("wrong param to sentinel-monitor: %s", str)
+	}
+
+	ip, port, err := ResolveMaster(tokens[1], tokens[2])
+	if err != nil {
+		return Monitor{}, err
+	}
+
+	quorum, err := strconv.Atoi(tokens[3])
+	if err != nil || quorum <= 0 {
+		return Monitor{}, fmt.Errorf("not the valid quorum: %s", tokens[3])
+	}
+
+	return Monitor{Name: tokens[0], IP: ip, Port: port, Quorum: quorum}, nil
+}
+
+// ParseOutputBufferLimit parses "<hard limit> <soft limit> <soft seconds>". Limits can have kb, mb and gb units.
+func ParseOutputBufferLimit(str string) (OutputBufferLimit, error) {
+	tokens := whitespace.Split(strings.TrimSpace(str), -1)
+	if len(tokens) != 3 {
+		return OutputBufferLimit{}, fmt.Errorf("wrong param to client-output-buffer-limit: %s", str)
+	}
+
+	hard, err := parseMemory(tokens[0])
+	if err != nil {
+		return OutputBufferLimit{}, fmt.Errorf("not the valid hard limit: %v", err)
+	}
+
+	soft, err := parseMemory(tokens[1])
+	if err != nil {
+		return OutputBufferLimit{}, fmt.Errorf("not the valid soft limit: %v", err)
+	}
+
+	seconds, err := strconv.Atoi(tokens[2])
+	if err != nil || seconds < 0 {
+		return OutputBufferLimit{}, fmt.Errorf("not the valid soft seconds: %s", tokens[2])
+	}
+
+	return OutputBufferLimit{HardBytes: hard, SoftBytes: soft, SoftSeconds: seconds}, nil
+}
+
+// parseMemory parses memory sizes like "64mb" into bytes.
+func parseMemory(str string) (int, error) {
+	units := []struct {
+		suffix string
+		mul    int
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+
+	lower := strings.ToLower(str)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(lower, u.suffix))
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("wrong memory size: %s", str)
+			}
+			return n * u.mul, nil
+		}
+	}
+
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("wrong memory size: %s", str)
+	}
+	return n, nil
+}
+
+// NewReplicationID returns a new random 40-character replication ID.
+func NewReplicationID() (string, error) {
+	return random.Random(40, replicationIdCharacterSet, true)
+}
+
+// ResolveMaster converts the given master host and port strings into the IP address and the port number.
+func ResolveMaster(host, port string) (net.IP, int, error) {
+	// With LookupIP, you can handle strings line 'localhost' as well.
+	ip, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("not the valid IP address format: %s", host)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0, fmt.Errorf("not the valid port number: %v", err)
+	}
+
+	return ip[0], p, nil
+}
@@ -65,3 +65,83 @@ func TestOpts_ReplicaOf_Validate(t *testing.T) {
 		})
 	}
 }
+
+func TestParseOutputBufferLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    OutputBufferLimit
+		wantErr bool
+	}{
+		{
+			name: "default",
+			str:  "256mb 64mb 60",
+			want: OutputBufferLimit{HardBytes: 256 << 20, SoftBytes: 64 << 20, SoftSeconds: 60},
+		},
+		{
+			name: "plain bytes and no limits",
+			str:  "1024 0 0",
+			want: OutputBufferLimit{HardBytes: 1024},
+		},
+		{
+			name:    "missing soft seconds",
+			str:     "1gb 1kb",
+			wantErr: true,
+		},
+		{
+			name:    "wrong unit",
+			str:     "1tb 1kb 10",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOutputBufferLimit(tt.str)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseMonitor(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    Monitor
+		wantErr bool
+	}{
+		{
+			name: "monitor",
+			str:  "mymaster 127.0.0.1 6379 2",
+			want: Monitor{Name: "mymaster", IP: net.ParseIP("127.0.0.1").To4(), Port: 6379, Quorum: 2},
+		},
+		{
+			name:    "missing quorum",
+			str:     "mymaster 127.0.0.1 6379",
+			wantErr: true,
+		},
+		{
+			name:    "zero quorum",
+			str:     "mymaster 127.0.0.1 6379 0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMonitor(tt.str)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Name, got.Name)
+			assert.True(t, tt.want.IP.Equal(got.IP))
+			assert.Equal(t, tt.want.Port, got.Port)
+			assert.Equal(t, tt.want.Quorum, got.Quorum)
+		})
+	}
+}
@@ -12,14 +12,15 @@ go 1.22
 
 require (
 	github.com/jessevdk/go-flags v1.6.1
+	github.com/mazen160/go-random v0.0.0-20210308102632-d2b501c85c03
 	github.com/stretchr/testify v1.9.0
+	github.com/yuin/gopher-lua v1.1.1
+	github.com/zhuyie/golzf v0.0.0-20161112031142-8387b0307ade
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/mazen160/go-random v0.0.0-20210308102632-d2b501c85c03 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/zhuyie/golzf v0.0.0-20161112031142-8387b0307ade // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
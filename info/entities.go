@@ -10,9 +10,26 @@ type Info struct {
 }
 
 type Replication struct {
-	Role             string
-	MasterReplID     string
-	MasterReplOffset int
+	Role                   string
+	MasterHost             string
+	MasterPort             int
+	MasterLinkStatus       string
+	MasterLastIOSecondsAgo int
+	MasterReplID           string
+	MasterReplID2          string
+	MasterReplOffset       int
+	SecondReplOffset       int
+	Slaves                 []Slave
+	MinSlavesEnabled       bool // true if min-replicas-to-write is set.
+	MinSlavesGoodSlaves    int
+}
+
+type Slave struct {
+	IP     string
+	Port   int
+	State  string
+	Offset int
+	Lag    int
 }
 
 func (info Info) Info() []string {
@@ -28,10 +45,48 @@ func replicationInfo(repl *Replication) string {
 
 	res = append(res, "# Replication")
 	res = append(res, fmt.Sprintf("role:%v", repl.Role))
-	if repl.Role == "master" {
-		res = append(res, fmt.Sprintf("master_replid:%v", repl.MasterReplID))
-		res = append(res, fmt.Sprintf("master_repl_offset:%v", repl.MasterReplOffset))
+	if repl.Role == "slave" {
+		res = append(res, fmt.Sprintf("master_host:%v", repl.MasterHost))
+		res = append(res, fmt.Sprintf("master_port:%v", repl.MasterPort))
+		res = append(res, fmt.Sprintf("master_link_status:%v", repl.MasterLinkStatus))
+		res = append(res, fmt.Sprintf("master_last_io_seconds_ago:%v", repl.MasterLastIOSecondsAgo))
+	}
+	if repl.MinSlavesEnabled {
+		res = append(res, fmt.Sprintf("min_slaves_good_slaves:%v", repl.MinSlavesGoodSlaves))
+	}
+	res = append(res, fmt.Sprintf("connected_slaves:%v", len(repl.Slaves)))
+	for i, s := range repl.Slaves {
+		res = append(res, fmt.Sprintf("slave%d:ip=%v,port=%v,state=%v,offset=%v,lag=%v", i, s.IP, s.Port, s.State, s.Offset, s.Lag))
 	}
+	res = append(res, fmt.Sprintf("master_replid:%v", repl.MasterReplID))
+	res = append(res, fmt.Sprintf("master_replid2:%v", repl.MasterReplID2))
+	res = append(res, fmt.Sprintf("master_repl_offset:%v", repl.MasterReplOffset))
+	res = append(res, fmt.Sprintf("second_repl_offset:%v", repl.SecondReplOffset))
 
 	return strings.Join(res, "\r\n")
 }
+
+// Sentinel is the INFO of a server running as a sentinel.
+type Sentinel struct {
+	Masters []SentinelMaster
+}
+
+type SentinelMaster struct {
+	Name      string
+	Status    string // ok, sdown or odown.
+	Address   string
+	Slaves    int
+	Sentinels int // including this sentinel.
+}
+
+func (s Sentinel) Info() []string {
+	res := make([]string, 0)
+
+	res = append(res, "# Sentinel")
+	res = append(res, fmt.Sprintf("sentinel_masters:%v", len(s.Masters)))
+	for i, m := range s.Masters {
+		res = append(res, fmt.Sprintf("master%d:name=%v,status=%v,address=%v,slaves=%v,sentinels=%v", i, m.Name, m.Status, m.Address, m.Slaves, m.Sentinels))
+	}
+
+	return []string{strings.Join(res, "\r\n")}
+}
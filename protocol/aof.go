@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+)
+
+// LoadData loads the data set at startup. With appendonly, the AOF has every write, so the data set is replayed
+// from it. A new AOF gets the data set loaded from the RDB file as its base instead.
+func LoadData(opts *config.Opts, cache *storage.Cache, repl *Replication, state *State) error {
+	aof := repl.AOF()
+	if aof != nil {
+		empty, err := aof.Empty()
+		if err != nil {
+			return fmt.Errorf("aof.Empty failed: %w", err)
+		}
+
+		if !empty {
+			if err := replayAOF(aof.Path(), opts, cache, repl, state); err != nil {
+				return fmt.Errorf("replayAOF failed: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if opts.Dir != "" && opts.DbFilename != "" {
+		// TODO: At this point, we don't care about the file read failure.
+		storage.ReadRDBToCache(opts.Dir, opts.DbFilename, cache)
+	}
+
+	if aof != nil {
+		if err := aof.Rewrite(cache, 0); err != nil {
+			return fmt.Errorf("aof.Rewrite failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// replayAOF loads the RDB at the start of the AOF, and runs the commands after it, like the master link does.
+// A command cut by a crash at the end of the file is dropped, and the file is truncated before it.
+func replayAOF(path string, opts *config.Opts, cache *storage.Cache, repl *Replication, state *State) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("file open failed: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(5); string(magic) == "REDIS" {
+		if err := storage.ReadRDB(r, cache); err != nil {
+			return fmt.Errorf("storage.ReadRDB failed: %w", err)
+		}
+	}
+
+	// the commands start right after the RDB.
+	base, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("file seek failed: %w", err)
+	}
+	base -= int64(r.Buffered())
+
+	h := newHandler(NewConnection(&aofConn{r: r}), false, opts, cache, repl, state)
+	for {
+		start := h.conn.Offset()
+		request, err := ReadMessage(h.conn)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if h.conn.Offset() == start {
+				return nil
+			}
+
+			fmt.Fprintf(os.Stderr, "truncating the AOF cut in the middle of a command at %d\n", base+int64(start))
+			if err := os.Truncate(path, base+int64(start)); err != nil {
+				return fmt.Errorf("file truncate failed: %w", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("ReadMessage failed: %w", err)
+		}
+
+		if err := h.processRequest(request); err != nil {
+			return fmt.Errorf("processRequest failed: %w", err)
+		}
+	}
+}
+
+// aofConn is a net.Conn reading the AOF. Nothing is written to it, as the handler replaying the AOF doesn't reply.
+type aofConn struct {
+	r io.Reader
+}
+
+func (ac *aofConn) Read(b []byte) (int, error)         { return ac.r.Read(b) }
+func (ac *aofConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (ac *aofConn) Close() error                       { return nil }
+func (ac *aofConn) LocalAddr() net.Addr                { return nil }
+func (ac *aofConn) RemoteAddr() net.Addr               { return nil }
+func (ac *aofConn) SetDeadline(t time.Time) error      { return nil }
+func (ac *aofConn) SetReadDeadline(t time.Time) error  { return nil }
+func (ac *aofConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadData_AOF(t *testing.T) {
+	dir := t.TempDir()
+	opts := func() *config.Opts {
+		return &config.Opts{Dir: dir, DbFilename: "dump.rdb", AppendOnly: "yes", AppendFsync: "always"}
+	}
+
+	// the keys saved to the RDB before appendonly is enabled are the base of the new AOF.
+	_, port := startTestServer(t, &config.Opts{Dir: dir, DbFilename: "dump.rdb"})
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "saved", "1"))
+	require.Equal(t, "+OK\r\n", request(t, client, "SAVE"))
+
+	_, port = startTestServer(t, opts())
+	client = dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+	require.Equal(t, "$5\r\nmylib\r\n", request(t, client, "FUNCTION", "LOAD", testLibrary))
+	require.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+	require.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "tx", "1"))
+	require.Equal(t, "+QUEUED\r\n", request(t, client, "DEL", "foo"))
+	require.Equal(t, "*2\r\n+OK\r\n:1\r\n", execRequest(t, client, 2))
+	require.Equal(t, "+OK\r\n", request(t, client, "FCALL", "set", "1", "fn", "called"))
+
+	// a restarted server replays the AOF, whatever the RDB file has.
+	require.NoError(t, os.Remove(filepath.Join(dir, "dump.rdb")))
+	restarted, _ := startTestServer(t, opts())
+	for key, want := range map[string]string{"saved": "1", "tx": "1", "fn": "called"} {
+		value, _ := restarted.cache.Get(key)
+		require.NotNil(t, value, key)
+		assert.Equal(t, want, *value, key)
+	}
+	value, _ := restarted.cache.Get("foo")
+	assert.Nil(t, value)
+	assert.Contains(t, restarted.cache.Libraries(), "mylib")
+}
+
+func TestLoadData_TruncatedAOF(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "appendonly.aof")
+
+	// the last command was cut by a crash.
+	complete := string(NewArray([]string{"SET", "foo", "bar"}).Redis())
+	require.NoError(t, os.WriteFile(path, []byte(complete+"*3\r\n$3\r\nSET\r\n$3\r\nbaz"), 0644))
+
+	server, _ := startTestServer(t, &config.Opts{Dir: dir, AppendOnly: "yes", AppendFsync: "always"})
+	value, _ := server.cache.Get("foo")
+	require.NotNil(t, value)
+	assert.Equal(t, "bar", *value)
+
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, complete, string(written))
+}
+
+func TestLoadData_FullResync(t *testing.T) {
+	dir := t.TempDir()
+	opts := func() *config.Opts {
+		return &config.Opts{Dir: dir, AppendOnly: "yes", AppendFsync: "always"}
+	}
+
+	master, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+
+	// the AOF of the replica has writes of its own, from before it was a replica.
+	server, serverPort := startTestServer(t, opts())
+	serverClient := dialTestServer(t, serverPort)
+	require.Equal(t, "+OK\r\n", request(t, serverClient, "SET", "old", "1"))
+
+	require.Equal(t, "+OK\r\n", request(t, serverClient, "REPLICAOF", "127.0.0.1", fmt.Sprint(port)))
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "new", "1"))
+	require.Eventually(t, func() bool {
+		return server.AOF().FsyncedOffset() == uint64(master.Info().MasterReplOffset)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the AOF starts over from the data set of the master, followed by the writes of the master.
+	written, err := os.ReadFile(filepath.Join(dir, "appendonly.aof"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(written), "REDIS"))
+
+	restarted, _ := startTestServer(t, opts())
+	for key, want := range map[string]bool{"foo": true, "new": true, "old": false} {
+		value, _ := restarted.cache.Get(key)
+		assert.Equal(t, want, value != nil, key)
+	}
+}
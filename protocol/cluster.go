@@ -0,0 +1,288 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/cluster"
+)
+
+var (
+	CLUSTERDISABLED = NewError("ERR This instance has cluster support disabled")
+	CROSSSLOT       = NewError("CROSSSLOT Keys in request don't hash to the same slot")
+	CLUSTERDOWN     = NewError("CLUSTERDOWN The cluster is down")
+	SLOTUNBOUND     = NewError("CLUSTERDOWN Hash slot not served")
+	TRYAGAIN        = NewError("TRYAGAIN Multiple keys request during rehashing of slot")
+)
+
+// redirect returns the error to reply instead of serving the request, if the keys of the request
+// aren't served by this node. It returns nil if the request can be served here. asking is true if the
+// request is preceded by ASKING, which lets the node importing the slot serve it.
+func (h *Handler) redirect(cmd *command, msg *ArrayMessage, asking bool) Message {
+	// commands with movable keys, such as MIGRATE, are served where they are sent.
+	c := h.state.Cluster()
+	if c == nil || cmd.getKeys != nil {
+		return nil
+	}
+
+	keys := cmd.keysOf(msg.Raw())
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return CROSSSLOT
+		}
+	}
+
+	if !c.StateOK() {
+		return CLUSTERDOWN
+	}
+
+	owner, ok := c.SlotOwner(slot)
+	if !ok {
+		return SLOTUNBOUND
+	}
+
+	if owner.Myself {
+		to, ok := c.Migrating(slot)
+		if !ok {
+			return nil
+		}
+
+		// the keys already moved are served by the node importing the slot.
+		missing := 0
+		for _, key := range keys {
+			if value, _ := h.cache.Get(key); value == nil {
+				missing++
+			}
+		}
+
+		switch {
+		case missing == 0:
+			return nil
+		case missing == len(keys):
+			return NewError(fmt.Sprintf("ASK %d %s:%d", slot, to.IP, to.Port))
+		default:
+			return TRYAGAIN
+		}
+	}
+
+	if (asking || cmd.flags&flagAsking != 0) && c.Importing(slot) {
+		return nil
+	}
+
+	return NewError(fmt.Sprintf("MOVED %d %s:%d", slot, owner.IP, owner.Port))
+}
+
+// keysInSlot returns the keys of the slot stored in this node.
+func (h *Handler) keysInSlot(slot int) []string {
+	keys, _ := h.cache.Keys()
+
+	res := make([]string, 0)
+	for _, key := range keys {
+		if cluster.KeySlot(key) != slot {
+			continue
+		}
+		if value, _ := h.cache.Get(key); value != nil {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func (h *Handler) handleCluster(args []string) error {
+	c := h.state.Cluster()
+	if c == nil {
+		if err := h.conn.Write(CLUSTERDISABLED); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+		return nil
+	}
+
+	if len(args) == 0 {
+		return h.replyError(NewArityError("cluster"))
+	}
+
+	var reply Message
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "MYID":
+		reply = NewBulk(c.MyID())
+
+	case "INFO":
+		reply = NewBulk(c.Info())
+
+	case "NODES":
+		reply = NewBulk(c.Nodes())
+
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return h.replyError(NewArityError("cluster|keyslot"))
+		}
+		reply = NewInt(cluster.KeySlot(args[1]))
+
+	case "MEET":
+		if len(args) != 3 && len(args) != 4 {
+			return h.replyError(NewArityError("cluster|meet"))
+		}
+
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return h.writeError(fmt.Sprintf("ERR Invalid base port specified: %s", args[2]))
+		}
+
+		busPort := port + 10000
+		if len(args) == 4 {
+			if busPort, err = strconv.Atoi(args[3]); err != nil {
+				return h.writeError(fmt.Sprintf("ERR Invalid bus port specified: %s", args[3]))
+			}
+		}
+
+		if err := c.Meet(args[1], port, busPort); err != nil {
+			return h.writeError(fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[1], args[2]))
+		}
+		reply = OK
+
+	case "ADDSLOTS":
+		if len(args) < 2 {
+			return h.replyError(NewArityError("cluster|addslots"))
+		}
+
+		slots := make([]int, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			slot, err := strconv.Atoi(arg)
+			if err != nil {
+				return h.writeError("ERR Invalid or out of range slot")
+			}
+			slots = append(slots, slot)
+		}
+
+		if err := c.AddSlots(slots); err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		reply = OK
+
+	case "SETSLOT":
+		if len(args) < 3 {
+			return h.replyError(NewArityError("cluster|setslot"))
+		}
+
+		slot, err := strconv.Atoi(args[1])
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return h.writeError("ERR Invalid or out of range slot")
+		}
+
+		switch state := strings.ToUpper(args[2]); {
+		case state == "STABLE" && len(args) == 3:
+			c.SetSlotStable(slot)
+
+		case state == "MIGRATING" && len(args) == 4:
+			err = c.SetSlotMigrating(slot, args[3])
+
+		case state == "IMPORTING" && len(args) == 4:
+			err = c.SetSlotImporting(slot, args[3])
+
+		case state == "NODE" && len(args) == 4:
+			owner, ok := c.SlotOwner(slot)
+			if ok && owner.Myself && args[3] != owner.ID && len(h.keysInSlot(slot)) > 0 {
+				return h.writeError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			}
+			err = c.SetSlotNode(slot, args[3])
+
+		default:
+			return h.writeError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		}
+
+		if err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		reply = OK
+
+	case "COUNTKEYSINSLOT":
+		if len(args) != 2 {
+			return h.replyError(NewArityError("cluster|countkeysinslot"))
+		}
+
+		slot, err := strconv.Atoi(args[1])
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return h.writeError("ERR Invalid slot")
+		}
+		reply = NewInt(len(h.keysInSlot(slot)))
+
+	case "GETKEYSINSLOT":
+		if len(args) != 3 {
+			return h.replyError(NewArityError("cluster|getkeysinslot"))
+		}
+
+		slot, err := strconv.Atoi(args[1])
+		if err != nil || slot < 0 || slot >= cluster.SlotCount {
+			return h.writeError("ERR Invalid slot")
+		}
+
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return h.writeError("ERR Invalid number of keys")
+		}
+
+		keys := h.keysInSlot(slot)
+		reply = NewArray(keys[:min(count, len(keys))])
+
+	case "SLOTS":
+		// [[start, end, [ip, port, id]], ...]
+		ranges := c.SlotRanges()
+		items := make([]Message, 0, len(ranges))
+		for _, r := range ranges {
+			items = append(items, NewNestedArray([]Message{
+				NewInt(r.Start),
+				NewInt(r.End),
+				NewNestedArray([]Message{NewBulk(r.Node.IP), NewInt(r.Node.Port), NewBulk(r.Node.ID)}),
+			}))
+		}
+		reply = NewNestedArray(items)
+
+	case "SHARDS":
+		// [["slots", [start, end, ...], "nodes", [[id, port, ip, role]]], ...]
+		shards := c.Shards()
+		nodes := make([]cluster.NodeInfo, 0, len(shards))
+		for n := range shards {
+			nodes = append(nodes, n)
+		}
+		sort.Slice(nodes, func(i, j int) bool { return shards[nodes[i]][0].Start < shards[nodes[j]][0].Start })
+
+		items := make([]Message, 0, len(nodes))
+		for _, n := range nodes {
+			slots := make([]Message, 0)
+			for _, r := range shards[n] {
+				slots = append(slots, NewInt(r.Start), NewInt(r.End))
+			}
+
+			node := NewNestedArray([]Message{
+				NewBulk("id"), NewBulk(n.ID),
+				NewBulk("port"), NewInt(n.Port),
+				NewBulk("ip"), NewBulk(n.IP),
+				NewBulk("role"), NewBulk("master"),
+			})
+
+			items = append(items, NewNestedArray([]Message{
+				NewBulk("slots"), NewNestedArray(slots),
+				NewBulk("nodes"), NewNestedArray([]Message{node}),
+			}))
+		}
+		reply = NewNestedArray(items)
+
+	default:
+		return h.replyError(NewUnknownSubcommandError("cluster", args[0]))
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClusterNode is a server of a test cluster, with its view of the cluster in state.
+type testClusterNode struct {
+	*Replication
+	state *State
+}
+
+func startTestClusterNode(t *testing.T) (*testClusterNode, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	busPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	repl, state, port := startTestNode(t, &config.Opts{ClusterEnabled: "yes", ClusterPort: busPort, ClusterNodeTimeout: 1000})
+	return &testClusterNode{Replication: repl, state: state}, port
+}
+
+// request sends the request, and returns the reply in the RESP format.
+func request(t *testing.T, c *Connection, args ...string) string {
+	require.NoError(t, c.Write(NewArray(args)))
+	reply, err := ReadMessage(c)
+	require.NoError(t, err)
+
+	return string(reply.Redis())
+}
+
+// startTestCluster starts a cluster of two nodes: the first node serves the lower half of the slots, and the second
+// one the upper half.
+func startTestCluster(t *testing.T) (first, second *testClusterNode, firstClient, secondClient *Connection) {
+	first, firstPort := startTestClusterNode(t)
+	second, secondPort := startTestClusterNode(t)
+	firstClient, secondClient = dialTestServer(t, firstPort), dialTestServer(t, secondPort)
+
+	assert.Equal(t, "-CLUSTERDOWN The cluster is down\r\n", request(t, firstClient, "SET", "foo", "bar"))
+
+	lower, upper := []string{"CLUSTER", "ADDSLOTS"}, []string{"CLUSTER", "ADDSLOTS"}
+	for slot := 0; slot < 16384; slot++ {
+		if slot < 8192 {
+			lower = append(lower, fmt.Sprint(slot))
+		} else {
+			upper = append(upper, fmt.Sprint(slot))
+		}
+	}
+	require.Equal(t, "+OK\r\n", request(t, firstClient, lower...))
+	require.Equal(t, "+OK\r\n", request(t, secondClient, upper...))
+	require.Equal(t, "+OK\r\n", request(t, firstClient,
+		"CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(secondPort), fmt.Sprint(second.opts.ClusterBusPort)))
+
+	require.Eventually(t, func() bool {
+		return first.state.Cluster().StateOK() && second.state.Cluster().StateOK()
+	}, 10*time.Second, 50*time.Millisecond)
+
+	return first, second, firstClient, secondClient
+}
+
+func TestCluster_Redirect(t *testing.T) {
+	first, second, firstClient, secondClient := startTestCluster(t)
+
+	tests := []struct {
+		client *Connection
+		args   []string
+		want   string
+	}{
+		{client: firstClient, args: []string{"CLUSTER", "KEYSLOT", "foo"}, want: ":12182\r\n"},
+		{client: firstClient, args: []string{"CLUSTER", "ADDSLOTS", "0"}, want: "-ERR Slot 0 is already busy\r\n"},
+		// foo hashes to 12182, served by the second node.
+		{client: firstClient, args: []string{"SET", "foo", "bar"}, want: fmt.Sprintf("-MOVED 12182 127.0.0.1:%d\r\n", second.opts.Port)},
+		{client: secondClient, args: []string{"SET", "foo", "bar"}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"GET", "{foo}.bar"}, want: "$-1\r\n"}, // same hash tag, same node.
+		{client: secondClient, args: []string{"GET", "bar"}, want: fmt.Sprintf("-MOVED 5061 127.0.0.1:%d\r\n", first.opts.Port)},
+		{client: secondClient, args: []string{"DEL", "foo", "bar"}, want: "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, request(t, tt.client, tt.args...), tt.args)
+	}
+
+	// the redirected writes aren't propagated by the first node, which doesn't serve their slots.
+	assert.Equal(t, 0, first.Info().MasterReplOffset)
+	assert.NotZero(t, second.Info().MasterReplOffset)
+}
+
+func TestCluster_Migration(t *testing.T) {
+	first, second, firstClient, secondClient := startTestCluster(t)
+	firstID, secondID := first.state.Cluster().MyID(), second.state.Cluster().MyID()
+	ask := fmt.Sprintf("-ASK 12182 127.0.0.1:%d\r\n", first.opts.Port)
+	moved := fmt.Sprintf("-MOVED 12182 127.0.0.1:%d\r\n", second.opts.Port)
+
+	// foo and {foo}.bar are in 12182, which is moved from the second node to the first one.
+	tests := []struct {
+		client *Connection
+		args   []string
+		want   string
+	}{
+		{client: secondClient, args: []string{"SET", "foo", "1"}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"SET", "{foo}.bar", "2"}, want: "+OK\r\n"},
+		{client: firstClient, args: []string{"CLUSTER", "SETSLOT", "12182", "IMPORTING", secondID}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"CLUSTER", "SETSLOT", "12182", "MIGRATING", firstID}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"CLUSTER", "GETKEYSINSLOT", "12182", "10"}, want: "*2\r\n$3\r\nfoo\r\n$9\r\n{foo}.bar\r\n"},
+		{client: secondClient, args: []string{"MIGRATE", "127.0.0.1", fmt.Sprint(first.opts.Port), "foo", "0", "5000"}, want: "+OK\r\n"},
+
+		// the keys moved already are served by the first node with ASKING, and the rest by the second node.
+		{client: secondClient, args: []string{"GET", "foo"}, want: ask},
+		{client: secondClient, args: []string{"GET", "{foo}.bar"}, want: "$1\r\n2\r\n"},
+		{client: secondClient, args: []string{"DEL", "foo", "{foo}.bar"}, want: "-TRYAGAIN Multiple keys request during rehashing of slot\r\n"},
+		{client: firstClient, args: []string{"GET", "foo"}, want: moved},
+		{client: firstClient, args: []string{"ASKING"}, want: "+OK\r\n"},
+		{client: firstClient, args: []string{"GET", "foo"}, want: "$1\r\n1\r\n"},
+		{client: firstClient, args: []string{"GET", "foo"}, want: moved}, // ASKING is for the next request only.
+
+		{client: secondClient, args: []string{"CLUSTER", "SETSLOT", "12182", "NODE", firstID}, want: "-ERR Can't assign hashslot 12182 to a different node while I still hold keys for this hash slot.\r\n"},
+		{client: secondClient, args: []string{"MIGRATE", "127.0.0.1", fmt.Sprint(first.opts.Port), "", "0", "5000", "KEYS", "{foo}.bar", "nokey"}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"MIGRATE", "127.0.0.1", fmt.Sprint(first.opts.Port), "foo", "0", "5000"}, want: "+NOKEY\r\n"},
+		{client: secondClient, args: []string{"CLUSTER", "COUNTKEYSINSLOT", "12182"}, want: ":0\r\n"},
+		{client: firstClient, args: []string{"CLUSTER", "SETSLOT", "12182", "NODE", firstID}, want: "+OK\r\n"},
+		{client: secondClient, args: []string{"CLUSTER", "SETSLOT", "12182", "NODE", firstID}, want: "+OK\r\n"},
+		{client: firstClient, args: []string{"GET", "{foo}.bar"}, want: "$1\r\n2\r\n"},
+		{client: secondClient, args: []string{"GET", "foo"}, want: fmt.Sprintf("-MOVED 12182 127.0.0.1:%d\r\n", first.opts.Port)},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, request(t, tt.client, tt.args...), tt.args)
+	}
+
+	// the new owner has bumped its config epoch, which makes the rest of the cluster accept it.
+	require.Eventually(t, func() bool {
+		owner, ok := second.state.Cluster().SlotOwner(12182)
+		return ok && owner.ID == firstID
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Contains(t, first.state.Cluster().Info(), "cluster_my_epoch:1")
+}
+
+func TestCluster_MigrationConcurrentWrite(t *testing.T) {
+	first, second, _, secondClient := startTestCluster(t)
+	writer := dialTestServer(t, second.opts.Port)
+	targetPort, restored := startSlowTarget(t)
+
+	require.Equal(t, "+OK\r\n", request(t, secondClient, "SET", "foo", "old"))
+	require.Equal(t, "+OK\r\n", request(t, secondClient,
+		"CLUSTER", "SETSLOT", "12182", "MIGRATING", first.state.Cluster().MyID()))
+
+	migrate := []string{"MIGRATE", "127.0.0.1", fmt.Sprint(targetPort), "foo", "0", "5000"}
+	require.NoError(t, secondClient.Write(NewArray(migrate)))
+	<-restored
+
+	// the write waits for MIGRATE, and then finds the key moved, instead of creating it again.
+	assert.Equal(t, fmt.Sprintf("-ASK 12182 127.0.0.1:%d\r\n", first.opts.Port), request(t, writer, "SET", "foo", "new"))
+	reply, err := ReadMessage(secondClient)
+	require.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", string(reply.Redis()))
+
+	value, _ := second.cache.Get("foo")
+	assert.Nil(t, value)
+}
@@ -0,0 +1,738 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commandFlag describes how a command behaves, like the command flags of Redis.
+type commandFlag uint
+
+const (
+	// flagWrite is for commands which modify the dataset. They are propagated to the slaves and the AOF, and
+	// refused by read-only replicas.
+	flagWrite commandFlag = 1 << iota
+
+	// flagReadOnly is for commands which read the dataset without modifying it.
+	flagReadOnly
+
+	// flagAdmin is for administrative commands, such as REPLICAOF.
+	flagAdmin
+
+	// flagNoScript is for commands which cannot be called from scripts.
+	flagNoScript
+
+	// flagPubSub is for the commands of Pub/Sub.
+	flagPubSub
+
+	// flagFast is for commands which run in constant or logarithmic time.
+	flagFast
+
+	// flagNoPropagate is for write commands which propagate their effects themselves, such as MIGRATE which
+	// propagates DEL of the keys moved.
+	flagNoPropagate
+
+	// flagAsking is for commands which are served by the node importing the slot without ASKING before.
+	flagAsking
+
+	// flagNoMulti is for commands which are refused in a transaction, instead of being queued.
+	flagNoMulti
+
+	// flagExclusive is for commands which run while no other command runs, such as MIGRATE which reads, moves
+	// and deletes the keys at once. It isn't shown by COMMAND INFO.
+	flagExclusive
+
+	// flagAllowBusy is for commands which are served while a script runs, such as SCRIPT KILL, instead of
+	// waiting for it or being refused with -BUSY.
+	flagAllowBusy
+)
+
+// flagNames are the names of the flags shown by COMMAND INFO, in the order of Redis.
+var flagNames = []struct {
+	flag commandFlag
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadOnly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagPubSub, "pubsub"},
+	{flagNoScript, "noscript"},
+	{flagAsking, "asking"},
+	{flagFast, "fast"},
+	{flagNoMulti, "no_multi"},
+	{flagAllowBusy, "allow_busy"},
+}
+
+// keySpec is where the keys are in the arguments, like the key specs of Redis 7. The search for the first key
+// begins at index, or right after keyword, which is searched from startFrom (negative counts from the end,
+// searching backwards). Then the keys are taken up to lastKey, every keyStep. lastKey is relative to the first
+// key, or negative to count from the end, like -1 for the last argument.
+//
+// With keyNum, the number of the keys is the argument at keyNumIdx from where the search began instead, and
+// the keys start at firstKey from there, like numkeys of EVAL.
+type keySpec struct {
+	flags []string // such as RO and ACCESS.
+
+	index     int
+	keyword   string
+	startFrom int
+
+	lastKey int
+	keyStep int
+
+	keyNum    bool
+	keyNumIdx int
+	firstKey  int
+}
+
+// command is an entry of the command table. Dispatch, arity checking, propagation and key extraction are all
+// driven by the table, as well as COMMAND.
+type command struct {
+	name  string // in lower case, like "get", or "cluster|info" for a subcommand.
+	arity int    // including the command name. -N means N or more.
+	flags commandFlag
+
+	// categories are the ACL categories besides the ones implied by the flags, such as @string.
+	categories []string
+
+	keySpecs []keySpec
+
+	// getKeys returns the keys of the request, for commands with movable keys which key specs can't tell exactly.
+	getKeys func(args []string) []string
+
+	// the documentation shown by COMMAND DOCS.
+	summary    string
+	since      string
+	group      string
+	complexity string
+
+	// subcommands are the subcommands by lower-case name, such as "info" of CLUSTER INFO. Subcommands are
+	// handled by the handler of their container.
+	subcommands map[string]*command
+
+	handler func(h *Handler, msg *ArrayMessage) error
+}
+
+// commands is the command table, by lower-case name. It's built in init, as the handlers refer to the table
+// through NewArray.
+var commands map[string]*command
+
+// index and keyword return the usual key specs: the keys from the given index, or after the given keyword.
+func index(idx, lastKey, keyStep int, flags ...string) keySpec {
+	return keySpec{flags: flags, index: idx, lastKey: lastKey, keyStep: keyStep}
+}
+
+func keyword(kw string, startFrom, lastKey, keyStep int, flags ...string) keySpec {
+	return keySpec{flags: flags, keyword: kw, startFrom: startFrom, lastKey: lastKey, keyStep: keyStep}
+}
+
+// keynum returns the key spec of keys preceded by their number, such as numkeys of EVAL.
+func keynum(idx, keyNumIdx, firstKey, keyStep int, flags ...string) keySpec {
+	return keySpec{flags: flags, index: idx, keyNum: true, keyNumIdx: keyNumIdx, firstKey: firstKey, keyStep: keyStep}
+}
+
+func init() {
+	table := []*command{
+		{
+			name: "ping", arity: -1, flags: flagFast, categories: []string{"@connection"},
+			summary: "Returns the server's liveliness response.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*Handler).pingCommand,
+		},
+		{
+			name: "echo", arity: 2, flags: flagFast, categories: []string{"@connection"},
+			summary: "Returns the given string.", since: "1.0.0", group: "connection", complexity: "O(1)",
+			handler: (*Handler).echoCommand,
+		},
+		{
+			name: "hello", arity: -1, flags: flagNoScript | flagFast, categories: []string{"@connection"},
+			summary: "Handshakes with the Redis server.", since: "6.0.0", group: "connection", complexity: "O(1)",
+			handler: (*Handler).helloCommand,
+		},
+		{
+			name: "client", arity: -2, categories: []string{"@connection"},
+			summary: "A container for client connection commands.", since: "2.4.0", group: "connection", complexity: "Depends on subcommand.",
+			subcommands: subcommands(
+				&command{
+					name: "client|id", arity: 2, flags: flagNoScript, categories: []string{"@connection"},
+					summary: "Returns the unique client ID of the connection.", since: "5.0.0", group: "connection", complexity: "O(1)",
+				},
+				&command{
+					name: "client|getname", arity: 2, flags: flagNoScript, categories: []string{"@connection"},
+					summary: "Returns the name of the connection.", since: "2.6.9", group: "connection", complexity: "O(1)",
+				},
+				&command{
+					name: "client|setname", arity: 3, flags: flagNoScript, categories: []string{"@connection"},
+					summary: "Sets the connection name.", since: "2.6.9", group: "connection", complexity: "O(1)",
+				},
+			),
+			handler: (*Handler).clientCommand,
+		},
+		{
+			name: "info", arity: -1, categories: []string{"@dangerous"},
+			summary: "Returns information and statistics about the server.", since: "1.0.0", group: "server", complexity: "O(1)",
+			handler: (*Handler).infoCommand,
+		},
+		{
+			name: "config", arity: -2,
+			summary: "A container for server configuration commands.", since: "2.0.0", group: "server", complexity: "Depends on subcommand.",
+			subcommands: subcommands(
+				&command{
+					name: "config|get", arity: -3, flags: flagAdmin | flagNoScript,
+					summary: "Returns the effective values of configuration parameters.", since: "2.0.0", group: "server", complexity: "O(N) when N is the number of configuration parameters provided",
+				},
+			),
+			handler: (*Handler).configCommand,
+		},
+		{
+			name: "save", arity: 1, flags: flagAdmin | flagNoScript | flagNoMulti, categories: []string{"@dangerous"},
+			summary: "Synchronously saves the database(s) to disk.", since: "1.0.0", group: "server", complexity: "O(N) where N is the total number of keys in all databases",
+			handler: (*Handler).saveCommand,
+		},
+		{
+			name: "command", arity: -1, categories: []string{"@connection"},
+			summary: "Returns detailed information about all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the total number of Redis commands",
+			subcommands: subcommands(
+				&command{
+					name: "command|count", arity: 2, categories: []string{"@connection"},
+					summary: "Returns a count of commands.", since: "2.8.13", group: "server", complexity: "O(1)",
+				},
+				&command{
+					name: "command|info", arity: -2, categories: []string{"@connection"},
+					summary: "Returns information about one, multiple or all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of commands to look up",
+				},
+				&command{
+					name: "command|docs", arity: -2, categories: []string{"@connection"},
+					summary: "Returns documentary information about one, multiple or all commands.", since: "7.0.0", group: "server", complexity: "O(N) where N is the number of commands to look up",
+				},
+				&command{
+					name: "command|getkeys", arity: -3, categories: []string{"@connection"},
+					summary: "Extracts the key names from an arbitrary command.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of arguments to the command",
+				},
+			),
+			handler: (*Handler).commandCommand,
+		},
+
+		{
+			name: "get", arity: 2, flags: flagReadOnly | flagFast, categories: []string{"@string"},
+			keySpecs: []keySpec{index(1, 0, 1, "RO", "ACCESS")},
+			summary:  "Returns the string value of a key.", since: "1.0.0", group: "string", complexity: "O(1)",
+			handler: (*Handler).getCommand,
+		},
+		{
+			name: "set", arity: -3, flags: flagWrite, categories: []string{"@string"},
+			keySpecs: []keySpec{index(1, 0, 1, "RW", "ACCESS", "UPDATE", "VARIABLE_FLAGS")},
+			summary:  "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", since: "1.0.0", group: "string", complexity: "O(1)",
+			handler: (*Handler).setCommand,
+		},
+		{
+			name: "del", arity: -2, flags: flagWrite, categories: []string{"@keyspace"},
+			keySpecs: []keySpec{index(1, -1, 1, "RM", "DELETE")},
+			summary:  "Deletes one or more keys.", since: "1.0.0", group: "generic", complexity: "O(N) where N is the number of keys that will be removed.",
+			handler: (*Handler).delCommand,
+		},
+		{
+			name: "keys", arity: 2, flags: flagReadOnly, categories: []string{"@keyspace", "@dangerous"},
+			summary: "Returns all key names that match a pattern.", since: "1.0.0", group: "generic", complexity: "O(N) with N being the number of keys in the database",
+			handler: (*Handler).keysCommand,
+		},
+		{
+			name: "dump", arity: 2, flags: flagReadOnly, categories: []string{"@keyspace"},
+			keySpecs: []keySpec{index(1, 0, 1, "RO", "ACCESS")},
+			summary:  "Returns a serialized representation of the value stored at a key.", since: "2.6.0", group: "generic", complexity: "O(1) to access the key and additional O(N*M) to serialize it",
+			handler: (*Handler).dumpCommand,
+		},
+		{
+			name: "restore", arity: -4, flags: flagWrite, categories: []string{"@keyspace", "@dangerous"},
+			keySpecs: []keySpec{index(1, 0, 1, "OW", "UPDATE")},
+			summary:  "Creates a key from the serialized representation of a value.", since: "2.6.0", group: "generic", complexity: "O(1) to create the new key and additional O(N*M) to reconstruct the serialized value",
+			handler: (*Handler).restoreCommand,
+		},
+		{
+			name: "restore-asking", arity: -4, flags: flagWrite | flagAsking, categories: []string{"@keyspace", "@dangerous"},
+			keySpecs: []keySpec{index(1, 0, 1, "OW", "UPDATE")},
+			summary:  "An internal command for migrating keys in a cluster.", since: "3.0.0", group: "server", complexity: "O(1) to create the new key and additional O(N*M) to reconstruct the serialized value",
+			handler: (*Handler).restoreCommand,
+		},
+		{
+			name: "migrate", arity: -6, flags: flagWrite | flagNoScript | flagNoPropagate | flagExclusive, categories: []string{"@keyspace", "@dangerous"},
+			keySpecs: []keySpec{
+				index(3, 0, 1, "RW", "ACCESS", "DELETE", "INCOMPLETE"),
+				keyword("KEYS", -2, -1, 1, "RW", "ACCESS", "DELETE", "INCOMPLETE"),
+			},
+			getKeys: migrateKeys,
+			summary: "Atomically transfers a key from one Redis instance to another.", since: "2.6.0", group: "generic", complexity: "This command actually executes a DUMP+DEL in the source instance, and a RESTORE in the target instance.",
+			handler: (*Handler).migrateCommand,
+		},
+
+		{
+			name: "subscribe", arity: -2, flags: flagPubSub | flagNoScript | flagNoMulti,
+			summary: "Listens for messages published to channels.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of channels to subscribe to.",
+			handler: (*Handler).subscribeCommand,
+		},
+		{
+			name: "unsubscribe", arity: -1, flags: flagPubSub | flagNoScript | flagNoMulti,
+			summary: "Stops listening to messages posted to channels.", since: "2.0.0", group: "pubsub", complexity: "O(N) where N is the number of channels to unsubscribe.",
+			handler: (*Handler).unsubscribeCommand,
+		},
+		{
+			name: "publish", arity: 3, flags: flagPubSub | flagFast,
+			summary: "Posts a message to a channel.", since: "2.0.0", group: "pubsub", complexity: "O(N+M) where N is the number of clients subscribed to the receiving channel and M is the total number of subscribed patterns (by any client).",
+			handler: (*Handler).publishCommand,
+		},
+
+		{
+			name: "multi", arity: 1, flags: flagNoScript | flagFast | flagNoMulti, categories: []string{"@transaction"},
+			summary: "Starts a transaction.", since: "1.2.0", group: "transactions", complexity: "O(1)",
+			handler: (*Handler).multiCommand,
+		},
+		{
+			name: "exec", arity: 1, flags: flagNoScript, categories: []string{"@transaction"},
+			summary: "Executes all commands in a transaction.", since: "1.2.0", group: "transactions", complexity: "Depends on commands in the transaction",
+			handler: (*Handler).execCommand,
+		},
+		{
+			name: "discard", arity: 1, flags: flagNoScript | flagFast, categories: []string{"@transaction"},
+			summary: "Discards a transaction.", since: "2.0.0", group: "transactions", complexity: "O(N), when N is the number of queued commands",
+			handler: (*Handler).discardCommand,
+		},
+		{
+			name: "watch", arity: -2, flags: flagNoScript | flagFast | flagNoMulti, categories: []string{"@transaction"},
+			keySpecs: []keySpec{index(1, -1, 1, "RO")},
+			summary:  "Monitors changes to keys to determine the execution of a transaction.", since: "2.2.0", group: "transactions", complexity: "O(1) for every key.",
+			handler: (*Handler).watchCommand,
+		},
+		{
+			name: "unwatch", arity: 1, flags: flagNoScript | flagFast, categories: []string{"@transaction"},
+			summary: "Forgets about watched keys of a transaction.", since: "2.2.0", group: "transactions", complexity: "O(1)",
+			handler: (*Handler).unwatchCommand,
+		},
+
+		{
+			name: "eval", arity: -3, flags: flagNoScript, categories: []string{"@scripting"},
+			keySpecs: []keySpec{keynum(2, 0, 1, 1, "RW", "ACCESS", "UPDATE")},
+			summary:  "Executes a server-side Lua script.", since: "2.6.0", group: "scripting", complexity: "Depends on the script that is executed.",
+			handler: (*Handler).evalCommand,
+		},
+		{
+			name: "evalsha", arity: -3, flags: flagNoScript, categories: []string{"@scripting"},
+			keySpecs: []keySpec{keynum(2, 0, 1, 1, "RW", "ACCESS", "UPDATE")},
+			summary:  "Executes a server-side Lua script by SHA1 digest.", since: "2.6.0", group: "scripting", complexity: "Depends on the script that is executed.",
+			handler: (*Handler).evalshaCommand,
+		},
+		{
+			name: "script", arity: -2,
+			summary: "A container for Lua scripts management commands.", since: "2.6.0", group: "scripting", complexity: "Depends on subcommand.",
+			subcommands: subcommands(
+				&command{
+					name: "script|load", arity: 3, flags: flagNoScript, categories: []string{"@scripting"},
+					summary: "Loads a server-side Lua script to the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the length in bytes of the script body.",
+				},
+				&command{
+					name: "script|exists", arity: -3, flags: flagNoScript, categories: []string{"@scripting"},
+					summary: "Determines whether server-side Lua scripts exist in the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the number of scripts to check (so checking a single script is an O(1) operation).",
+				},
+				&command{
+					name: "script|flush", arity: -2, flags: flagNoScript, categories: []string{"@scripting"},
+					summary: "Removes all server-side Lua scripts from the script cache.", since: "2.6.0", group: "scripting", complexity: "O(N) with N being the number of scripts in cache",
+				},
+				&command{
+					name: "script|kill", arity: 2, flags: flagNoScript | flagAllowBusy, categories: []string{"@scripting"},
+					summary: "Terminates a server-side Lua script during execution.", since: "2.6.0", group: "scripting", complexity: "O(1)",
+				},
+			),
+			handler: (*Handler).scriptCommand,
+		},
+		{
+			name: "fcall", arity: -3, flags: flagNoScript, categories: []string{"@scripting"},
+			keySpecs: []keySpec{keynum(2, 0, 1, 1, "RW", "ACCESS", "UPDATE")},
+			summary:  "Invokes a function.", since: "7.0.0", group: "scripting", complexity: "Depends on the function that is executed.",
+			handler: (*Handler).fcallCommand,
+		},
+		{
+			name: "fcall_ro", arity: -3, flags: flagNoScript, categories: []string{"@scripting"},
+			keySpecs: []keySpec{keynum(2, 0, 1, 1, "RO", "ACCESS")},
+			summary:  "Invokes a read-only function.", since: "7.0.0", group: "scripting", complexity: "Depends on the function that is executed.",
+			handler: (*Handler).fcallroCommand,
+		},
+		{
+			name: "function", arity: -2,
+			summary: "A container for function commands.", since: "7.0.0", group: "scripting", complexity: "Depends on subcommand.",
+			subcommands: subcommands(
+				&command{
+					name: "function|load", arity: -3, flags: flagWrite | flagNoScript, categories: []string{"@scripting"},
+					summary: "Creates a library.", since: "7.0.0", group: "scripting", complexity: "O(1) (considering compilation time is redundant)",
+				},
+				&command{
+					name: "function|kill", arity: 2, flags: flagNoScript | flagAllowBusy, categories: []string{"@scripting"},
+					summary: "Terminates a function during execution.", since: "7.0.0", group: "scripting", complexity: "O(1)",
+				},
+				&command{
+					name: "function|list", arity: -2, flags: flagNoScript, categories: []string{"@scripting"},
+					summary: "Returns information about all libraries.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions",
+				},
+				&command{
+					name: "function|delete", arity: 3, flags: flagWrite | flagNoScript, categories: []string{"@scripting"},
+					summary: "Deletes a library and its functions.", since: "7.0.0", group: "scripting", complexity: "O(1)",
+				},
+				&command{
+					name: "function|flush", arity: -2, flags: flagWrite | flagNoScript, categories: []string{"@scripting"},
+					summary: "Deletes all libraries and functions.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions deleted",
+				},
+				&command{
+					name: "function|dump", arity: 2, flags: flagNoScript, categories: []string{"@scripting"},
+					summary: "Dumps all libraries into a serialized binary payload.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions",
+				},
+				&command{
+					name: "function|restore", arity: -3, flags: flagWrite | flagNoScript, categories: []string{"@scripting"},
+					summary: "Restores all libraries from a payload.", since: "7.0.0", group: "scripting", complexity: "O(N) where N is the number of functions on the payload",
+				},
+			),
+			handler: (*Handler).functionCommand,
+		},
+
+		{
+			name: "replconf", arity: -1, flags: flagAdmin | flagNoScript | flagNoMulti | flagAllowBusy,
+			summary: "An internal command for configuring the replication stream.", since: "3.0.0", group: "server", complexity: "O(1)",
+			handler: (*Handler).replconfCommand,
+		},
+		{
+			name: "psync", arity: -3, flags: flagAdmin | flagNoScript | flagNoMulti,
+			summary: "An internal command used in replication.", since: "2.8.0", group: "server",
+			handler: (*Handler).psyncCommand,
+		},
+		{
+			name: "wait", arity: 3, flags: flagNoScript | flagNoMulti,
+			summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.", since: "3.0.0", group: "generic", complexity: "O(1)",
+			handler: (*Handler).waitCommand,
+		},
+		{
+			name: "waitaof", arity: 4, flags: flagNoScript | flagNoMulti,
+			summary: "Blocks until all of the preceding write commands sent by the connection are written to the append-only file of the master and/or replicas.", since: "7.2.0", group: "generic", complexity: "O(1)",
+			handler: (*Handler).waitaofCommand,
+		},
+		{
+			name: "replicaof", arity: 3, flags: flagAdmin | flagNoScript | flagNoMulti,
+			summary: "Configures a server as replica of another, or promotes it to a master.", since: "5.0.0", group: "server", complexity: "O(1)",
+			handler: (*Handler).replicaofCommand,
+		},
+		{
+			name: "slaveof", arity: 3, flags: flagAdmin | flagNoScript | flagNoMulti,
+			summary: "Sets a Redis server as a replica of another, or promotes it to being a master.", since: "1.0.0", group: "server", complexity: "O(1)",
+			handler: (*Handler).replicaofCommand,
+		},
+
+		{
+			name: "cluster", arity: -2,
+			summary: "A container for Redis Cluster commands.", since: "3.0.0", group: "cluster", complexity: "Depends on subcommand.",
+			subcommands: subcommands(
+				&command{name: "cluster|myid", arity: 2, summary: "Returns the ID of a node.", since: "3.0.0", group: "cluster", complexity: "O(1)"},
+				&command{name: "cluster|info", arity: 2, summary: "Returns information about the state of a node.", since: "3.0.0", group: "cluster", complexity: "O(1)"},
+				&command{name: "cluster|nodes", arity: 2, summary: "Returns the cluster configuration for a node.", since: "3.0.0", group: "cluster", complexity: "O(N) where N is the total number of Cluster nodes"},
+				&command{name: "cluster|keyslot", arity: 3, summary: "Returns the hash slot for a key.", since: "3.0.0", group: "cluster", complexity: "O(N) where N is the number of bytes in the key"},
+				&command{name: "cluster|meet", arity: -4, flags: flagAdmin | flagNoScript, categories: []string{"@dangerous"}, summary: "Forces a node to handshake with another node.", since: "3.0.0", group: "cluster", complexity: "O(1)"},
+				&command{name: "cluster|addslots", arity: -3, flags: flagAdmin | flagNoScript, categories: []string{"@dangerous"}, summary: "Assigns new hash slots to a node.", since: "3.0.0", group: "cluster", complexity: "O(N) where N is the total number of hash slot arguments"},
+				&command{name: "cluster|setslot", arity: -4, flags: flagAdmin | flagNoScript, categories: []string{"@dangerous"}, summary: "Binds a hash slot to a node.", since: "3.0.0", group: "cluster", complexity: "O(1)"},
+				&command{name: "cluster|countkeysinslot", arity: 3, summary: "Returns the number of keys in a hash slot.", since: "3.0.0", group: "cluster", complexity: "O(1)"},
+				&command{name: "cluster|getkeysinslot", arity: 4, summary: "Returns the key names in a hash slot.", since: "3.0.0", group: "cluster", complexity: "O(N) where N is the number of requested keys"},
+				&command{name: "cluster|slots", arity: 2, summary: "Returns the mapping of cluster slots to nodes.", since: "3.0.0", group: "cluster", complexity: "O(N) where N is the total number of Cluster nodes"},
+				&command{name: "cluster|shards", arity: 2, summary: "Returns the mapping of cluster slots to shards.", since: "7.0.0", group: "cluster", complexity: "O(N) where N is the total number of cluster nodes"},
+			),
+			handler: (*Handler).clusterCommand,
+		},
+		{
+			name: "asking", arity: 1, flags: flagFast, categories: []string{"@connection"},
+			summary: "Signals that a cluster client is following an -ASK redirect.", since: "3.0.0", group: "cluster", complexity: "O(1)",
+			handler: (*Handler).askingCommand,
+		},
+	}
+
+	commands = make(map[string]*command, len(table))
+	for _, cmd := range table {
+		for _, sub := range cmd.subcommands {
+			sub.handler = cmd.handler
+		}
+		commands[cmd.name] = cmd
+	}
+}
+
+// subcommands returns the subcommands by the name after the '|'.
+func subcommands(cmds ...*command) map[string]*command {
+	res := make(map[string]*command, len(cmds))
+	for _, cmd := range cmds {
+		_, name, _ := strings.Cut(cmd.name, "|")
+		res[name] = cmd
+	}
+	return res
+}
+
+// lookupCommand returns the command of the given name, in any case. It returns nil for an unknown command.
+func lookupCommand(name string) *command {
+	return commands[strings.ToLower(name)]
+}
+
+// checkArity returns false if the number of arguments, including the command name, doesn't match the arity.
+func (cmd *command) checkArity(args int) bool {
+	if cmd.arity < 0 {
+		return args >= -cmd.arity
+	}
+	return args == cmd.arity
+}
+
+// propagatible returns true if the request of this command is propagated to the slaves and the AOF as is.
+func (cmd *command) propagatible() bool {
+	return cmd.flags&flagWrite != 0 && cmd.flags&flagNoPropagate == 0
+}
+
+// keysOf returns the keys the request accesses.
+func (cmd *command) keysOf(args []string) []string {
+	if cmd.getKeys != nil {
+		return cmd.getKeys(args)
+	}
+
+	var keys []string
+	for _, spec := range cmd.keySpecs {
+		keys = append(keys, spec.keysOf(args)...)
+	}
+	return keys
+}
+
+// keysOf returns the keys found by the key spec.
+func (spec keySpec) keysOf(args []string) []string {
+	first := spec.index
+	if spec.keyword != "" {
+		first = 0
+
+		start, step := spec.startFrom, 1
+		if start < 0 {
+			start, step = len(args)+start, -1
+		}
+		for i := start; 0 < i && i < len(args); i += step {
+			if strings.EqualFold(args[i], spec.keyword) {
+				first = i + 1
+				break
+			}
+		}
+	}
+	if first <= 0 || first >= len(args) {
+		return nil
+	}
+
+	if spec.keyNum {
+		if first+spec.keyNumIdx >= len(args) {
+			return nil
+		}
+		num, err := strconv.Atoi(args[first+spec.keyNumIdx])
+		if err != nil || num <= 0 {
+			return nil
+		}
+
+		keys := make([]string, 0, num)
+		for i := first + spec.firstKey; len(keys) < num && i < len(args); i += spec.keyStep {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+
+	last := first + spec.lastKey
+	if spec.lastKey < 0 {
+		last = len(args) + spec.lastKey
+	}
+
+	keys := make([]string, 0)
+	for i := first; i <= last && i < len(args); i += spec.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// migrateKeys returns the keys of MIGRATE host port key|"" destination-db timeout [...] [KEYS key ...].
+func migrateKeys(args []string) []string {
+	if args[3] != "" {
+		return []string{args[3]}
+	}
+
+	for i := 6; i < len(args); i++ {
+		if strings.EqualFold(args[i], "KEYS") {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+func (h *Handler) pingCommand(msg *ArrayMessage) error {
+	if !h.server {
+		// We don't handle ping when master sends to slave for keep-alive purpose.
+		return nil
+	}
+
+	return h.handlePing()
+}
+
+func (h *Handler) echoCommand(msg *ArrayMessage) error {
+	return h.handleEcho(msg.Token(1))
+}
+
+func (h *Handler) helloCommand(msg *ArrayMessage) error {
+	return h.handleHello(msg.SliceFrom(1))
+}
+
+func (h *Handler) clientCommand(msg *ArrayMessage) error {
+	return h.handleClient(msg.SliceFrom(1))
+}
+
+func (h *Handler) infoCommand(msg *ArrayMessage) error {
+	return h.handleInfo()
+}
+
+func (h *Handler) configCommand(msg *ArrayMessage) error {
+	return h.handleConfig(msg.SliceFrom(1))
+}
+
+func (h *Handler) saveCommand(msg *ArrayMessage) error {
+	return h.handleSave()
+}
+
+func (h *Handler) commandCommand(msg *ArrayMessage) error {
+	return h.handleCommand(msg.SliceFrom(1))
+}
+
+func (h *Handler) getCommand(msg *ArrayMessage) error {
+	return h.handleGet(msg.Token(1))
+}
+
+func (h *Handler) setCommand(msg *ArrayMessage) error {
+	options := map[string][]string{}
+	if msg.Len() > 3 {
+		var err error
+		options, err = BuildOptions(
+			msg.SliceFrom(3),
+			OptionConfig{"EX": 1, "PX": 1, "EXAT": 1, "PXAT": 1, "NX": 0, "XX": 0, "KEEPTTL": 0, "GET": 0},
+		)
+		if err != nil {
+			return h.replyError(SYNTAXERR)
+		}
+	}
+
+	return h.handleSet(msg.Token(1), msg.Token(2), options)
+}
+
+func (h *Handler) delCommand(msg *ArrayMessage) error {
+	return h.handleDel(msg.SliceFrom(1))
+}
+
+func (h *Handler) keysCommand(msg *ArrayMessage) error {
+	return h.handleKeys(msg.SliceFrom(1))
+}
+
+func (h *Handler) dumpCommand(msg *ArrayMessage) error {
+	return h.handleDump(msg.Token(1))
+}
+
+func (h *Handler) restoreCommand(msg *ArrayMessage) error {
+	return h.handleRestore(msg.SliceFrom(1))
+}
+
+func (h *Handler) migrateCommand(msg *ArrayMessage) error {
+	return h.handleMigrate(msg.SliceFrom(1))
+}
+
+func (h *Handler) subscribeCommand(msg *ArrayMessage) error {
+	return h.handleSubscribe(msg.SliceFrom(1))
+}
+
+func (h *Handler) unsubscribeCommand(msg *ArrayMessage) error {
+	return h.handleUnsubscribe(msg.SliceFrom(1))
+}
+
+func (h *Handler) publishCommand(msg *ArrayMessage) error {
+	received := h.state.PubSub().Publish(msg.Token(1), msg.Token(2))
+	if err := h.conn.Write(NewInt(received)); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) replconfCommand(msg *ArrayMessage) error {
+	return h.handleReplConf(msg.SliceFrom(1))
+}
+
+func (h *Handler) psyncCommand(msg *ArrayMessage) error {
+	// slaves can serve sub-slaves, as long as they are in sync with their own master.
+	if role := h.repl.Role(); role != "master" && !h.repl.MasterLinkUp() {
+		return h.writeError("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+
+	offset, err := strconv.Atoi(msg.Token(2))
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+
+	return h.handlePsync(msg.Token(1), offset)
+}
+
+func (h *Handler) waitCommand(msg *ArrayMessage) error {
+	if role := h.repl.Role(); role != "master" {
+		return h.writeError("ERR WAIT cannot be used with replica instances.")
+	}
+
+	numReplicas, err := strconv.Atoi(msg.Token(1))
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+
+	timeout, err := strconv.Atoi(msg.Token(2))
+	if err != nil || timeout < 0 {
+		return h.writeError("ERR timeout is not an integer or out of range")
+	}
+
+	return h.handleWait(numReplicas, timeout)
+}
+
+func (h *Handler) waitaofCommand(msg *ArrayMessage) error {
+	if role := h.repl.Role(); role != "master" {
+		return h.writeError("ERR WAITAOF cannot be used with replica instances.")
+	}
+
+	numLocal, err := strconv.Atoi(msg.Token(1))
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+
+	numReplicas, err := strconv.Atoi(msg.Token(2))
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+
+	timeout, err := strconv.Atoi(msg.Token(3))
+	if err != nil || timeout < 0 {
+		return h.writeError("ERR timeout is not an integer or out of range")
+	}
+
+	return h.handleWaitAOF(numLocal, numReplicas, timeout)
+}
+
+func (h *Handler) replicaofCommand(msg *ArrayMessage) error {
+	return h.handleReplicaOf(msg.Token(1), msg.Token(2))
+}
+
+func (h *Handler) clusterCommand(msg *ArrayMessage) error {
+	return h.handleCluster(msg.SliceFrom(1))
+}
+
+func (h *Handler) askingCommand(msg *ArrayMessage) error {
+	if h.state.Cluster() == nil {
+		if err := h.conn.Write(CLUSTERDISABLED); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+		return nil
+	}
+
+	h.asking = true
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
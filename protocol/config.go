@@ -1,88 +1,208 @@
 package protocol
 
 import (
-	"log"
+	"fmt"
+	"net"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/info"
+	"github.com/codecrafters-io/redis-starter-go/storage"
 )
 
-type SlaveAckWG struct {
-	cnt int
-	wg  *sync.WaitGroup
+// ackWaiter is a WAIT waiting for the slaves to acknowledge its offset.
+type ackWaiter struct {
+	offset uint64 // the offset that the slaves should acknowledge.
+	needed int    // the number of slaves that should acknowledge the offset.
+	aof    bool   // true if the offset should be fsynced to the slaves' AOF (WAITAOF).
+	done   chan struct{}
 }
 
-func NewSlaveAckWG(howmany int) *SlaveAckWG {
-	wg := &sync.WaitGroup{}
-	wg.Add(howmany)
+// MasterConfig is a config shared by all Master handlers.
+type MasterConfig struct {
+	slaves            map[string]*Slave
+	slavesLock        sync.RWMutex
+	propagationOffset uint64 // the offset that we expect to be acknowledged by the next REPLCONF ACK ?? response.
+	ackWaiters        map[*ackWaiter]struct{}
+	bufferLimit       config.OutputBufferLimit // the output buffer limit of each slave.
+
+	// backlog is the end of the replication stream, up to backlogSize bytes, so that a slave which lost the link
+	// can continue from its offset instead of resyncing from scratch.
+	backlog     []byte
+	backlogSize int
+}
 
-	return &SlaveAckWG{
-		cnt: howmany,
-		wg:  wg,
+func NewMasterConfig(bufferLimit config.OutputBufferLimit, backlogSize int) *MasterConfig {
+	return &MasterConfig{
+		slaves:      make(map[string]*Slave, 0),
+		slavesLock:  sync.RWMutex{},
+		ackWaiters:  make(map[*ackWaiter]struct{}),
+		bufferLimit: bufferLimit,
+		backlogSize: backlogSize,
 	}
 }
 
-func (saw *SlaveAckWG) Done() bool {
-	saw.wg.Done()
-	saw.cnt--
+// Propagate queues the message to all slaves through the replication stream, and returns the offset right after
+// the message. It never blocks on slow slaves: the slaves that cannot keep up with the stream are disconnected instead.
+func (mc *MasterConfig) Propagate(msg Message) uint64 {
+	return mc.PropagateRaw(msg.Redis())
+}
 
-	return saw.cnt == 0
+// PropagateRaw is Propagate for the payload already encoded, such as the exact bytes a slave received from
+// its own master and forwards to its sub-slaves.
+func (mc *MasterConfig) PropagateRaw(payload []byte) uint64 {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	return mc.propagate(payload)
 }
 
-func (saw *SlaveAckWG) TimedWait(timeoutMillis int) {
-	c := make(chan struct{})
-	go func() {
-		defer close(c)
-		saw.wg.Wait()
-	}()
+// PropagateWrite is Propagate for a write, which is appended to the AOF (if any) as well. Both happen under the
+// same lock, so that the AOF has the writes in the order of the replication stream.
+func (mc *MasterConfig) PropagateWrite(msg Message, aof *storage.AOF) uint64 {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
 
-	select {
-	case <-c:
-	case <-time.After(time.Millisecond * time.Duration(timeoutMillis)):
+	payload := msg.Redis()
+	offset := mc.propagate(payload)
+	if aof != nil {
+		if err := aof.Append(payload, offset); err != nil {
+			fmt.Fprintf(os.Stderr, "aof.Append failed: %v\n", err)
+		}
 	}
-}
 
-// MasterConfig is a config shared by all Master handlers.
-type MasterConfig struct {
-	slaves            map[string]*Slave
-	slavesLock        sync.RWMutex
-	propagationOffset uint64 // the offset that we expect to be acknowledged by the next REPLCONF ACK ?? response.
-	slaveAckWGs       []*SlaveAckWG
+	return offset
 }
 
-func NewMasterConfig() *MasterConfig {
-	return &MasterConfig{
-		slaves:     make(map[string]*Slave, 0),
-		slavesLock: sync.RWMutex{},
+// propagate should be called with the lock held.
+func (mc *MasterConfig) propagate(payload []byte) uint64 {
+	mc.propagationOffset += uint64(len(payload))
+
+	if mc.backlogSize > 0 {
+		mc.backlog = append(mc.backlog, payload...)
+		if over := len(mc.backlog) - mc.backlogSize; over > 0 {
+			mc.backlog = mc.backlog[over:]
+		}
 	}
-}
 
-func (mc *MasterConfig) ForEachSlave(f func(mc *MasterConfig, s *Slave)) {
-	for _, s := range mc.slaves {
-		f(mc, s)
+	for addr, s := range mc.slaves {
+		if err := s.Enqueue(payload); err != nil {
+			fmt.Fprintf(os.Stderr, "[master] disconnecting slave %s: %v\n", addr, err)
+			s.Close()
+			delete(mc.slaves, addr)
+		}
 	}
+
+	return mc.propagationOffset
+}
+
+// SlaveNum returns the number of the registered slaves.
+func (mc *MasterConfig) SlaveNum() int {
+	mc.slavesLock.RLock()
+	defer mc.slavesLock.RUnlock()
+
+	return len(mc.slaves)
+}
+
+func (mc *MasterConfig) PropagationOffset() uint64 {
+	mc.slavesLock.RLock()
+	defer mc.slavesLock.RUnlock()
+
+	return mc.propagationOffset
+}
+
+// ResetPropagation starts the propagation from the given offset. The backlog is emptied, as it is about another
+// replication history.
+func (mc *MasterConfig) ResetPropagation(offset uint64) {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	mc.propagationOffset = offset
+	mc.backlog = nil
 }
 
-func (mc *MasterConfig) AdvancePropagation(amount int) {
-	mc.propagationOffset += uint64(amount)
+// WaitForSlaves waits until the given number of slaves acknowledge the offset, or the timeout expires.
+// Zero timeout means waiting forever. It returns the number of slaves that acknowledged the offset.
+func (mc *MasterConfig) WaitForSlaves(numReplicas int, offset uint64, timeout time.Duration) int {
+	return mc.waitForSlaves(numReplicas, offset, timeout, false)
 }
 
-func (mc *MasterConfig) NewSlaveAckWG(howmany int) *SlaveAckWG {
+// WaitForSlavesAOF is WaitForSlaves for the offset fsynced to the slaves' AOF.
+func (mc *MasterConfig) WaitForSlavesAOF(numReplicas int, offset uint64, timeout time.Duration) int {
+	return mc.waitForSlaves(numReplicas, offset, timeout, true)
+}
+
+func (mc *MasterConfig) waitForSlaves(numReplicas int, offset uint64, timeout time.Duration, aof bool) int {
+	mc.slavesLock.Lock()
+	if synced := mc.syncedSlaveNum(offset, aof); synced >= numReplicas {
+		mc.slavesLock.Unlock()
+		return synced
+	}
+
+	w := &ackWaiter{
+		offset: offset,
+		needed: numReplicas,
+		aof:    aof,
+		done:   make(chan struct{}),
+	}
+	mc.ackWaiters[w] = struct{}{}
+	mc.slavesLock.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-w.done:
+	case <-expired:
+	}
+
 	mc.slavesLock.Lock()
 	defer mc.slavesLock.Unlock()
 
-	new := NewSlaveAckWG(howmany)
-	mc.slaveAckWGs = append(mc.slaveAckWGs, new)
+	delete(mc.ackWaiters, w)
+	return mc.syncedSlaveNum(offset, aof)
+}
+
+// GoodSlaveNum returns the number of online slaves which have ACKed within the given lag.
+func (mc *MasterConfig) GoodSlaveNum(maxLag time.Duration) int {
+	mc.slavesLock.RLock()
+	defer mc.slavesLock.RUnlock()
+
+	var result int
+	for _, s := range mc.slaves {
+		if s.state == "online" && time.Since(s.lastAckTime) <= maxLag {
+			result += 1
+		}
+	}
 
-	return new
+	return result
 }
 
-func (mc *MasterConfig) SyncedSlaveNum() int {
+// SyncedSlaveNum returns the number of slaves that acknowledged the given offset.
+func (mc *MasterConfig) SyncedSlaveNum(offset uint64) int {
 	mc.slavesLock.RLock()
 	defer mc.slavesLock.RUnlock()
 
+	return mc.syncedSlaveNum(offset, false)
+}
+
+// syncedSlaveNum should be called with the lock held. If aof is true, the offset fsynced to the slaves' AOF
+// is counted instead.
+func (mc *MasterConfig) syncedSlaveNum(offset uint64, aof bool) int {
 	var result int
 	for _, s := range mc.slaves {
-		if mc.propagationOffset == s.propagatedOffset {
+		acked := s.propagatedOffset
+		if aof {
+			acked = s.aofOffset
+		}
+
+		if acked >= offset {
 			result += 1
 		}
 	}
@@ -90,38 +210,259 @@ func (mc *MasterConfig) SyncedSlaveNum() int {
 	return result
 }
 
-func (mc *MasterConfig) AckSlave(conn *Connection, offset uint64) {
+// AckSlave records the offsets acknowledged by the slave, and releases the waiters whose offset is
+// acknowledged by enough slaves. aofOffset is the offset fsynced to the slave's AOF (0 if it has no AOF).
+func (mc *MasterConfig) AckSlave(conn *Connection, offset, aofOffset uint64) error {
 	mc.slavesLock.Lock()
 	defer mc.slavesLock.Unlock()
 
-	remoteAddr := conn.conn.RemoteAddr().String()
+	remoteAddr := conn.RemoteAddr().String()
 	s, ok := mc.slaves[remoteAddr]
 	if !ok {
-		log.Fatal("cannot find the right slave: ", remoteAddr)
+		return fmt.Errorf("cannot find the right slave: %s", remoteAddr)
+	}
+
+	if offset > s.propagatedOffset {
+		s.propagatedOffset = offset
+	}
+	if aofOffset > s.aofOffset {
+		s.aofOffset = aofOffset
+	}
+	s.lastAckTime = time.Now()
+
+	for w := range mc.ackWaiters {
+		if mc.syncedSlaveNum(w.offset, w.aof) >= w.needed {
+			close(w.done)
+			delete(mc.ackWaiters, w)
+		}
 	}
 
+	return nil
+}
+
+// AddSlave registers a new slave. listeningPort is the one the slave gave us with REPLCONF listening-port.
+// It returns the offset from which the replication stream to the slave starts.
+func (mc *MasterConfig) AddSlave(conn *Connection, listeningPort int) uint64 {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	s := NewSlave(conn, listeningPort, mc.bufferLimit)
+
+	// the slave starts from the snapshot taken at the current offset.
+	s.propagatedOffset = mc.propagationOffset
+	mc.slaves[conn.RemoteAddr().String()] = s
+
+	return mc.propagationOffset
+}
+
+// ContinueSlave registers a slave which has the replication stream up to the given offset, and queues the rest
+// of the stream from the backlog. It returns false if the backlog doesn't go back to the offset anymore, and the
+// slave should resync from scratch.
+func (mc *MasterConfig) ContinueSlave(conn *Connection, listeningPort int, offset uint64) bool {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	start := mc.propagationOffset - uint64(len(mc.backlog))
+	if offset < start || offset > mc.propagationOffset {
+		return false
+	}
+
+	s := NewSlave(conn, listeningPort, mc.bufferLimit)
 	s.propagatedOffset = offset
+	if missed := mc.backlog[offset-start:]; len(missed) > 0 {
+		if err := s.Enqueue(append([]byte(nil), missed...)); err != nil {
+			return false
+		}
+	}
+	mc.slaves[conn.RemoteAddr().String()] = s
+
+	return true
+}
+
+// RemoveSlave disconnects and unregisters the slave. It does nothing if the connection is not a slave.
+func (mc *MasterConfig) RemoveSlave(conn *Connection) {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	remoteAddr := conn.RemoteAddr().String()
+	if s, ok := mc.slaves[remoteAddr]; ok && s.conn == conn {
+		s.Close()
+		delete(mc.slaves, remoteAddr)
+	}
+}
+
+// RemoveAllSlaves disconnects and unregisters all slaves, so that they resync from scratch.
+func (mc *MasterConfig) RemoveAllSlaves() {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
 
-	front := mc.slaveAckWGs[0]
-	if front.Done() {
-		mc.slaveAckWGs = mc.slaveAckWGs[1:]
+	for addr, s := range mc.slaves {
+		s.Close()
+		delete(mc.slaves, addr)
 	}
 }
 
-func (mc *MasterConfig) AddSlave(conn *Connection) {
+// SetSlaveOnline marks the slave as online, which means the initial synchronization is done.
+// The replication stream buffered during the synchronization starts flowing to the slave.
+func (mc *MasterConfig) SetSlaveOnline(conn *Connection) {
 	mc.slavesLock.Lock()
 	defer mc.slavesLock.Unlock()
 
-	mc.slaves[conn.RemoteAddr().String()] = NewSlave(conn)
+	if s, ok := mc.slaves[conn.RemoteAddr().String()]; ok {
+		s.state = "online"
+		go s.runWriter()
+	}
+}
+
+// DropTimedOutSlaves disconnects the slaves which haven't ACKed within the given timeout.
+func (mc *MasterConfig) DropTimedOutSlaves(timeout time.Duration) {
+	mc.slavesLock.Lock()
+	defer mc.slavesLock.Unlock()
+
+	for addr, s := range mc.slaves {
+		if time.Since(s.lastAckTime) <= timeout {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "[master] disconnecting timed out slave: %s\n", addr)
+		s.Close()
+		delete(mc.slaves, addr)
+	}
+}
+
+// SlavesInfo returns the slaves' status for INFO replication.
+func (mc *MasterConfig) SlavesInfo() []info.Slave {
+	mc.slavesLock.RLock()
+	defer mc.slavesLock.RUnlock()
+
+	res := make([]info.Slave, 0, len(mc.slaves))
+	for _, s := range mc.slaves {
+		res = append(res, s.Info())
+	}
+
+	return res
 }
 
 type Slave struct {
 	conn             *Connection
-	propagatedOffset uint64 // the offset that the slave last acked with REPLCONF ACK ?? response.
+	listeningPort    int
+	state            string
+	propagatedOffset uint64    // the offset that the slave last acked with REPLCONF ACK ?? response.
+	aofOffset        uint64    // the offset that the slave last acked with REPLCONF ACK ?? FACK ?? response.
+	lastAckTime      time.Time // the time when the slave last acked.
+
+	// output is the replication stream not written to the slave yet. It is written by its own goroutine,
+	// so that a slow slave cannot stall the others.
+	outputLock     sync.Mutex
+	outputCond     *sync.Cond
+	output         [][]byte
+	outputSize     int
+	bufferLimit    config.OutputBufferLimit
+	softLimitSince time.Time // the time when the output first exceeded the soft limit.
+	closed         bool
+}
+
+func NewSlave(conn *Connection, listeningPort int, bufferLimit config.OutputBufferLimit) *Slave {
+	s := &Slave{
+		conn:          conn,
+		listeningPort: listeningPort,
+		state:         "wait_bgsave",
+		lastAckTime:   time.Now(), // give the new slave a full timeout to send its first ACK.
+		bufferLimit:   bufferLimit,
+	}
+	s.outputCond = sync.NewCond(&s.outputLock)
+
+	return s
+}
+
+// Enqueue appends the payload to the slave's output. It returns an error if the slave should be disconnected,
+// either because the output exceeds the buffer limits or because the slave is already gone.
+func (s *Slave) Enqueue(payload []byte) error {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("connection closed")
+	}
+
+	s.output = append(s.output, payload)
+	s.outputSize += len(payload)
+	s.outputCond.Signal()
+
+	limit := s.bufferLimit
+	if limit.HardBytes > 0 && s.outputSize > limit.HardBytes {
+		return fmt.Errorf("output buffer exceeded the hard limit: %d > %d", s.outputSize, limit.HardBytes)
+	}
+
+	if limit.SoftBytes > 0 && s.outputSize > limit.SoftBytes {
+		if s.softLimitSince.IsZero() {
+			s.softLimitSince = time.Now()
+		} else if time.Since(s.softLimitSince) > time.Duration(limit.SoftSeconds)*time.Second {
+			return fmt.Errorf("output buffer exceeded the soft limit for %d seconds: %d > %d",
+				limit.SoftSeconds, s.outputSize, limit.SoftBytes)
+		}
+	} else {
+		s.softLimitSince = time.Time{}
+	}
+
+	return nil
 }
 
-func NewSlave(conn *Connection) *Slave {
-	return &Slave{
-		conn: conn,
+// Close disconnects the slave, and stops its writer.
+func (s *Slave) Close() {
+	s.outputLock.Lock()
+	defer s.outputLock.Unlock()
+
+	s.closed = true
+	s.output = nil
+	s.outputCond.Signal()
+	s.conn.Close()
+}
+
+// runWriter writes the output to the slave until the slave is closed.
+func (s *Slave) runWriter() {
+	for {
+		s.outputLock.Lock()
+		for len(s.output) == 0 && !s.closed {
+			s.outputCond.Wait()
+		}
+		if s.closed {
+			s.outputLock.Unlock()
+			return
+		}
+
+		pending := s.output
+		s.output = nil
+		s.outputLock.Unlock()
+
+		var written int
+		for _, payload := range pending {
+			if err := s.conn.WriteBytes(payload); err != nil {
+				// the next Enqueue reports this, and the slave gets removed.
+				fmt.Fprintf(os.Stderr, "[master] s.conn.WriteBytes failed: %v\n", err)
+				s.Close()
+				return
+			}
+			written += len(payload)
+		}
+
+		s.outputLock.Lock()
+		s.outputSize -= written
+		s.outputLock.Unlock()
+	}
+}
+
+func (s *Slave) Info() info.Slave {
+	var ip string
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+
+	return info.Slave{
+		IP:     ip,
+		Port:   s.listeningPort,
+		State:  s.state,
+		Offset: int(s.propagatedOffset),
+		Lag:    int(time.Since(s.lastAckTime).Seconds()),
 	}
 }
@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlave_Enqueue_Limits(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// nobody reads from the pipe, so the output piles up.
+	s := NewSlave(NewConnection(server), 6380, config.OutputBufferLimit{HardBytes: 10, SoftBytes: 5, SoftSeconds: 1})
+
+	assert.NoError(t, s.Enqueue([]byte("1234")))
+	assert.NoError(t, s.Enqueue([]byte("56")), "exceeding the soft limit is tolerated for a while")
+	assert.Error(t, s.Enqueue([]byte("7890a")), "exceeding the hard limit")
+
+	s = NewSlave(NewConnection(server), 6380, config.OutputBufferLimit{SoftBytes: 5})
+	assert.NoError(t, s.Enqueue([]byte("123456")))
+	time.Sleep(10 * time.Millisecond)
+	assert.Error(t, s.Enqueue([]byte("7")), "exceeding the soft limit for longer than soft seconds")
+
+	s.Close()
+	assert.Error(t, s.Enqueue([]byte("8")), "closed slave")
+}
+
+// newTestSlaveConn returns the server side of a loopback TCP connection, so that each one has a distinct address.
+func newTestSlaveConn(t *testing.T) *Connection {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	server, err := l.Accept()
+	require.NoError(t, err)
+
+	return NewConnection(server)
+}
+
+func TestMasterConfig_WaitForSlaves_ConcurrentWaiters(t *testing.T) {
+	mc := NewMasterConfig(config.OutputBufferLimit{}, 0)
+	slave1, slave2 := newTestSlaveConn(t), newTestSlaveConn(t)
+	mc.AddSlave(slave1, 6380)
+	mc.AddSlave(slave2, 6381)
+
+	offset1 := mc.Propagate(NewArray([]string{"SET", "a", "1"}))
+	offset2 := mc.Propagate(NewArray([]string{"SET", "b", "2"}))
+
+	results1, results2 := make(chan int), make(chan int)
+	go func() { results1 <- mc.WaitForSlaves(2, offset1, 5*time.Second) }()
+	go func() { results2 <- mc.WaitForSlaves(1, offset2, 5*time.Second) }()
+
+	require.Eventually(t, func() bool {
+		mc.slavesLock.RLock()
+		defer mc.slavesLock.RUnlock()
+		return len(mc.ackWaiters) == 2
+	}, time.Second, time.Millisecond)
+
+	// slave1 catches up with both offsets: the second waiter has enough, but the first one needs another slave.
+	require.NoError(t, mc.AckSlave(slave1, offset2, 0))
+	assert.Equal(t, 1, <-results2)
+
+	select {
+	case <-results1:
+		t.Fatal("the first waiter shouldn't be released by a single slave")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, mc.AckSlave(slave2, offset1, 0))
+	assert.Equal(t, 2, <-results1)
+}
+
+func TestMasterConfig_WaitForSlaves_Timeout(t *testing.T) {
+	mc := NewMasterConfig(config.OutputBufferLimit{}, 0)
+	slave := newTestSlaveConn(t)
+	mc.AddSlave(slave, 6380)
+
+	offset := mc.Propagate(NewArray([]string{"SET", "a", "1"}))
+	assert.Equal(t, 1, mc.WaitForSlaves(1, 0, 0), "nothing written: no need to wait")
+	assert.Equal(t, 0, mc.WaitForSlaves(1, offset, 10*time.Millisecond))
+
+	// a removed slave is not counted, and its ACKs are refused.
+	mc.RemoveSlave(slave)
+	assert.Equal(t, 0, mc.SlaveNum())
+	assert.Error(t, mc.AckSlave(slave, offset, 0))
+}
+
+func TestMasterConfig_PropagateWrite_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	aof, err := storage.OpenAOF(path, "always")
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	mc := NewMasterConfig(config.OutputBufferLimit{}, 0)
+	slave := NewConnection(server)
+	mc.AddSlave(slave, 6380)
+	mc.SetSlaveOnline(slave)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				mc.PropagateWrite(NewArray([]string{"SET", fmt.Sprint(i), fmt.Sprint(j)}), aof)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the AOF has the writes in the order of the replication stream, and the offsets of both match.
+	offset := mc.PropagationOffset()
+	assert.Equal(t, offset, aof.FsyncedOffset())
+
+	received := make([]byte, offset)
+	_, err = io.ReadFull(client, received)
+	require.NoError(t, err)
+
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, int(offset), len(written))
+	assert.Equal(t, string(received), string(written))
+
+	// an older offset, such as the one of a PING propagated in between, doesn't take the fsynced offset back.
+	require.NoError(t, aof.Append(nil, offset-1))
+	assert.Equal(t, offset, aof.FsyncedOffset())
+}
@@ -2,24 +2,63 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// maxLineLength is the longest line accepted, such as the header of a bulk string, or a simple string.
+const maxLineLength = 64 * 1024
+
+// maxOutputBuffer is how many bytes of replies are kept while batching, before they are written anyway.
+const maxOutputBuffer = 64 * 1024
+
 // Connection represents a Redis connection between client and server.
 type Connection struct {
 	conn   net.Conn
 	reader *bufio.Reader
-	token  string
-	offset uint64
+	offset uint64 // the exact number of bytes consumed from this connection.
+
+	// record keeps the raw bytes consumed between StartRecording and StopRecording, nil otherwise.
+	record *bytes.Buffer
+
+	// writeLock serializes writes, as replication writes can come from other goroutines.
+	writeLock sync.Mutex
+
+	// while batching, the messages written are kept in out until Flush, so that the replies to pipelined
+	// requests are written at once. Guarded by writeLock.
+	batching bool
+	out      []byte
+
+	// proto is the protocol version of the replies, 2 or 3. Zero means 2. It's atomic, as other goroutines
+	// write to this connection, such as PUBLISH of other clients.
+	proto atomic.Int32
 }
 
 // NewConnection returns a new RequestLoop instance.
 func NewConnection(c net.Conn) *Connection {
-	return &Connection{
-		conn:   c,
-		reader: bufio.NewReader(c),
+	conn := &Connection{conn: c}
+	conn.reader = bufio.NewReader(flushingReader{c: conn})
+	return conn
+}
+
+// flushingReader writes the messages kept by batching before reading from the network, as the read can block
+// until the peer sends more, and the peer can be waiting for the replies first.
+type flushingReader struct {
+	c *Connection
+}
+
+func (fr flushingReader) Read(b []byte) (int, error) {
+	if err := fr.c.Flush(); err != nil {
+		return 0, err
 	}
+	return fr.c.conn.Read(b)
 }
 
 // Close closes the connection
@@ -31,36 +70,137 @@ func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+func (c *Connection) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadline of the connection. Zero means no deadline.
+func (c *Connection) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
 func (c *Connection) Offset() uint64 {
 	return c.offset
 }
 
-// Read returns just one token from the given connection.
-// The second return value is the total number of bytes read from the connection.
-func (c *Connection) Read() (ret string, _ error) {
-	defer func() {
-		// c.offset is about how much we read from this connection. '2' is for \r\n.
-		c.offset += uint64(len(ret) + 2)
-	}()
+// StartRecording starts keeping the raw bytes consumed from the connection.
+func (c *Connection) StartRecording() {
+	c.record = &bytes.Buffer{}
+}
+
+// StopRecording stops recording, and returns the raw bytes consumed since StartRecording.
+func (c *Connection) StopRecording() []byte {
+	if c.record == nil {
+		return nil
+	}
+
+	raw := c.record.Bytes()
+	c.record = nil
+	return raw
+}
+
+// Read returns just one line from the given connection, without the line terminator (\r\n or \n).
+func (c *Connection) Read() (string, error) {
+	line, err := c.reader.ReadString('\n')
+
+	// c.offset is about how much we read from this connection, including the line terminator.
+	c.offset += uint64(len(line))
+	if c.record != nil {
+		c.record.WriteString(line)
+	}
 
+	if err != nil {
+		return "", fmt.Errorf("reader.ReadString: %w", err)
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, nil
+}
+
+// readLine returns one line without its CRLF terminator. The line must be terminated by CRLF, and be at most
+// maxLineLength long.
+func (c *Connection) readLine() ([]byte, error) {
+	line, err := c.readUntilLF(maxLineLength + 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, newProtocolError("line not terminated by CRLF")
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readInline returns one line of an inline request without its line terminator, which can be CRLF or just LF as
+// sent by netcat. The line must be at most maxInlineLength long.
+func (c *Connection) readInline() ([]byte, error) {
+	line, err := c.readUntilLF(maxInlineLength + 2)
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > maxInlineLength {
+		return nil, newProtocolError("too big inline request")
+	}
+
+	return line, nil
+}
+
+// readUntilLF returns the bytes up to and including the next LF. More than limit bytes is a protocol error.
+func (c *Connection) readUntilLF(limit int) ([]byte, error) {
+	var line []byte
 	for {
-		bytes, isPrefix, err := c.reader.ReadLine()
-		if err != nil {
-			return "", fmt.Errorf("reader.Readline: %w", err)
-		}
+		chunk, err := c.reader.ReadSlice('\n')
+		c.consumed(chunk)
+		line = append(line, chunk...)
 
-		c.token += string(bytes)
-		if !isPrefix {
-			ret := c.token
-			c.token = ""
-			return ret, nil
+		if len(line) > limit {
+			return nil, newProtocolError("too big line")
+		}
+		if err == nil {
+			return line, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("reader.ReadSlice: %w", err)
 		}
 	}
 }
 
+// readFull returns exactly n bytes. The buffer grows as the data arrives, so a huge n given by the peer doesn't
+// allocate the memory upfront.
+func (c *Connection) readFull(n int) ([]byte, error) {
+	var buf bytes.Buffer
+	if n <= 64*1024 {
+		buf.Grow(n)
+	}
+
+	_, err := io.CopyN(&buf, c.reader, int64(n))
+	c.consumed(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("io.CopyN: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// consumed counts the bytes read from the connection, and records them if recording.
+func (c *Connection) consumed(b []byte) {
+	c.offset += uint64(len(b))
+	if c.record != nil {
+		c.record.Write(b)
+	}
+}
+
 func (c *Connection) ReadBytes(buf []byte) (r int, _ error) {
 	defer func() {
 		c.offset += uint64(r)
+		if c.record != nil {
+			c.record.Write(buf[:r])
+		}
 	}()
 
 	r, err := c.reader.Read(buf)
@@ -70,22 +210,112 @@ func (c *Connection) ReadBytes(buf []byte) (r int, _ error) {
 	return r, nil
 }
 
-func (c *Connection) WriteBytes(bytes []byte) error {
-	var written int
-	for written < len(bytes) {
-		n, err := c.conn.Write(bytes)
+// ReadUntil reads from the connection until the data read ends with the mark, and returns the data including the mark.
+func (c *Connection) ReadUntil(mark []byte) ([]byte, error) {
+	if len(mark) == 0 {
+		return nil, fmt.Errorf("empty mark")
+	}
+
+	result := make([]byte, 0)
+	for {
+		chunk, err := c.reader.ReadBytes(mark[len(mark)-1])
+		c.offset += uint64(len(chunk))
+		if c.record != nil {
+			c.record.Write(chunk)
+		}
+		result = append(result, chunk...)
+
 		if err != nil {
-			return fmt.Errorf("c.conn.Write failed: %w", err)
+			return nil, fmt.Errorf("c.reader.ReadBytes: %w", err)
+		}
+
+		if bytes.HasSuffix(result, mark) {
+			return result, nil
 		}
-		written += n
+	}
+}
+
+// WriteBytes writes the raw bytes right away, after the messages kept by batching.
+func (c *Connection) WriteBytes(bytes []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.writeAfterOut(bytes)
+}
+
+// writeAfterOut writes the output buffer and then the bytes, with a single system call when possible. It should
+// be called with writeLock held.
+func (c *Connection) writeAfterOut(bytes []byte) error {
+	buffers := make(net.Buffers, 0, 2)
+	for _, b := range [][]byte{c.out, bytes} {
+		if len(b) > 0 {
+			buffers = append(buffers, b)
+		}
+	}
+	c.out = c.out[:0]
+
+	if _, err := buffers.WriteTo(c.conn); err != nil {
+		return fmt.Errorf("buffers.WriteTo failed: %w", err)
 	}
 	return nil
 }
 
+// StartBatch makes the messages written kept in the output buffer until Flush, or until the next read from the
+// network.
+func (c *Connection) StartBatch() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.batching = true
+}
+
+// Flush writes the messages kept in the output buffer, and ends batching.
+func (c *Connection) Flush() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.batching = false
+	if len(c.out) == 0 {
+		return nil
+	}
+
+	return c.writeAfterOut(nil)
+}
+
+// Buffered returns the number of bytes received but not read yet, such as pipelined requests.
+func (c *Connection) Buffered() int {
+	return c.reader.Buffered()
+}
+
 func (c *Connection) WriteString(str string) error {
 	return c.WriteBytes([]byte(str))
 }
 
+// SetProtocol sets the protocol version of the messages written to the connection, 2 or 3.
+func (c *Connection) SetProtocol(proto int) {
+	c.proto.Store(int32(proto))
+}
+
+// Protocol returns the protocol version of the messages written to the connection.
+func (c *Connection) Protocol() int {
+	if proto := c.proto.Load(); proto != 0 {
+		return int(proto)
+	}
+	return 2
+}
+
+// Write writes the message encoded in the protocol version of the connection. While batching, the message is
+// kept in the output buffer, unless the buffer would grow beyond maxOutputBuffer.
 func (c *Connection) Write(msg Message) error {
-	return c.WriteString(msg.Redis())
+	encoded := Encode(msg, c.Protocol())
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.batching && len(c.out)+len(encoded) <= maxOutputBuffer {
+		c.out = append(c.out, encoded...)
+		return nil
+	}
+
+	return c.writeAfterOut(encoded)
 }
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnection_Read_Offset(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	long := strings.Repeat("a", 5000)
+	go func() {
+		client.Write([]byte("+OK\r\n$5000\r\n" + long + "\r\n"))
+	}()
+
+	conn := NewConnection(server)
+
+	line, err := conn.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "+OK", line)
+	assert.Equal(t, uint64(5), conn.Offset())
+
+	_, err = conn.Read()
+	require.NoError(t, err)
+
+	line, err = conn.Read()
+	require.NoError(t, err)
+	assert.Equal(t, long, line)
+	assert.Equal(t, uint64(5+7+5002), conn.Offset())
+}
+
+func TestConnection_Batch(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewConnection(server)
+
+	// net.Pipe blocks writes until they are read, so the messages written must be kept in the output buffer.
+	conn.StartBatch()
+	require.NoError(t, conn.Write(OK))
+	require.NoError(t, conn.Write(NewInt(1)))
+
+	done := make(chan error)
+	go func() { done <- conn.Flush() }()
+
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(client, buf, len("+OK\r\n:1\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "+OK\r\n:1\r\n", string(buf[:n]))
+	require.NoError(t, <-done)
+
+	// a big message is written right away, after the ones kept.
+	conn.StartBatch()
+	require.NoError(t, conn.Write(PONG))
+	big := NewBulk(strings.Repeat("x", maxOutputBuffer))
+
+	go func() { done <- conn.Write(big) }()
+
+	want := string(PONG.Redis()) + string(big.Redis())
+	all := make([]byte, len(want))
+	_, err = io.ReadFull(client, all)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(all))
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/storage"
+)
+
+// eofMarkLength is the length of the random mark that terminates a diskless RDB transfer ($EOF:<mark>).
+const eofMarkLength = 40
+
+// disklessSync batches the slaves waiting for a full resync, so that they can share one RDB transfer
+// streamed directly to their sockets.
+type disklessSync struct {
+	lock    sync.Mutex
+	waiting []*disklessTarget
+	delay   time.Duration
+}
+
+// disklessTarget is a slave waiting for a diskless transfer.
+type disklessTarget struct {
+	conn          *Connection
+	listeningPort int
+	err           error      // the first error while transferring to this slave.
+	done          chan error // receives the result of the transfer.
+}
+
+func newDisklessSync(delay time.Duration) *disklessSync {
+	return &disklessSync{
+		delay: delay,
+	}
+}
+
+// Schedule queues the slave for the next transfer. The transfer starts after the delay from the first slave
+// queued, so that the slaves arriving in the meantime can share it. The returned channel receives the result.
+func (ds *disklessSync) Schedule(r *Replication, conn *Connection, listeningPort int) <-chan error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	target := &disklessTarget{
+		conn:          conn,
+		listeningPort: listeningPort,
+		done:          make(chan error, 1),
+	}
+	ds.waiting = append(ds.waiting, target)
+
+	if len(ds.waiting) == 1 {
+		time.AfterFunc(ds.delay, func() { ds.transfer(r) })
+	}
+
+	return target.done
+}
+
+// transfer sends FULLRESYNC and streams the RDB to all waiting slaves, using the EOF-marker format as the length
+// of the RDB is not known in advance.
+func (ds *disklessSync) transfer(r *Replication) {
+	ds.lock.Lock()
+	targets := ds.waiting
+	ds.waiting = nil
+	ds.lock.Unlock()
+
+	mark, err := newEOFMark()
+	if err != nil {
+		for _, t := range targets {
+			t.done <- fmt.Errorf("newEOFMark failed: %w", err)
+		}
+		return
+	}
+
+	// the replication stream to the slaves is buffered from these offsets until the transfer is done. The slaves
+	// are registered and the snapshot taken while no write runs, so that each write is either in the snapshot or
+	// in the replication stream, never both.
+	offsets := make([]uint64, len(targets))
+	var snapshot *storage.Cache
+	_ = r.cache.Exec(func() error {
+		for i, t := range targets {
+			offsets[i] = r.mc.AddSlave(t.conn, t.listeningPort)
+		}
+		snapshot = r.cache.Snapshot()
+		return nil
+	})
+
+	rid := r.ID()
+	for i, t := range targets {
+		header := fmt.Sprintf("+FULLRESYNC %s %d\r\n$EOF:%s\r\n", rid, offsets[i], mark)
+		if err := t.conn.WriteString(header); err != nil {
+			t.err = fmt.Errorf("write response failed: %w", err)
+		}
+	}
+
+	fanout := &fanoutWriter{targets: targets}
+	if err := storage.WriteRDB(fanout, snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "[master] storage.WriteRDB failed: %v\n", err)
+	}
+	fanout.Write([]byte(mark))
+
+	for _, t := range targets {
+		if t.err == nil {
+			r.mc.SetSlaveOnline(t.conn)
+		}
+		t.done <- t.err
+	}
+}
+
+// fanoutWriter writes to all slaves that haven't failed so far.
+type fanoutWriter struct {
+	targets []*disklessTarget
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for _, t := range fw.targets {
+		if t.err != nil {
+			continue
+		}
+
+		if err := t.conn.WriteBytes(p); err != nil {
+			t.err = fmt.Errorf("t.conn.WriteBytes failed: %w", err)
+			continue
+		}
+		alive++
+	}
+
+	if alive == 0 {
+		return 0, fmt.Errorf("no slave to write to")
+	}
+	return len(p), nil
+}
+
+func newEOFMark() (string, error) {
+	buf := make([]byte, eofMarkLength/2)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rand.Read failed: %w", err)
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/storage"
+)
+
+var BUSYKEY = NewError("BUSYKEY Target key name already exists.")
+
+// handleDump handles DUMP key, which replies the value serialized by storage.DumpValue, or null if the key
+// doesn't exist.
+func (h *Handler) handleDump(key string) error {
+	var reply Message = NULL
+
+	if value, _ := h.cache.Get(key); value != nil {
+		payload, err := storage.DumpValue(*value)
+		if err != nil {
+			return fmt.Errorf("storage.DumpValue failed: %w", err)
+		}
+		reply = NewBulk(string(payload))
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// handleRestore handles RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency].
+// ttl is in milliseconds, 0 for no expiry, or the unix time in milliseconds with ABSTTL.
+// RESTORE-ASKING is the same, sent by MIGRATE to the node importing the slot.
+func (h *Handler) handleRestore(args []string) error {
+	if len(args) < 3 {
+		return h.replyError(NewArityError("restore"))
+	}
+
+	key := args[0]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || ttl < 0 {
+		return h.writeError("ERR Invalid TTL value, must be >= 0")
+	}
+
+	var replace, absTTL bool
+	idleTime, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "REPLACE":
+			replace = true
+
+		case opt == "ABSTTL":
+			absTTL = true
+
+		case opt == "IDLETIME" && i+1 < len(args) && freq == -1:
+			idleTime, err = strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return h.replyError(NOTINTEGER)
+			}
+			if idleTime < 0 {
+				return h.writeError("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+
+		case opt == "FREQ" && i+1 < len(args) && idleTime == -1:
+			freq, err = strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return h.replyError(NOTINTEGER)
+			}
+			if freq < 0 || freq > 255 {
+				return h.writeError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+
+		default:
+			// IDLETIME and FREQ are mutually exclusive, like the LRU and LFU eviction policies.
+			return h.replyError(SYNTAXERR)
+		}
+	}
+
+	if existing, _ := h.cache.Get(key); existing != nil && !replace {
+		return h.writeError(BUSYKEY.Raw())
+	}
+
+	value, err := storage.RestoreValue([]byte(args[2]))
+	if err != nil {
+		return h.writeError("ERR DUMP payload version or checksum are wrong")
+	}
+
+	// there's no eviction policy to track the access time or frequency for, so IDLETIME and FREQ are only validated.
+	switch {
+	case ttl == 0:
+		h.cache.Set(key, value, 0)
+	case !absTTL:
+		h.cache.Set(key, value, ttl)
+	case ttl >= time.Now().UnixMilli():
+		h.cache.SetExpireAt(key, value, ttl)
+	default:
+		// the key is already expired.
+		h.cache.Delete(key)
+	}
+	h.dirty = true
+
+	if !h.server {
+		// no reply to the master.
+		return nil
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
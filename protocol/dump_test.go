@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withVersion returns the payload with the RDB version replaced, and the checksum updated accordingly.
+func withVersion(payload []byte, version uint16) string {
+	res := append([]byte{}, payload...)
+	binary.LittleEndian.PutUint16(res[len(res)-10:], version)
+	binary.LittleEndian.PutUint64(res[len(res)-8:], storage.CRC64(0, res[:len(res)-8]))
+
+	return string(res)
+}
+
+func TestDumpRestore(t *testing.T) {
+	repl, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	value := "binary\r\n\x00value"
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", value))
+	require.Equal(t, "$-1\r\n", request(t, client, "DUMP", "nokey"))
+
+	require.NoError(t, client.Write(NewArray([]string{"DUMP", "foo"})))
+	reply, err := ReadMessage(client)
+	require.NoError(t, err)
+	payload := []byte(reply.(*BulkMessage).Raw())
+
+	// the value in the RDB object format, the RDB version (11) and the CRC64 of everything before.
+	assert.Equal(t, append([]byte{0x00, byte(len(value))}, value...), payload[:len(payload)-10])
+	assert.Equal(t, uint16(11), binary.LittleEndian.Uint16(payload[len(payload)-10:]))
+	assert.Equal(t, storage.CRC64(0, payload[:len(payload)-8]), binary.LittleEndian.Uint64(payload[len(payload)-8:]))
+
+	corrupted := append([]byte{}, payload...)
+	corrupted[2] ^= 0xFF
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "busy key", args: []string{"RESTORE", "foo", "0", string(payload)}, want: "-BUSYKEY Target key name already exists.\r\n"},
+		{name: "replace", args: []string{"RESTORE", "foo", "0", string(payload), "REPLACE"}, want: "+OK\r\n"},
+		{name: "ttl", args: []string{"RESTORE", "ttl", "100000", string(payload)}, want: "+OK\r\n"},
+		{name: "absttl", args: []string{"RESTORE", "absttl", future, string(payload), "ABSTTL"}, want: "+OK\r\n"},
+		{name: "absttl in the past", args: []string{"RESTORE", "expired", "1000", string(payload), "ABSTTL"}, want: "+OK\r\n"},
+		{name: "idletime", args: []string{"RESTORE", "idle", "0", string(payload), "IDLETIME", "100"}, want: "+OK\r\n"},
+		{name: "freq", args: []string{"RESTORE", "freq", "0", string(payload), "FREQ", "255"}, want: "+OK\r\n"},
+		{name: "older version", args: []string{"RESTORE", "old", "0", withVersion(payload, 9)}, want: "+OK\r\n"},
+
+		{name: "newer version", args: []string{"RESTORE", "new", "0", withVersion(payload, 12)}, want: "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{name: "corrupted", args: []string{"RESTORE", "bad", "0", string(corrupted)}, want: "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{name: "negative ttl", args: []string{"RESTORE", "bad", "-1", string(payload)}, want: "-ERR Invalid TTL value, must be >= 0\r\n"},
+		{name: "negative idletime", args: []string{"RESTORE", "bad", "0", string(payload), "IDLETIME", "-1"}, want: "-ERR Invalid IDLETIME value, must be >= 0\r\n"},
+		{name: "freq out of range", args: []string{"RESTORE", "bad", "0", string(payload), "FREQ", "256"}, want: "-ERR Invalid FREQ value, must be >= 0 and <= 255\r\n"},
+		{name: "idletime and freq", args: []string{"RESTORE", "bad", "0", string(payload), "IDLETIME", "1", "FREQ", "1"}, want: "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, request(t, client, tt.args...))
+		})
+	}
+
+	for _, key := range []string{"foo", "ttl", "absttl", "idle", "freq", "old"} {
+		assert.Equal(t, string(NewBulk(value).Redis()), request(t, client, "GET", key), key)
+	}
+	for _, key := range []string{"expired", "new", "bad"} {
+		assert.Equal(t, "$-1\r\n", request(t, client, "GET", key), key)
+	}
+
+	_, expireAt := repl.cache.GetWithExpireAt("ttl")
+	assert.InDelta(t, time.Now().UnixMilli()+100000, expireAt, 5000)
+	_, expireAt = repl.cache.GetWithExpireAt("absttl")
+	assert.Equal(t, future, strconv.FormatInt(expireAt, 10))
+	_, expireAt = repl.cache.GetWithExpireAt("foo")
+	assert.Zero(t, expireAt)
+}
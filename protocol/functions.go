@@ -0,0 +1,602 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// functionFlags are the flags a function can be registered with.
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// FunctionEngine is the function libraries loaded with FUNCTION LOAD, compiled. The code of the libraries is
+// kept in storage.Cache, so that it's saved in the RDB and replaced by a full resync, and the engine follows it.
+type FunctionEngine struct {
+	lock      sync.Mutex
+	libraries map[string]*library
+	functions map[string]*function
+
+	// cache and version are the cache and the version of its libraries the engine was compiled from.
+	cache   *storage.Cache
+	version uint64
+}
+
+// library is a function library, whose Lua state is kept to call its functions.
+type library struct {
+	name      string
+	code      string
+	L         *lua.LState
+	functions map[string]*function
+
+	// run is the run calling a function of the library, while one does.
+	run *scriptRun
+}
+
+type function struct {
+	name        string
+	description string
+	flags       []string
+	callback    *lua.LFunction
+	lib         *library
+}
+
+func NewFunctionEngine() *FunctionEngine {
+	return &FunctionEngine{
+		libraries: make(map[string]*library),
+		functions: make(map[string]*function),
+	}
+}
+
+// Libraries returns the libraries in the cache, by name. They are compiled again only when the libraries of the
+// cache changed, such as by a full resync. A library which fails to load, such as one from a corrupted RDB, is left
+// out. The map must not be modified.
+func (fe *FunctionEngine) Libraries(cache *storage.Cache) map[string]*library {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+
+	fe.sync(cache)
+	return fe.libraries
+}
+
+// Lookup returns the function of the given name, nil if there is none.
+func (fe *FunctionEngine) Lookup(cache *storage.Cache, name string) *function {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+
+	fe.sync(cache)
+	return fe.functions[name]
+}
+
+// sync compiles the libraries of the cache, unless the engine already has them. fe.lock must be held.
+func (fe *FunctionEngine) sync(cache *storage.Cache) {
+	// the version is read first, so that a change while compiling is compiled by the next call.
+	version := cache.LibrariesVersion()
+	if fe.cache == cache && fe.version == version {
+		return
+	}
+
+	libraries := make(map[string]*library)
+	for name, code := range cache.Libraries() {
+		lib, err := fe.load(code)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "function library %s failed to load: %v\n", name, err)
+			continue
+		}
+		libraries[name] = lib
+	}
+
+	fe.set(libraries, cache, version)
+}
+
+// set replaces the compiled libraries, and indexes their functions. fe.lock must be held.
+func (fe *FunctionEngine) set(libraries map[string]*library, cache *storage.Cache, version uint64) {
+	functions := make(map[string]*function)
+	for _, lib := range libraries {
+		for name, fn := range lib.functions {
+			functions[name] = fn
+		}
+	}
+
+	fe.libraries = libraries
+	fe.functions = functions
+	fe.cache = cache
+	fe.version = version
+}
+
+// update applies f to the code of the libraries in the cache, by library name. The libraries are saved only if
+// they all load, with no function registered twice. The errors can be replied as they are.
+func (fe *FunctionEngine) update(cache *storage.Cache, f func(codes map[string]string) error) error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+
+	codes := cache.Libraries()
+	if err := f(codes); err != nil {
+		return err
+	}
+
+	libraries := make(map[string]*library, len(codes))
+	owners := make(map[string]string)
+	for name, code := range codes {
+		lib, err := fe.load(code)
+		if err != nil {
+			return err
+		}
+
+		for fn := range lib.functions {
+			if _, ok := owners[fn]; ok {
+				return fmt.Errorf("Function %s already exists", fn)
+			}
+			owners[fn] = name
+		}
+		libraries[name] = lib
+	}
+
+	fe.set(libraries, cache, cache.SetLibraries(codes))
+	return nil
+}
+
+// load returns the library of the code, compiled unless it already was. fe.lock must be held.
+func (fe *FunctionEngine) load(code string) (*library, error) {
+	md, err := storage.ParseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	if lib, ok := fe.libraries[md.Name]; ok && lib.code == code {
+		return lib, nil
+	}
+
+	return loadLibrary(md, code)
+}
+
+// loadLibrary runs the code of the library, which registers its functions with redis.register_function.
+func loadLibrary(md storage.LibraryMetadata, code string) (*library, error) {
+	if !strings.EqualFold(md.Engine, "lua") {
+		return nil, fmt.Errorf("Engine '%s' not found", md.Engine)
+	}
+
+	// the metadata line is commented out, so that the line numbers stay the same.
+	proto, err := compileLua("--"+code, "user_function")
+	if err != nil {
+		var pe *parse.Error
+		if errors.As(err, &pe) {
+			err = pe
+		}
+		return nil, fmt.Errorf("Error compiling function: %s", singleLine(err.Error()))
+	}
+
+	lib := &library{
+		name:      md.Name,
+		code:      code,
+		L:         newLuaState(),
+		functions: make(map[string]*function),
+	}
+
+	// only redis.register_function is there while loading.
+	L := lib.L
+	L.SetGlobal("redis", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"register_function": lib.register,
+	}))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		var ae *lua.ApiError
+		if errors.As(err, &ae) {
+			return nil, errors.New(singleLine(ae.Object.String()))
+		}
+		return nil, errors.New(singleLine(err.Error()))
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+
+	setRedisLib(L, func() *scriptRun { return lib.run })
+	return lib, nil
+}
+
+// register handles redis.register_function(name, callback), or redis.register_function{function_name=...,
+// callback=..., flags=..., description=...}.
+func (lib *library) register(L *lua.LState) int {
+	fn := &function{lib: lib}
+
+	if t, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+		name, _ := t.RawGetString("function_name").(lua.LString)
+		fn.name = string(name)
+
+		fn.callback, _ = t.RawGetString("callback").(*lua.LFunction)
+
+		if desc, ok := t.RawGetString("description").(lua.LString); ok {
+			fn.description = string(desc)
+		}
+
+		switch flags := t.RawGetString("flags").(type) {
+		case *lua.LNilType:
+		case *lua.LTable:
+			for i := 1; i <= flags.Len(); i++ {
+				flag, ok := flags.RawGetInt(i).(lua.LString)
+				if !ok || !functionFlags[string(flag)] {
+					L.Error(lua.LString("unknown flag given"), 0)
+				}
+				fn.flags = append(fn.flags, string(flag))
+			}
+		default:
+			L.Error(lua.LString("flags argument to redis.register_function must be a table representing function flags"), 0)
+		}
+	} else {
+		if L.GetTop() != 2 {
+			L.Error(lua.LString("wrong number of arguments to redis.register_function"), 0)
+		}
+		name, _ := L.Get(1).(lua.LString)
+		fn.name = string(name)
+		fn.callback, _ = L.Get(2).(*lua.LFunction)
+	}
+
+	if !storage.ValidFunctionName(fn.name) {
+		L.Error(lua.LString("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long"), 0)
+	}
+	if fn.callback == nil {
+		L.Error(lua.LString("callback argument given to redis.register_function must be a function"), 0)
+	}
+	if _, ok := lib.functions[fn.name]; ok {
+		L.Error(lua.LString("Function already exists in the library"), 0)
+	}
+
+	lib.functions[fn.name] = fn
+	return 0
+}
+
+func (fn *function) hasFlag(flag string) bool {
+	for _, f := range fn.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// fcallCommand handles FCALL function numkeys [key ...] [arg ...].
+func (h *Handler) fcallCommand(msg *ArrayMessage) error {
+	return h.fcall(msg, false)
+}
+
+// fcallroCommand handles FCALL_RO, which only calls functions with the no-writes flag.
+func (h *Handler) fcallroCommand(msg *ArrayMessage) error {
+	return h.fcall(msg, true)
+}
+
+func (h *Handler) fcall(msg *ArrayMessage, readOnly bool) error {
+	keys, args, em := scriptArgs(msg.SliceFrom(2))
+	if em != nil {
+		return h.replyError(em)
+	}
+
+	fn := h.state.Functions().Lookup(h.cache, msg.Token(1))
+	if fn == nil {
+		return h.writeError("ERR Function not found")
+	}
+
+	noWrites := fn.hasFlag("no-writes")
+	if readOnly && !noWrites {
+		return h.writeError("ERR Can not execute a script with write flag using *_ro command.")
+	}
+
+	// the callback is called with the keys and the args, in the Lua state of its library.
+	lib, L := fn.lib, fn.lib.L
+	return h.runLua(L, true, noWrites, func(run *scriptRun) (lua.LValue, error) {
+		lib.run = run
+		defer func() { lib.run = nil }()
+		defer L.SetTop(0)
+
+		L.Push(fn.callback)
+		L.Push(luaStrings(L, keys))
+		L.Push(luaStrings(L, args))
+		if err := L.PCall(2, 1, nil); err != nil {
+			return nil, err
+		}
+		return L.Get(-1), nil
+	})
+}
+
+// functionCommand handles FUNCTION LOAD|LIST|DELETE|FLUSH|DUMP|RESTORE|KILL.
+func (h *Handler) functionCommand(msg *ArrayMessage) error {
+	fe := h.state.Functions()
+
+	var reply Message
+	switch strings.ToUpper(msg.Token(1)) {
+	case "LOAD":
+		// FUNCTION LOAD [REPLACE] code
+		replace := msg.Len() == 4
+		if replace && !strings.EqualFold(msg.Token(2), "REPLACE") {
+			return h.writeError(fmt.Sprintf("ERR Unknown option given: %s", msg.Token(2)))
+		}
+		if msg.Len() > 4 {
+			return h.replyError(SYNTAXERR)
+		}
+		code := msg.Token(msg.Len() - 1)
+
+		var name string
+		err := fe.update(h.cache, func(codes map[string]string) error {
+			md, err := storage.ParseLibraryMetadata(code)
+			if err != nil {
+				return err
+			}
+			if _, ok := codes[md.Name]; ok && !replace {
+				return fmt.Errorf("Library '%s' already exists", md.Name)
+			}
+
+			name = md.Name
+			codes[md.Name] = code
+			return nil
+		})
+		if err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		h.dirty = true
+		reply = NewBulk(name)
+
+	case "LIST":
+		return h.handleFunctionList(msg.SliceFrom(2))
+
+	case "KILL":
+		reply = h.killScript(true)
+
+	case "DELETE":
+		err := fe.update(h.cache, func(codes map[string]string) error {
+			if _, ok := codes[msg.Token(2)]; !ok {
+				return errors.New("Library not found")
+			}
+			delete(codes, msg.Token(2))
+			return nil
+		})
+		if err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		h.dirty = true
+		reply = OK
+
+	case "FLUSH":
+		if msg.Len() == 3 && !strings.EqualFold(msg.Token(2), "SYNC") && !strings.EqualFold(msg.Token(2), "ASYNC") {
+			return h.writeError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+		}
+		if msg.Len() > 3 {
+			return h.replyError(SYNTAXERR)
+		}
+
+		err := fe.update(h.cache, func(codes map[string]string) error {
+			for name := range codes {
+				delete(codes, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		h.dirty = true
+		reply = OK
+
+	case "DUMP":
+		libraries := h.cache.Libraries()
+		codes := make([]string, 0, len(libraries))
+		for _, name := range sortedNames(libraries) {
+			codes = append(codes, libraries[name])
+		}
+
+		payload, err := storage.DumpLibraries(codes)
+		if err != nil {
+			return fmt.Errorf("storage.DumpLibraries failed: %w", err)
+		}
+		reply = NewBulk(string(payload))
+
+	case "RESTORE":
+		// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+		policy := "APPEND"
+		if msg.Len() == 4 {
+			policy = strings.ToUpper(msg.Token(3))
+		}
+		if msg.Len() > 4 || (policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE") {
+			return h.writeError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+
+		restored, err := storage.RestoreLibraries([]byte(msg.Token(2)))
+		if err != nil {
+			return h.writeError("ERR payload version or checksum are wrong")
+		}
+
+		err = fe.update(h.cache, func(codes map[string]string) error {
+			if policy == "FLUSH" {
+				for name := range codes {
+					delete(codes, name)
+				}
+			}
+
+			for _, code := range restored {
+				md, err := storage.ParseLibraryMetadata(code)
+				if err != nil {
+					return err
+				}
+				if _, ok := codes[md.Name]; ok && policy == "APPEND" {
+					return fmt.Errorf("Library %s already exists", md.Name)
+				}
+				codes[md.Name] = code
+			}
+			return nil
+		})
+		if err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+		h.dirty = true
+		reply = OK
+
+	default:
+		return h.replyError(NewUnknownSubcommandError("function", msg.Token(1)))
+	}
+
+	// the changes of the libraries are propagated, and applied silently by the slaves.
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// handleFunctionList handles FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE].
+func (h *Handler) handleFunctionList(args []string) error {
+	pattern := "*"
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "WITHCODE"):
+			withCode = true
+		case strings.EqualFold(args[i], "LIBRARYNAME") && i+1 < len(args):
+			pattern = args[i+1]
+			i++
+		default:
+			return h.writeError(fmt.Sprintf("ERR Unknown argument %s", args[i]))
+		}
+	}
+
+	libraries := h.state.Functions().Libraries(h.cache)
+
+	items := make([]Message, 0, len(libraries))
+	for _, name := range sortedNames(libraries) {
+		if !matchPattern(pattern, name) {
+			continue
+		}
+		lib := libraries[name]
+
+		functions := make([]Message, 0, len(lib.functions))
+		for _, fnName := range sortedNames(lib.functions) {
+			fn := lib.functions[fnName]
+
+			var desc Message = NULL
+			if fn.description != "" {
+				desc = NewBulk(fn.description)
+			}
+
+			functions = append(functions, NewMap([]Message{
+				NewBulk("name"), NewBulk(fn.name),
+				NewBulk("description"), desc,
+				NewBulk("flags"), NewSet(simpleStrings(fn.flags)),
+			}))
+		}
+
+		fields := []Message{
+			NewBulk("library_name"), NewBulk(lib.name),
+			NewBulk("engine"), NewBulk("LUA"),
+			NewBulk("functions"), NewNestedArray(functions),
+		}
+		if withCode {
+			fields = append(fields, NewBulk("library_code"), NewBulk(lib.code))
+		}
+		items = append(items, NewMap(fields))
+	}
+
+	if err := h.conn.Write(NewNestedArray(items)); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchPattern returns true if the glob-style pattern matches the string, like stringmatch of Redis: * matches
+// any sequence, ? any single character, [...] a set of characters, and \ escapes.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// an unclosed bracket is a plain character.
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				break
+			}
+
+			set := pattern[1 : end+1]
+			negate := strings.HasPrefix(set, "^")
+			if negate {
+				set = set[1:]
+			}
+			matched := false
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					if set[i] <= s[0] && s[0] <= set[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if set[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+			s = s[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
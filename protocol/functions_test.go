@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLibrary = `#!lua name=mylib
+redis.register_function('set', function(keys, args) return redis.call('SET', keys[1], args[1]) end)
+redis.register_function{
+	function_name = 'get',
+	callback = function(keys) return redis.call('GET', keys[1]) end,
+	flags = {'no-writes'},
+	description = 'gets a key',
+}
+`
+
+func TestFunctions(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	require.Equal(t, "$5\r\nmylib\r\n", request(t, client, "FUNCTION", "LOAD", testLibrary))
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "fcall", args: []string{"FCALL", "set", "1", "foo", "bar"}, want: "+OK\r\n"},
+		{name: "fcall_ro", args: []string{"FCALL_RO", "get", "1", "foo"}, want: "$3\r\nbar\r\n"},
+		{name: "fcall_ro of a write function", args: []string{"FCALL_RO", "set", "1", "foo", "baz"}, want: "-ERR Can not execute a script with write flag using *_ro command.\r\n"},
+		{name: "writes from a no-writes function", args: []string{"FUNCTION", "LOAD", "#!lua name=ro\nredis.register_function{function_name='ro', callback=function() return redis.call('SET', 'x', 1) end, flags={'no-writes'}}"}, want: "$2\r\nro\r\n"},
+		{name: "write denied", args: []string{"FCALL", "ro", "0"}, want: "-ERR Write commands are not allowed from read-only scripts.\r\n"},
+		{name: "unknown function", args: []string{"FCALL", "nope", "0"}, want: "-ERR Function not found\r\n"},
+		{name: "library exists", args: []string{"FUNCTION", "LOAD", testLibrary}, want: "-ERR Library 'mylib' already exists\r\n"},
+		{name: "replace", args: []string{"FUNCTION", "LOAD", "REPLACE", testLibrary}, want: "$5\r\nmylib\r\n"},
+		{name: "function exists", args: []string{"FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('get', function() return 1 end)"}, want: "-ERR Function get already exists\r\n"},
+		{name: "missing metadata", args: []string{"FUNCTION", "LOAD", "return 1"}, want: "-ERR Missing library metadata\r\n"},
+		{name: "unknown engine", args: []string{"FUNCTION", "LOAD", "#!js name=x\n"}, want: "-ERR Engine 'js' not found\r\n"},
+		{name: "no functions", args: []string{"FUNCTION", "LOAD", "#!lua name=empty\nlocal a = 1"}, want: "-ERR No functions registered\r\n"},
+		{name: "unknown flag", args: []string{"FUNCTION", "LOAD", "#!lua name=x\nredis.register_function{function_name='f', callback=function() end, flags={'nope'}}"}, want: "-ERR unknown flag given\r\n"},
+		{name: "invalid name", args: []string{"FUNCTION", "LOAD", "#!lua name=x\nredis.register_function('f-1', function() end)"}, want: "-ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long\r\n"},
+		{name: "delete unknown", args: []string{"FUNCTION", "DELETE", "nope"}, want: "-ERR Library not found\r\n"},
+		{name: "delete", args: []string{"FUNCTION", "DELETE", "ro"}, want: "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, request(t, client, tt.args...))
+		})
+	}
+
+	t.Run("list", func(t *testing.T) {
+		want := "*1\r\n*6\r\n$12\r\nlibrary_name\r\n$5\r\nmylib\r\n$6\r\nengine\r\n$3\r\nLUA\r\n$9\r\nfunctions\r\n*2\r\n" +
+			"*6\r\n$4\r\nname\r\n$3\r\nget\r\n$11\r\ndescription\r\n$10\r\ngets a key\r\n$5\r\nflags\r\n*1\r\n+no-writes\r\n" +
+			"*6\r\n$4\r\nname\r\n$3\r\nset\r\n$11\r\ndescription\r\n$-1\r\n$5\r\nflags\r\n*0\r\n"
+		assert.Equal(t, want, request(t, client, "FUNCTION", "LIST"))
+		assert.Equal(t, "*0\r\n", request(t, client, "FUNCTION", "LIST", "LIBRARYNAME", "other*"))
+		assert.Contains(t, request(t, client, "FUNCTION", "LIST", "LIBRARYNAME", "my*", "WITHCODE"), "$12\r\nlibrary_code\r\n")
+	})
+
+	t.Run("dump and restore", func(t *testing.T) {
+		payload := request(t, client, "FUNCTION", "DUMP")
+		require.True(t, strings.HasPrefix(payload, "$"))
+		_, dump, _ := strings.Cut(strings.TrimSuffix(payload, "\r\n"), "\r\n")
+
+		assert.Equal(t, "+OK\r\n", request(t, client, "FUNCTION", "FLUSH"))
+		assert.Equal(t, "-ERR Function not found\r\n", request(t, client, "FCALL", "get", "1", "foo"))
+
+		assert.Equal(t, "+OK\r\n", request(t, client, "FUNCTION", "RESTORE", dump))
+		assert.Equal(t, "$3\r\nbar\r\n", request(t, client, "FCALL", "get", "1", "foo"))
+
+		assert.Equal(t, "-ERR Library mylib already exists\r\n", request(t, client, "FUNCTION", "RESTORE", dump, "APPEND"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "FUNCTION", "RESTORE", dump, "REPLACE"))
+		assert.Equal(t, "-ERR payload version or checksum are wrong\r\n", request(t, client, "FUNCTION", "RESTORE", "garbage"))
+	})
+}
+
+func TestFunctions_Replication(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	// the library loaded before the replica connects comes with the RDB of the full resync.
+	require.Equal(t, "$5\r\nmylib\r\n", request(t, client, "FUNCTION", "LOAD", testLibrary))
+
+	replica, replicaPort := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, testLibrary, replica.cache.Libraries()["mylib"])
+
+	// the ones loaded later are propagated.
+	require.Equal(t, "$5\r\nother\r\n", request(t, client, "FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('one', function() return 1 end)"))
+	require.Equal(t, "+OK\r\n", request(t, client, "FCALL", "set", "1", "foo", "bar"))
+
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && *value == "bar" && replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+
+	replicaClient := dialTestServer(t, replicaPort)
+	assert.Equal(t, ":1\r\n", request(t, replicaClient, "FCALL", "one", "0"))
+	assert.Equal(t, "$3\r\nbar\r\n", request(t, replicaClient, "FCALL_RO", "get", "1", "foo"))
+	assert.Contains(t, request(t, replicaClient, "FUNCTION", "DELETE", "mylib"), "-READONLY ")
+}
+
+func TestFunctions_Restart(t *testing.T) {
+	dir := t.TempDir()
+	_, port := startTestServer(t, &config.Opts{Dir: dir, DbFilename: "dump.rdb"})
+	client := dialTestServer(t, port)
+
+	require.Equal(t, "$5\r\nmylib\r\n", request(t, client, "FUNCTION", "LOAD", testLibrary))
+	require.Equal(t, "+OK\r\n", request(t, client, "FCALL", "set", "1", "foo", "bar"))
+	require.Equal(t, "+OK\r\n", request(t, client, "SAVE"))
+
+	// a server started with the saved RDB file has the libraries.
+	_, restartedPort := startTestServer(t, &config.Opts{Dir: dir, DbFilename: "dump.rdb"})
+	restarted := dialTestServer(t, restartedPort)
+	assert.Equal(t, "$3\r\nbar\r\n", request(t, restarted, "FCALL_RO", "get", "1", "foo"))
+
+	_, otherPort := startTestServer(t, &config.Opts{})
+	assert.Equal(t, "-ERR dir and dbfilename must be set to save the RDB file\r\n", request(t, dialTestServer(t, otherPort), "SAVE"))
+}
+
+func TestFunctions_Kill(t *testing.T) {
+	_, state, port := startTestNode(t, &config.Opts{LuaTimeLimit: 100})
+	runner, client := dialTestServer(t, port), dialTestServer(t, port)
+
+	library := "#!lua name=spinlib\nredis.register_function('spin', function() while true do end end)"
+	require.Equal(t, "$7\r\nspinlib\r\n", request(t, client, "FUNCTION", "LOAD", library))
+
+	require.NoError(t, runner.Write(NewArray([]string{"FCALL", "spin", "0"})))
+	require.Eventually(t, func() bool { return state.script.Load() != nil }, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "-BUSY Redis is busy running a script. You can only call FUNCTION KILL.\r\n", request(t, client, "SCRIPT", "KILL"))
+	assert.Equal(t, "+OK\r\n", request(t, client, "FUNCTION", "KILL"))
+
+	reply, err := ReadMessage(runner)
+	require.NoError(t, err)
+	assert.Equal(t, "-ERR Script killed by user with FUNCTION KILL...\r\n", string(reply.Redis()))
+	assert.Equal(t, "-NOTBUSY No scripts in execution right now.\r\n", request(t, client, "FUNCTION", "KILL"))
+}
+
+func TestFunctionEngine_Cache(t *testing.T) {
+	fe, cache := NewFunctionEngine(), storage.NewCache()
+	require.NoError(t, fe.update(cache, func(codes map[string]string) error {
+		codes["mylib"] = testLibrary
+		return nil
+	}))
+
+	// the libraries are compiled once, not by each lookup.
+	fn := fe.Lookup(cache, "get")
+	require.NotNil(t, fn)
+	assert.Same(t, fn, fe.Lookup(cache, "get"))
+	assert.Same(t, fn.lib, fe.Libraries(cache)["mylib"])
+	assert.Nil(t, fe.Lookup(cache, "nope"))
+
+	// changes of the cache which don't go through the engine, like an RDB load, are followed.
+	cache.SetLibrary("otherlib", "#!lua name=otherlib\nredis.register_function('other', function() return 1 end)")
+	assert.NotNil(t, fe.Lookup(cache, "other"))
+	assert.Same(t, fn.lib, fe.Libraries(cache)["mylib"])
+
+	cache.Reset()
+	assert.Nil(t, fe.Lookup(cache, "get"))
+	assert.Empty(t, fe.Libraries(cache))
+}
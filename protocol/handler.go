@@ -1,11 +1,14 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/config"
 	"github.com/codecrafters-io/redis-starter-go/info"
@@ -17,45 +20,91 @@ type Handler struct {
 	opts   *config.Opts
 	conn   *Connection
 	cache  *storage.Cache
-	info   info.Info
+	repl   *Replication
+	state  *State
 
-	// only for master.
+	// serves our slaves. slaves can have their own slaves as well.
 	mc *MasterConfig
 
-	// only for slaves.
-	replicationStartOffset uint64
+	// only for master handlers serving a slave: the port given with REPLCONF listening-port,
+	// and whether the slave understands the EOF-marker RDB format (REPLCONF capa eof).
+	slaveListeningPort int
+	slaveCapaEOF       bool
+
+	// only for master handlers: the replication offset right after the last write of this client, for WAIT.
+	lastWriteOffset uint64
+
+	// only for slaves: the replication offset processed so far.
+	replicationOffset uint64
+
+	// only for server handlers: the channels this client subscribed to.
+	subscriptions map[string]struct{}
+
+	// only for server handlers in cluster mode: true right after ASKING, for the next request only.
+	asking bool
+
+	// only for server handlers: the client id, the name given with SETNAME, and the protocol version (2 or 3)
+	// negotiated with HELLO.
+	id    int64
+	name  string
+	proto int
+
+	// the transaction started with MULTI, nil outside of it, and the keys watched with WATCH, with the version
+	// of the cache when they were.
+	multi   *transaction
+	watched map[string]uint64
+
+	// exclusive is true while running a transaction or a script, while no other command runs. effects collects
+	// the writes of the scripts in a transaction, nil otherwise.
+	exclusive bool
+	effects   *[]Message
+
+	// dirty is set by write commands which changed the dataset, so that they are propagated. Writes replied with
+	// an error leave it unset.
+	dirty bool
 }
 
-func NewClient(conn *Connection, opts *config.Opts, cache *storage.Cache) *Handler {
-	return newHandler(conn, false, opts, cache, nil)
+func NewClient(conn *Connection, opts *config.Opts, cache *storage.Cache, repl *Replication, state *State) *Handler {
+	return newHandler(conn, false, opts, cache, repl, state)
 }
 
-func NewServer(conn *Connection, opts *config.Opts, cache *storage.Cache, mc *MasterConfig) *Handler {
-	return newHandler(conn, true, opts, cache, mc)
+func NewServer(conn *Connection, opts *config.Opts, cache *storage.Cache, repl *Replication, state *State) *Handler {
+	return newHandler(conn, true, opts, cache, repl, state)
 }
 
-func newHandler(conn *Connection, server bool, opts *config.Opts, cache *storage.Cache, mc *MasterConfig) *Handler {
+func newHandler(conn *Connection, server bool, opts *config.Opts, cache *storage.Cache, repl *Replication, state *State) *Handler {
 	return &Handler{
-		conn:   conn,
-		server: server,
-		opts:   opts,
-		cache:  cache,
-		info: info.Info{
-			Replication: info.Replication{
-				Role:             opts.Role,
-				MasterReplID:     opts.ReplicationID,
-				MasterReplOffset: opts.ReplicationOffset,
-			},
-		},
-		replicationStartOffset: 0,
-		mc:                     mc,
+		conn:              conn,
+		server:            server,
+		opts:              opts,
+		cache:             cache,
+		repl:              repl,
+		state:             state,
+		replicationOffset: 0,
+		mc:                repl.MasterConfig(),
+		subscriptions:     make(map[string]struct{}),
+		watched:           make(map[string]uint64),
+		id:                nextClientID.Add(1),
+		proto:             2,
 	}
 }
 
 func (h *Handler) Handle() error {
 	defer h.conn.Close()
+	defer h.unwatch()
+
+	if h.server {
+		// if this connection is from a slave, the slave is gone with it.
+		defer h.mc.RemoveSlave(h.conn)
 
-	if !h.server && h.opts.Role == "slave" {
+		defer func() {
+			for channel := range h.subscriptions {
+				h.state.PubSub().Unsubscribe(h.conn, channel)
+			}
+		}()
+	}
+
+	if !h.server {
 		// I'm connecting master as slave. NOTE: slave can be a server as well (for example, for INFO command)
 		if err := h.conn.Write(PING); err != nil {
 			return fmt.Errorf("conn.Write failed: %w", err)
@@ -74,7 +123,7 @@ func (h *Handler) Handle() error {
 			return fmt.Errorf("conn.Write failed: %w", err)
 		}
 
-		replConf2 := NewArray([]string{"REPLCONF", "capa", "psync2"})
+		replConf2 := NewArray([]string{"REPLCONF", "capa", "eof", "capa", "psync2"})
 		if err := h.conn.Write(replConf2); err != nil {
 			return fmt.Errorf("conn.Write failed: %w", err)
 		}
@@ -83,109 +132,136 @@ func (h *Handler) Handle() error {
 			return fmt.Errorf("conn.Write failed: %w", err)
 		}
 
-		psync := NewArray([]string{"PSYNC", "?", "-1"})
-		if err := h.conn.Write(psync); err != nil {
+		// the master continues from the offset we have if it can, and otherwise sends everything with an RDB.
+		if err := h.conn.Write(h.repl.PsyncMessage()); err != nil {
 			return fmt.Errorf("conn.Write failed: %w", err)
 		}
 
-		if _, err := h.shouldReadReply("FULLRESYNC"); err != nil {
+		reply, err := h.shouldReadReply("")
+		if err != nil {
 			return fmt.Errorf("shouldReadPrefix failed: %w", err)
 		}
 
-		if err := h.shouldReadRDB(); err != nil {
-			return fmt.Errorf("shouldReadRDB: %w", err)
+		simple, ok := reply.(*SimpleMessage)
+		if !ok {
+			return fmt.Errorf("unexpected reply to PSYNC: %v", reply)
 		}
 
-		h.replicationStartOffset = h.conn.Offset()
+		if id, ok := parseContinue(simple.Raw()); ok {
+			h.replicationOffset = h.repl.Continue(id)
+		} else {
+			id, offset, err := parseFullResync(simple.Raw())
+			if err != nil {
+				return fmt.Errorf("parseFullResync failed: %w", err)
+			}
+
+			if err := h.shouldReadRDB(); err != nil {
+				return fmt.Errorf("shouldReadRDB: %w", err)
+			}
+
+			h.repl.SetMaster(id, offset)
+			h.replicationOffset = offset
+
+			// the writes in the AOF are of another history: the AOF starts over from the data set of the master.
+			if aof := h.repl.AOF(); aof != nil {
+				if err := aof.Rewrite(h.cache, offset); err != nil {
+					return fmt.Errorf("aof.Rewrite failed: %w", err)
+				}
+			}
+		}
 	}
 
+	// the replies kept by batching are written before closing, such as a protocol error.
+	defer h.conn.Flush()
+
 	for {
+		start := h.conn.Offset()
+		if !h.server {
+			// the exact bytes from the master are forwarded to our sub-slaves.
+			h.conn.StartRecording()
+		}
+
 		request, err := h.read()
 		if err != nil {
+			var pe *ProtocolError
+			if h.server && errors.As(err, &pe) {
+				// like Redis, the client learns what was wrong before the connection is closed.
+				_ = h.conn.Write(NewError("ERR " + pe.Error()))
+			}
+
 			err = fmt.Errorf("h.read failed: %w", err)
 			fmt.Fprintln(os.Stderr, err.Error())
 			return err
 		}
 
-		// requestArray is a single request from a client.
-		err = h.processRequest(request)
+		// messages from other goroutines, such as PUBLISH, are batched too while processing the request. The replies
+		// to pipelined requests are written at once, when the connection has to wait for the next request.
+		h.conn.StartBatch()
+
+		if h.server {
+			// requestArray is a single request from a client.
+			err = h.processRequest(request)
+		} else {
+			// a write from the master is applied and forwarded to our sub-slaves while no other command runs,
+			// so that a sub-slave syncing meanwhile gets it either in the snapshot or in the stream, not both.
+			err = h.runExclusive(func() error {
+				if err := h.processRequest(request); err != nil {
+					return err
+				}
+
+				// every byte of the replication stream counts, whether the command is processed or not.
+				h.replicationOffset += h.conn.Offset() - start
+				h.repl.SetOffset(h.replicationOffset)
+				h.mc.PropagateRaw(h.conn.StopRecording())
+
+				if aof := h.repl.AOF(); aof != nil {
+					var payload []byte
+					if request.Propagatible() {
+						payload = request.Redis()
+					}
+
+					if err := aof.Append(payload, h.replicationOffset); err != nil {
+						fmt.Fprintf(os.Stderr, "aof.Append failed: %v\n", err)
+					}
+				}
+				return nil
+			})
+		}
 		if err != nil {
 			err = fmt.Errorf("handleRequest failed: %w", err)
 			fmt.Fprintln(os.Stderr, err.Error())
 			return err
 		}
-
-		if h.opts.Role == "master" {
-			if err := h.propagate(request); err != nil {
-				err = fmt.Errorf("h.propagate failed: %w", err)
-				fmt.Fprintln(os.Stderr, err.Error())
-				return err
-			}
-		}
 	}
 }
 
-func (h *Handler) propagate(msg Message) error {
+// propagate feeds the write to the slaves and the AOF.
+func (h *Handler) propagate(msg Message) {
 	if !msg.Propagatible() {
-		return nil
+		return
 	}
 
-	h.mc.AdvancePropagation(len(msg.Redis()))
-
-	errors := make([]string, 0)
-	h.mc.ForEachSlave(func(mc *MasterConfig, s *Slave) {
-		if err := s.conn.Write(msg); err != nil {
-			errors = append(errors, fmt.Sprintf("conn.Write: %v", err))
-		}
-	})
-
-	if len(errors) > 0 {
-		return fmt.Errorf("propagate failed: [%s]", strings.Join(errors, ", "))
-	}
-
-	return nil
+	h.lastWriteOffset = h.mc.PropagateWrite(msg, h.repl.AOF())
 }
 
-// read is a basic request-reading routine. Assumes the request is always an array.
+// read reads the next request, or the next reply while handshaking with the master. Clients can send inline
+// commands as well, but the master link always speaks RESP.
 func (h *Handler) read() (Message, error) {
-	token, err := h.conn.Read()
-	if err != nil {
-		return nil, fmt.Errorf("conn.Read(): %w", err)
-	}
-
-	if token[0] == '+' { // simple string
-		return NewSimple(token[1:]), nil
-	}
-
-	num, err := ArrayLength(token)
-	if err != nil {
-		return nil, fmt.Errorf("ValidateArray(): %w", err)
-	}
-
-	requestArray := make([]string, 0, num)
-	for i := 0; i < num; i++ {
-		token, err := h.conn.Read()
-		if err != nil {
-			return nil, fmt.Errorf("h.conn.GetToken(): %w", err)
-		}
-
-		l, err := BulkStringLength(token)
+	if h.server {
+		msg, err := ReadRequest(h.conn)
 		if err != nil {
-			return nil, fmt.Errorf("ValidateString(): %w", err)
+			return nil, fmt.Errorf("ReadRequest(): %w", err)
 		}
 
-		str, err := h.conn.Read()
-		if err != nil {
-			return nil, fmt.Errorf("h.conn.GetToken(): %w", err)
-		}
-		if l != len(str) {
-			return nil, fmt.Errorf("bulk string length mismatch: %v != %v", l, len(str))
-		}
+		return msg, nil
+	}
 
-		requestArray = append(requestArray, str)
+	msg, err := ReadMessage(h.conn)
+	if err != nil {
+		return nil, fmt.Errorf("ReadMessage(): %w", err)
 	}
 
-	return NewArray(requestArray), nil
+	return msg, nil
 }
 
 func (h *Handler) shouldReadReply(prefix string) (Message, error) {
@@ -214,6 +290,8 @@ func (h *Handler) shouldReadReply(prefix string) (Message, error) {
 	return msg, nil
 }
 
+// shouldReadRDB reads the RDB sent by the master, and loads it to the cache. Both the length-prefixed format
+// ($<length>) and the EOF-marker format of diskless transfers ($EOF:<mark>) are understood.
 func (h *Handler) shouldReadRDB() error {
 	typ, err := h.conn.Read()
 	if err != nil {
@@ -224,9 +302,38 @@ func (h *Handler) shouldReadRDB() error {
 		return fmt.Errorf("unexpected type than $: %v", typ[0])
 	}
 
+	var result []byte
+	if strings.HasPrefix(typ, "$EOF:") {
+		mark := typ[len("$EOF:"):]
+		if len(mark) != eofMarkLength {
+			return fmt.Errorf("wrong EOF mark: %s", mark)
+		}
+
+		result, err = h.conn.ReadUntil([]byte(mark))
+		if err != nil {
+			return fmt.Errorf("h.conn.ReadUntil: %w", err)
+		}
+		result = result[:len(result)-len(mark)]
+	} else {
+		result, err = h.readRDBWithLength(typ)
+		if err != nil {
+			return fmt.Errorf("h.readRDBWithLength: %w", err)
+		}
+	}
+
+	// full resync: the RDB replaces everything we had.
+	h.cache.Reset()
+	if err := storage.ReadRDB(bytes.NewReader(result), h.cache); err != nil {
+		return fmt.Errorf("storage.ReadRDB: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) readRDBWithLength(typ string) ([]byte, error) {
 	total, err := strconv.Atoi(typ[1:])
 	if err != nil {
-		return fmt.Errorf("strconf.Atoi: %w", err)
+		return nil, fmt.Errorf("strconf.Atoi: %w", err)
 	}
 
 	result := make([]byte, 0, total)
@@ -238,7 +345,7 @@ func (h *Handler) shouldReadRDB() error {
 				total = total - rd
 				break
 			} else {
-				return fmt.Errorf("h.conn.ReadBytes: %w", err)
+				return nil, fmt.Errorf("h.conn.ReadBytes: %w", err)
 			}
 		}
 
@@ -247,149 +354,200 @@ func (h *Handler) shouldReadRDB() error {
 		}
 
 		total = total - rd
-
-		// TODO: copy buf to somewhere.
 		result = append(result, tmp[:rd]...)
 	}
 
-	_ = result
-
 	if total > 0 {
 		// incomplete termination.
-		return fmt.Errorf("couldn't read RDB fully")
+		return nil, fmt.Errorf("couldn't read RDB fully")
 	}
 
-	return nil
+	return result, nil
 }
 
-// the first return arg is a flag for propagation to secondaries.
+// processRequest dispatches the request to its command in the command table.
 func (h *Handler) processRequest(request Message) error {
+	if request == NULL {
+		// a null array is ignored, like an empty one.
+		return nil
+	}
+
 	msg, ok := request.(*ArrayMessage)
 	if !ok {
-		// TODO: request that cannot be understood by this logic.
-		return fmt.Errorf("couldn't understand request: %v", request)
+		// like Redis, the client learns what was wrong before the connection is closed.
+		pe := newProtocolError("expected an array of bulk strings")
+		if err := h.reject(NewError("ERR " + pe.Error())); err != nil {
+			return err
+		}
+		return fmt.Errorf("couldn't understand request %q: %w", request.Redis(), pe)
 	}
 
-	switch msg.Raw()[0] {
-	case "CONFIG":
-		err := h.handleConfig(msg.Token(1), msg.Token(2))
-		if err != nil {
-			return fmt.Errorf("handleConfig: %v", err)
-		}
+	if msg.Len() == 0 {
+		// an empty array is ignored, like Redis does.
+		return nil
+	}
 
-	case "PING":
-		if h.server {
-			// We don't handle ping when master sends to slave for keep-alive purpose.
-			err := h.handlePing()
-			if err != nil {
-				return fmt.Errorf("handlePing: %v", err)
-			}
-		}
+	// errors about the command itself are replied, and the connection stays open.
+	cmd, em := lookupRequest(msg)
+	if em != nil {
+		return h.reject(em)
+	}
 
-	case "ECHO":
-		err := h.handleEcho(msg.Token(1))
-		if err != nil {
-			return fmt.Errorf("handleEcho: %v", err)
+	// while a script runs, the other clients wait for it, unless it runs for longer than lua-time-limit.
+	if h.server && cmd.flags&flagAllowBusy == 0 {
+		if em := h.waitScript(); em != nil {
+			return h.reject(em)
 		}
+	}
 
-	case "INFO":
-		err := h.handleInfo()
-		if err != nil {
-			return fmt.Errorf("handleInfo: %v", err)
-		}
+	// writes from the master link are applied silently, but normal clients of a read-only replica are refused.
+	if h.server && cmd.flags&flagWrite != 0 && h.opts.ReadOnlyReplica && h.repl.Role() == "slave" {
+		return h.reject(READONLY)
+	}
 
-	case "SET":
-		options := map[string][]string{}
-		var err error
-		if msg.Len() > 3 {
-			options, err = BuildOptions(
-				msg.SliceFrom(3),
-				OptionConfig{"EX": 1, "PX": 1, "EXAT": 1, "PXAT": 1, "NX": 0, "XX": 0, "KEEPTTL": 0, "GET": 0},
-			)
-			if err != nil {
-				return fmt.Errorf("buildOptions for set operation: %v", err)
-			}
+	// with min-replicas-to-write, the master refuses writes unless enough slaves are keeping up with it.
+	if h.server && cmd.flags&flagWrite != 0 && h.tooFewReplicas() {
+		return h.reject(NOREPLICAS)
+	}
+
+	// in cluster mode, clients are redirected to the node serving the keys of the request. Redirected writes
+	// aren't propagated, as the slaves of this node don't serve their slots either.
+	asking := h.asking
+	h.asking = false
+	redirected := func() Message {
+		if !h.server {
+			return nil
 		}
+		return h.redirect(cmd, msg, asking)
+	}
 
-		key, value := msg.Token(1), msg.Token(2)
-		err = h.handleSet(key, value, options)
-		if err != nil {
-			return fmt.Errorf("handleSet: %v", err)
+	// in a transaction, commands are queued until EXEC.
+	if h.multi != nil && cmd.name != "exec" && cmd.name != "discard" {
+		if cmd.flags&flagNoMulti != 0 {
+			return h.reject(NewError("ERR Command not allowed inside a transaction"))
 		}
+		if reply := redirected(); reply != nil {
+			return h.reject(reply)
+		}
+		return h.queue(cmd, msg)
+	}
 
-	case "GET":
-		err := h.handleGet(msg.Token(1))
-		if err != nil {
-			return fmt.Errorf("handleGet: %v", err)
+	run := func() error {
+		// the keys of a migrating slot are checked under the lock of the command, so that MIGRATE can't move
+		// them in between.
+		if reply := redirected(); reply != nil {
+			return h.reject(reply)
 		}
 
-	case "REPLCONF":
-		err := h.handleReplConf(msg.SliceFrom(1))
+		dirty, err := h.call(cmd, msg)
 		if err != nil {
-			return fmt.Errorf("handleReplConf: %v", err)
+			return err
 		}
 
-	case "PSYNC":
-		if h.opts.Role != "master" {
-			return fmt.Errorf("role is not master: %s", h.opts.Role)
+		if dirty && h.server && h.repl.Role() == "master" {
+			// propagation never fails the request: slow or broken slaves are disconnected instead.
+			h.propagate(msg)
 		}
+		return nil
+	}
 
-		// register a new slave to update continuously.
-		h.mc.AddSlave(h.conn)
+	// commands accessing the dataset don't run in the middle of a transaction, and exclusive commands don't run
+	// in the middle of any command.
+	switch {
+	case cmd.flags&flagExclusive != 0:
+		return h.runExclusive(run)
+	case cmd.flags&(flagWrite|flagReadOnly) != 0 && !h.exclusive:
+		return h.cache.Run(run)
+	}
+	return run()
+}
 
-		offset, err := strconv.Atoi(msg.Token(2))
-		if err != nil {
-			return fmt.Errorf("strconv.Atoi: %w", err)
-		}
+// call runs the handler of the command, and returns whether the command changed the dataset.
+func (h *Handler) call(cmd *command, msg *ArrayMessage) (bool, error) {
+	h.dirty = false
+	if err := cmd.handler(h, msg); err != nil {
+		return false, fmt.Errorf("%s failed: %w", cmd.name, err)
+	}
 
-		err = h.handlePsync(msg.Token(1), offset)
-		if err != nil {
-			return fmt.Errorf("handlePsync: %w", err)
-		}
+	dirty := h.dirty
+	h.dirty = false
+	return dirty, nil
+}
 
-	case "WAIT":
-		if h.opts.Role != "master" {
-			return fmt.Errorf("role is not master: %s", h.opts.Role)
-		}
+// lookupRequest returns the command of the request, or its subcommand, with the arity checked.
+func lookupRequest(msg *ArrayMessage) (*command, *ErrorMessage) {
+	cmd := lookupCommand(msg.Token(0))
+	if cmd == nil {
+		return nil, NewUnknownCommandError(msg.Raw())
+	}
+	if !cmd.checkArity(msg.Len()) {
+		return nil, NewArityError(cmd.name)
+	}
 
-		numReplicas, err := strconv.Atoi(msg.Token(1))
-		if err != nil {
-			return fmt.Errorf("strconv.Atoi: %w", err)
+	if cmd.subcommands != nil && msg.Len() >= 2 {
+		sub := cmd.subcommands[strings.ToLower(msg.Token(1))]
+		if sub == nil {
+			return nil, NewUnknownSubcommandError(cmd.name, msg.Token(1))
 		}
-
-		timeout, err := strconv.Atoi(msg.Token(2))
-		if err != nil {
-			return fmt.Errorf("strconv.Atoi: %w", err)
+		if !sub.checkArity(msg.Len()) {
+			return nil, NewArityError(sub.name)
 		}
+		cmd = sub
+	}
 
-		err = h.handleWait(numReplicas, timeout)
-		if err != nil {
-			return fmt.Errorf("h.handleWait failed: %w", err)
-		}
+	return cmd, nil
+}
 
-	case "KEYS":
-		err := h.handleKeys(msg.SliceFrom(1))
-		if err != nil {
-			return fmt.Errorf("h.handleKeys failed: %w", err)
-		}
+// tooFewReplicas returns whether min-replicas-to-write is set and the master has fewer good slaves.
+func (h *Handler) tooFewReplicas() bool {
+	return h.opts.MinReplicasToWrite > 0 && h.repl.Role() == "master" &&
+		h.mc.GoodSlaveNum(time.Duration(h.opts.MinReplicasMaxLag)*time.Second) < h.opts.MinReplicasToWrite
+}
+
+// reject replies the error about a request which is not run. In a transaction, the transaction fails at EXEC.
+func (h *Handler) reject(reply Message) error {
+	if h.multi != nil {
+		h.multi.aborted = true
+	}
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
 	}
 
 	return nil
 }
 
-func (h *Handler) handleConfig(cmd, param string) error {
-	if strings.EqualFold(cmd, "GET") {
-		if strings.EqualFold(param, "dir") {
-			if err := h.conn.Write(NewArray([]string{"dir", h.opts.Dir})); err != nil {
-				return fmt.Errorf("h.conn.Write failed: %w", err)
-			}
-		} else if strings.EqualFold(param, "dir") {
-			if err := h.conn.Write(NewArray([]string{"dbfilename", h.opts.DbFilename})); err != nil {
-				return fmt.Errorf("h.conn.Write failed: %w", err)
-			}
+// handleConfig handles CONFIG GET parameter [parameter ...]. The reply is a map of the parameters known.
+func (h *Handler) handleConfig(args []string) error {
+	if !strings.EqualFold(args[0], "GET") {
+		return h.replyError(NewUnknownSubcommandError("config", args[0]))
+	}
+	if len(args) < 2 {
+		return h.replyError(NewArityError("config|get"))
+	}
+
+	params := map[string]string{
+		"dir":        h.opts.Dir,
+		"dbfilename": h.opts.DbFilename,
+	}
+
+	items := make([]Message, 0)
+	for _, param := range args[1:] {
+		name := strings.ToLower(param)
+		if value, ok := params[name]; ok {
+			items = append(items, NewBulk(name), NewBulk(value))
 		}
 	}
-	return fmt.Errorf("cannot process the cmd: %s %s", cmd, param)
+
+	if err := h.conn.Write(NewMap(items)); err != nil {
+		return fmt.Errorf("h.conn.Write failed: %w", err)
+	}
+
+	return nil
 }
 
 func (h *Handler) handlePing() error {
@@ -414,16 +572,22 @@ func (h *Handler) handleSet(key, val string, options map[string][]string) error
 	var expireAfter int64
 
 	if ex, ok := options["PX"]; ok {
+		if len(ex) == 0 {
+			return h.replyError(SYNTAXERR)
+		}
+
 		millisec, err := strconv.ParseInt(ex[0], 10, 64)
 		if err != nil {
-			return fmt.Errorf("the given PX option value cannot be converted into int64: %v", err)
+			return h.replyError(NOTINTEGER)
 		}
 		expireAfter = millisec
 	}
 
 	h.cache.Set(key, val, expireAfter)
+	h.dirty = true
 
-	if h.opts.Role != "master" {
+	if !h.server {
+		// no reply to the master.
 		return nil
 	}
 
@@ -450,8 +614,45 @@ func (h *Handler) handleGet(key string) error {
 	return nil
 }
 
+func (h *Handler) handleDel(keys []string) error {
+	deleted := h.cache.Delete(keys...)
+	h.dirty = deleted > 0
+
+	if !h.server {
+		// no reply to the master.
+		return nil
+	}
+
+	if err := h.conn.Write(NewInt(deleted)); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// writeError replies the error to the client. Nothing is written to the master, which doesn't read replies.
+func (h *Handler) writeError(msg string) error {
+	return h.replyError(NewError(msg))
+}
+
+// replyError is writeError for a pre-defined error message.
+func (h *Handler) replyError(em *ErrorMessage) error {
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(em); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
 func (h *Handler) handleInfo() error {
-	info := NewBulk(strings.Join(h.info.Info(), "\r\n"))
+	i := info.Info{
+		Replication: h.repl.Info(),
+	}
+	info := NewVerbatim("txt", []byte(strings.Join(i.Info(), "\r\n")))
 
 	err := h.conn.Write(info)
 	if err != nil {
@@ -461,69 +662,130 @@ func (h *Handler) handleInfo() error {
 	return nil
 }
 
+// handleSave writes the keys and the function libraries to the RDB file loaded at startup.
+func (h *Handler) handleSave() error {
+	if h.opts.Dir == "" || h.opts.DbFilename == "" {
+		return h.writeError("ERR dir and dbfilename must be set to save the RDB file")
+	}
+
+	if err := storage.WriteRDBToFile(h.opts.Dir, h.opts.DbFilename, h.cache.Snapshot()); err != nil {
+		fmt.Fprintf(os.Stderr, "storage.WriteRDBToFile failed: %v\n", err)
+		return h.writeError("ERR saving the RDB file failed")
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
 func (h *Handler) handleWait(numReplicas, timeout int) error {
-	toWait := make([]*Connection, 0)
-	for _, slave := range h.mc.slaves {
-		if h.mc.propagationOffset > slave.propagatedOffset {
-			toWait = append(toWait, slave.conn)
-		}
+	// the slaves should acknowledge everything this client has written.
+	target := h.lastWriteOffset
+
+	if h.mc.SyncedSlaveNum(target) < numReplicas {
+		// GETACK goes through the replication stream, so that every slave accounts for it in its offset.
+		h.mc.Propagate(NewArray([]string{"REPLCONF", "GETACK", "*"}))
 	}
-	if len(toWait) == 0 {
-		// nothing to wait for - return immediately.
-		allInSync := NewInt(len(h.mc.slaves))
-		err := h.conn.Write(allInSync)
-		if err != nil {
-			return fmt.Errorf("h.conn.Write failed: %w", err)
-		}
-		return nil
+
+	synced := h.mc.WaitForSlaves(numReplicas, target, time.Duration(timeout)*time.Millisecond)
+	if err := h.conn.Write(NewInt(synced)); err != nil {
+		return fmt.Errorf("h.conn.Write failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) handleWaitAOF(numLocal, numReplicas, timeout int) error {
+	aof := h.repl.AOF()
+	if numLocal > 0 && aof == nil {
+		return h.writeError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
 	}
 
-	slaveAckWG := h.mc.NewSlaveAckWG(min(len(toWait), numReplicas))
+	// the local AOF and the slaves should fsync everything this client has written.
+	target := h.lastWriteOffset
 
-	getAck := NewArray([]string{"REPLCONF", "GETACK", "*"})
-	for _, c := range toWait {
-		// cannot use h.conn.Write here because we should send to slave
-		if err := c.Write(getAck); err != nil {
-			fmt.Fprintf(os.Stderr, "c.Write failed: %v", err)
-			slaveAckWG.Done()
-		}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
 	}
 
-	slaveAckWG.TimedWait(timeout)
+	if numReplicas > 0 {
+		// ask for fresh FACKs.
+		h.mc.Propagate(NewArray([]string{"REPLCONF", "GETACK", "*"}))
+	}
 
-	syncedSlaves := NewInt(h.mc.SyncedSlaveNum())
-	if err := h.conn.Write(syncedSlaves); err != nil {
-		return fmt.Errorf("h.conn.Write failed: %w", err)
+	var local int
+	if numLocal > 0 && aof.WaitFsynced(target, deadline) {
+		local = 1
+	} else if aof != nil && aof.FsyncedOffset() >= target {
+		local = 1
 	}
 
-	// because we sent getAck command for this
-	h.mc.AdvancePropagation(len(getAck.Redis()))
+	var remaining time.Duration
+	if !deadline.IsZero() {
+		// a tiny positive duration: the deadline has passed, but we still count the slaves already synced.
+		remaining = max(time.Until(deadline), time.Nanosecond)
+	}
+
+	synced := h.mc.WaitForSlavesAOF(numReplicas, target, remaining)
+	if err := h.conn.Write(NewNestedArray([]Message{NewInt(local), NewInt(synced)})); err != nil {
+		return fmt.Errorf("h.conn.Write failed: %w", err)
+	}
 
 	return nil
 }
 
 func (h *Handler) handleReplConf(request []string) error {
-	if h.opts.Role != "master" && CommandEquals(request[0], "GETACK") {
-		// 37 represents the length of REPLCONF GETACK * command itself.
-		transferred := h.conn.Offset() - h.replicationStartOffset - 37
-		r := strconv.FormatUint(transferred, 10)
+	// options come in pairs.
+	if len(request) == 0 || len(request)%2 != 0 {
+		return h.replyError(SYNTAXERR)
+	}
 
-		// send response to master.
-		if err := h.conn.Write(NewArray([]string{"REPLCONF", "ACK", r})); err != nil {
+	if !h.server && CommandEquals(request[0], "GETACK") {
+		// send response to master. the offset doesn't include the REPLCONF GETACK command itself yet.
+		if err := h.conn.Write(h.repl.AckMessage(h.replicationOffset)); err != nil {
 			return fmt.Errorf("h.conn.Write failed: %w", err)
 		}
 
 		return nil
 
-	} else if h.opts.Role == "master" && CommandEquals(request[0], "ACK") {
+	} else if h.server && CommandEquals(request[0], "ACK") {
 		offset, err := strconv.ParseUint(request[1], 10, 64)
 		if err != nil {
 			return fmt.Errorf("strconf.ParseInt failed: %w", err)
 		}
 
-		h.mc.AckSlave(h.conn, offset)
+		// REPLCONF ACK <offset> FACK <aof offset>
+		var aofOffset uint64
+		if len(request) >= 4 && CommandEquals(request[2], "FACK") {
+			aofOffset, err = strconv.ParseUint(request[3], 10, 64)
+			if err != nil {
+				return fmt.Errorf("strconf.ParseInt failed: %w", err)
+			}
+		}
+
+		if err := h.mc.AckSlave(h.conn, offset, aofOffset); err != nil {
+			// not a slave (anymore). nothing to reply to ACK anyway.
+			fmt.Fprintf(os.Stderr, "h.mc.AckSlave failed: %v\n", err)
+		}
 
 		return nil
+	} else if h.server && CommandEquals(request[0], "capa") {
+		// REPLCONF capa <capability> [capa <capability> ...]
+		for i := 1; i < len(request); i += 2 {
+			if CommandEquals(request[i], "eof") {
+				h.slaveCapaEOF = true
+			}
+		}
+	} else if h.server && CommandEquals(request[0], "listening-port") {
+		port, err := strconv.Atoi(request[1])
+		if err != nil {
+			return h.replyError(NOTINTEGER)
+		}
+
+		h.slaveListeningPort = port
 	}
 
 	err := h.conn.Write(OK)
@@ -534,24 +796,44 @@ func (h *Handler) handleReplConf(request []string) error {
 	return nil
 }
 
+// handlePsync handles PSYNC replicationid offset, where the offset is the one of the next byte the slave needs.
+// The slave continues from there if the backlog still has it, and resyncs from scratch otherwise.
 func (h *Handler) handlePsync(id string, offset int) error {
-	// replication id and offset is not used for now.
-	if id != "?" && id != h.opts.ReplicationID {
-		return fmt.Errorf("client-sent rid is different from ours: client: %s, this: %s", id, h.opts.ReplicationID)
-	}
+	if id != "?" && offset > 0 {
+		if rid := h.repl.ContinueSlave(h.conn, h.slaveListeningPort, id, uint64(offset-1)); rid != "" {
+			if err := h.conn.Write(NewSimple("CONTINUE " + rid)); err != nil {
+				return fmt.Errorf("write response failed: %w", err)
+			}
 
-	if id == "?" && offset > 0 {
-		return fmt.Errorf("wrong rsync request: id: %s, offset: %d", id, offset)
+			h.mc.SetSlaveOnline(h.conn)
+			return nil
+		}
 	}
 
-	if offset <= 0 { // FULLRESYNC
-		fullResync := NewSimple(fmt.Sprintf("FULLRESYNC %s 0", h.opts.ReplicationID))
+	rid := h.repl.ID()
+	if h.opts.DisklessSync && h.slaveCapaEOF { // FULLRESYNC, streaming the RDB
+		// the slave is registered, and gets FULLRESYNC when the shared transfer starts.
+		if err := <-h.repl.ScheduleDisklessSync(h.conn, h.slaveListeningPort); err != nil {
+			return fmt.Errorf("diskless sync failed: %w", err)
+		}
+	} else { // FULLRESYNC
+		// register a new slave to update continuously. The snapshot is taken while no write runs, so that each
+		// write is either in the snapshot or in the replication stream to the slave, never both.
+		var start uint64
+		var snapshot *storage.Cache
+		_ = h.runExclusive(func() error {
+			start = h.mc.AddSlave(h.conn, h.slaveListeningPort)
+			snapshot = h.cache.Snapshot()
+			return nil
+		})
+
+		fullResync := NewSimple(fmt.Sprintf("FULLRESYNC %s %d", rid, start))
 		if err := h.conn.Write(fullResync); err != nil {
 			return fmt.Errorf("write response failed: %w", err)
 		}
 
 		// We need to read RDB file and send it.
-		rdb, err := h.readRDB()
+		rdb, err := readRDB(snapshot)
 		if err != nil {
 			return fmt.Errorf("readRDB failed: %w", err)
 		}
@@ -561,9 +843,8 @@ func (h *Handler) handlePsync(id string, offset int) error {
 		if err := h.conn.WriteString(rdb); err != nil {
 			return fmt.Errorf("write response failed: %w", err)
 		}
-	} else {
-		return fmt.Errorf("not implemented")
-		// Should implement a response to PSYNC <replicationid> <offset>
+
+		h.mc.SetSlaveOnline(h.conn)
 	}
 
 	return nil
@@ -583,9 +864,84 @@ func (h *Handler) handleKeys(_ []string) error {
 	return nil
 }
 
-// readRDB returns the base64-decoded RDB file.
-func (h *Handler) readRDB() (string, error) {
-	// TODO:
+func (h *Handler) handleReplicaOf(host, port string) error {
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		if err := h.repl.Promote(); err != nil {
+			return h.writeError("ERR " + err.Error())
+		}
+
+		if err := h.conn.Write(OK); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+		return nil
+	}
+
+	ip, p, err := config.ResolveMaster(host, port)
+	if err != nil {
+		return h.writeError("ERR Invalid master address: " + err.Error())
+	}
+
+	reply := OK
+	if !h.repl.ReplicaOf(ip, p) {
+		reply = NewSimple("OK Already connected to specified master")
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) handleSubscribe(channels []string) error {
+	for _, channel := range channels {
+		h.state.PubSub().Subscribe(h.conn, channel)
+		h.subscriptions[channel] = struct{}{}
+
+		reply := NewPush([]Message{NewBulk("subscribe"), NewBulk(channel), NewInt(len(h.subscriptions))})
+		if err := h.conn.Write(reply); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) handleUnsubscribe(channels []string) error {
+	if len(channels) == 0 {
+		// unsubscribe from all channels.
+		for channel := range h.subscriptions {
+			channels = append(channels, channel)
+		}
+	}
+
+	if len(channels) == 0 {
+		reply := NewPush([]Message{NewBulk("unsubscribe"), NULL, NewInt(0)})
+		if err := h.conn.Write(reply); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+		return nil
+	}
+
+	for _, channel := range channels {
+		h.state.PubSub().Unsubscribe(h.conn, channel)
+		delete(h.subscriptions, channel)
+
+		reply := NewPush([]Message{NewBulk("unsubscribe"), NewBulk(channel), NewInt(len(h.subscriptions))})
+		if err := h.conn.Write(reply); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readRDB returns the snapshot of the cache in the RDB format.
+func readRDB(snapshot *storage.Cache) (string, error) {
+	var buf bytes.Buffer
+	if err := storage.WriteRDB(&buf, snapshot); err != nil {
+		return "", fmt.Errorf("storage.WriteRDB failed: %w", err)
+	}
 
-	return storage.EmptyRDBString()
+	return buf.String(), nil
 }
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_ErrorReplies(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "unknown command", args: []string{"NOPE", "a", "b\r\nc"}, want: "-ERR unknown command 'NOPE', with args beginning with: 'a' 'b  c' \r\n"},
+		{name: "too few arguments", args: []string{"GET"}, want: "-ERR wrong number of arguments for 'get' command\r\n"},
+		{name: "too many arguments", args: []string{"ECHO", "a", "b"}, want: "-ERR wrong number of arguments for 'echo' command\r\n"},
+		{name: "syntax error", args: []string{"SET", "foo", "bar", "NOPE"}, want: "-ERR syntax error\r\n"},
+		{name: "not an integer", args: []string{"WAIT", "x", "0"}, want: "-ERR value is not an integer or out of range\r\n"},
+		{name: "unknown subcommand", args: []string{"CONFIG", "SET", "dir", "/tmp"}, want: "-ERR unknown subcommand 'SET'. Try CONFIG HELP.\r\n"},
+		{name: "config get", args: []string{"CONFIG", "GET", "DBFILENAME", "nope"}, want: "*2\r\n$10\r\ndbfilename\r\n$0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, request(t, client, tt.args...))
+
+			// the connection is still usable.
+			assert.Equal(t, "+PONG\r\n", request(t, client, "PING"))
+		})
+	}
+
+	// a protocol error is replied, and then the connection is closed.
+	require.NoError(t, client.WriteString("*1\r\n$x\r\n"))
+	reply, err := ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", string(reply.Redis()))
+
+	_, err = ReadMessage(client)
+	assert.Error(t, err)
+
+	// so is a request which isn't an array of bulk strings.
+	client = dialTestServer(t, port)
+	require.NoError(t, client.WriteString("*-1\r\n*1\r\n*0\r\n"))
+	reply, err = ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, "-ERR Protocol error: expected an array of bulk strings\r\n", string(reply.Redis()))
+
+	_, err = ReadMessage(client)
+	assert.Error(t, err)
+}
+
+func TestHandler_FailedWrites(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"SET", "foo", "bar", "PX", "abc"}, want: "-ERR value is not an integer or out of range\r\n"},
+		{args: []string{"SET", "foo", "bar", "NOPE"}, want: "-ERR syntax error\r\n"},
+		{args: []string{"DEL", "nokey"}, want: ":0\r\n"},
+		{args: []string{"RESTORE", "foo", "0", "garbage"}, want: "-ERR DUMP payload version or checksum are wrong\r\n"},
+		{args: []string{"FUNCTION", "LOAD", "garbage"}, want: "-ERR Missing library metadata\r\n"},
+		{args: []string{"FUNCTION", "DELETE", "nolib"}, want: "-ERR Library not found\r\n"},
+		{args: []string{"FUNCTION", "RESTORE", "garbage"}, want: "-ERR payload version or checksum are wrong\r\n"},
+		{args: []string{"EVAL", "return redis.pcall('SET', 'foo', 'bar', 'PX', 'abc')", "0"}, want: "-ERR value is not an integer or out of range\r\n"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, request(t, client, tt.args...), tt.args)
+	}
+
+	require.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+	require.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "bar", "PX", "abc"))
+	require.Equal(t, "*1\r\n-ERR value is not an integer or out of range\r\n", execRequest(t, client, 1))
+
+	// the writes which failed changed nothing, so nothing is propagated.
+	assert.Zero(t, master.Info().MasterReplOffset)
+
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+	assert.Equal(t, len(NewArray([]string{"SET", "foo", "bar"}).Redis()), master.Info().MasterReplOffset)
+}
+
+func TestHandler_PartialRequest(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	// the reply to PING is written while the server waits for the rest of the next request.
+	require.NoError(t, client.WriteString("*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPI"))
+	require.NoError(t, client.SetDeadline(time.Now().Add(time.Second)))
+	reply, err := ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", string(reply.Redis()))
+
+	require.NoError(t, client.WriteString("NG\r\n"))
+	reply, err = ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", string(reply.Redis()))
+}
+
+func TestNewUnknownCommandError(t *testing.T) {
+	em := NewUnknownCommandError([]string{"FOO", strings.Repeat("x", 200), "b"})
+	assert.Equal(t, "ERR", em.Code())
+	assert.Equal(t, "ERR unknown command 'FOO', with args beginning with: '"+strings.Repeat("x", 128)+"' ", em.Raw())
+}
+
+// BenchmarkPipeline sends SET and GET requests in pipelines of the given depth, like redis-benchmark -P.
+func BenchmarkPipeline(b *testing.B) {
+	for _, depth := range []int{1, 16} {
+		b.Run(fmt.Sprintf("P=%d", depth), func(b *testing.B) {
+			_, port := startTestServer(b, &config.Opts{})
+			client := dialTestServer(b, port)
+
+			var batch []byte
+			for i := 0; i < depth; i++ {
+				batch = append(batch, NewArray([]string{"SET", "key", "value"}).Redis()...)
+				batch = append(batch, NewArray([]string{"GET", "key"}).Redis()...)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 2 * depth {
+				if err := client.WriteBytes(batch); err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < 2*depth; j++ {
+					if _, err := ReadMessage(client); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_CommandTable(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	// commands are case-insensitive.
+	assert.Equal(t, "+OK\r\n", request(t, client, "set", "foo", "bar", "px", "100000"))
+	assert.Equal(t, "$3\r\nbar\r\n", request(t, client, "Get", "foo"))
+	assert.Equal(t, "-ERR syntax error\r\n", request(t, client, "SET", "foo", "bar", "PX"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'config' command\r\n", request(t, client, "config"))
+
+	// propagation follows the write flag of the command.
+	assert.True(t, NewArray([]string{"del", "foo"}).Propagatible())
+	assert.False(t, NewArray([]string{"GET", "foo"}).Propagatible())
+	assert.False(t, NewArray([]string{"MIGRATE", "host", "6379", "foo", "0", "1000"}).Propagatible())
+}
+
+func TestCommand_KeysOf(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{args: []string{"GET", "foo"}, want: []string{"foo"}},
+		{args: []string{"SET", "foo", "bar", "PX", "100"}, want: []string{"foo"}},
+		{args: []string{"DEL", "a", "b", "c"}, want: []string{"a", "b", "c"}},
+		{args: []string{"PING"}, want: nil},
+		{args: []string{"MIGRATE", "host", "6379", "foo", "0", "1000"}, want: []string{"foo"}},
+		{args: []string{"MIGRATE", "host", "6379", "", "0", "1000", "COPY", "KEYS", "a", "b"}, want: []string{"a", "b"}},
+		{args: []string{"EVAL", "return 1", "2", "a", "b", "arg"}, want: []string{"a", "b"}},
+		{args: []string{"EVAL", "return 1", "0", "arg"}, want: nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, lookupCommand(tt.args[0]).keysOf(tt.args), tt.args)
+	}
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// serverVersion is the version of Redis reported to the clients.
+const serverVersion = "7.2.0"
+
+var (
+	NOPROTO   = NewError("NOPROTO unsupported protocol version")
+	WRONGPASS = NewError("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// nextClientID gives each connection a unique id, like CLIENT ID of Redis.
+var nextClientID atomic.Int64
+
+// handleHello handles HELLO [protover [AUTH username password] [SETNAME clientname]]. The protocol version
+// switches the encoding of the replies to this connection, and the reply is the properties of the server.
+func (h *Handler) handleHello(args []string) error {
+	proto := h.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return h.writeError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			if err := h.conn.Write(NOPROTO); err != nil {
+				return fmt.Errorf("write response failed: %w", err)
+			}
+			return nil
+		}
+		proto = v
+	}
+
+	var name *string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+			// there is no ACL: only the default user exists, and it has no password.
+			if args[i+1] != "default" {
+				if err := h.conn.Write(WRONGPASS); err != nil {
+					return fmt.Errorf("write response failed: %w", err)
+				}
+				return nil
+			}
+			i += 2
+
+		case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+			if !validClientName(args[i+1]) {
+				return h.writeError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = &args[i+1]
+			i++
+
+		default:
+			return h.writeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+		}
+	}
+
+	h.proto = proto
+	h.conn.SetProtocol(proto)
+	if name != nil {
+		h.name = *name
+	}
+
+	mode := "standalone"
+	if h.state.Cluster() != nil {
+		mode = "cluster"
+	}
+
+	role := h.repl.Role()
+	if role == "slave" {
+		role = "replica"
+	}
+
+	reply := NewMap([]Message{
+		NewBulk("server"), NewBulk("redis"),
+		NewBulk("version"), NewBulk(serverVersion),
+		NewBulk("proto"), NewInt(proto),
+		NewBulk("id"), NewInt(int(h.id)),
+		NewBulk("mode"), NewBulk(mode),
+		NewBulk("role"), NewBulk(role),
+		NewBulk("modules"), NewNestedArray([]Message{}),
+	})
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// handleClient handles CLIENT ID|GETNAME|SETNAME.
+func (h *Handler) handleClient(args []string) error {
+	if len(args) == 0 {
+		return h.replyError(NewArityError("client"))
+	}
+
+	var reply Message
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		reply = NewInt(int(h.id))
+
+	case "GETNAME":
+		reply = NULL
+		if h.name != "" {
+			reply = NewBulk(h.name)
+		}
+
+	case "SETNAME":
+		if len(args) != 2 {
+			return h.replyError(NewArityError("client|setname"))
+		}
+		if !validClientName(args[1]) {
+			return h.writeError("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		h.name = args[1]
+		reply = OK
+
+	default:
+		return h.replyError(NewUnknownSubcommandError("client", args[0]))
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// validClientName returns false if the name has spaces, newlines or other characters outside of '!' to '~'.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
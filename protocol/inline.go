@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxInlineLength is the longest inline request accepted, like PROTO_INLINE_MAX_SIZE of Redis.
+const maxInlineLength = 64 * 1024
+
+// ReadRequest reads one request from a client. A request is usually an array of bulk strings, but a line of
+// whitespace-separated tokens (an inline command) is understood too, so that plain telnet or netcat can be used.
+// An empty inline command is returned as an empty array.
+func ReadRequest(c *Connection) (Message, error) {
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("c.reader.Peek failed: %w", err)
+	}
+
+	if b[0] == '*' {
+		return ReadMessage(c)
+	}
+
+	line, err := c.readInline()
+	if err != nil {
+		return nil, fmt.Errorf("c.readInline failed: %w", err)
+	}
+
+	args, err := splitArgs(line)
+	if err != nil {
+		return nil, newProtocolError("%v", err)
+	}
+
+	return NewArrayBytes(args), nil
+}
+
+// splitArgs splits the line into tokens separated by whitespace, like sdssplitargs of Redis. A token can be
+// quoted: "..." understands escapes such as \n, \t and \xHH, and '...' only \'. A closing quote must be followed
+// by whitespace or the end of the line.
+func splitArgs(line []byte) ([][]byte, error) {
+	args := make([][]byte, 0)
+
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		var inDouble, inSingle bool
+		for done := false; !done; {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				break
+			}
+
+			c := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					v, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(v))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case c == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+
+			case inSingle:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg = append(arg, '\'')
+					i++
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			i++
+		}
+
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
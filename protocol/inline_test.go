@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{name: "empty", line: "", want: []string{}},
+		{name: "spaces only", line: " \t ", want: []string{}},
+		{name: "tokens", line: "  SET foo\tbar ", want: []string{"SET", "foo", "bar"}},
+		{name: "double quotes", line: `SET "hello world" ""`, want: []string{"SET", "hello world", ""}},
+		{name: "escapes", line: `"a\nb\tc\"d\\e\x41\xzz"`, want: []string{"a\nb\tc\"d\\eA" + "xzz"}},
+		{name: "single quotes", line: `'it\'s "raw" \n'`, want: []string{`it's "raw" \n`}},
+		{name: "quotes in token", line: `foo"bar baz"`, want: []string{"foobar baz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := splitArgs([]byte(tt.line))
+			require.NoError(t, err)
+			assert.Equal(t, NewArray(tt.want), NewArrayBytes(args))
+		})
+	}
+
+	for _, line := range []string{`"unterminated`, `'unterminated`, `"closed"too-early`, `'closed'too-early`} {
+		_, err := splitArgs([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	conn := newTestConnection([]byte("PING\nSET foo \"a b\"\r\n\r\n*1\r\n$4\r\nPING\r\n"))
+
+	for _, want := range []*ArrayMessage{
+		NewArray([]string{"PING"}),
+		NewArray([]string{"SET", "foo", "a b"}),
+		NewArray([]string{}),
+		NewArray([]string{"PING"}),
+	} {
+		msg, err := ReadRequest(conn)
+		require.NoError(t, err)
+		assert.Equal(t, want, msg)
+	}
+
+	_, err := ReadRequest(newTestConnection([]byte(strings.Repeat("x", maxInlineLength+1) + "\n")))
+	assert.True(t, errors.Is(err, ErrProtocol), "%v", err)
+
+	_, err = ReadRequest(newTestConnection([]byte("GET \"foo\n")))
+	assert.True(t, errors.Is(err, ErrProtocol), "%v", err)
+}
+
+func TestInlineCommands(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	require.NoError(t, client.WriteString("PING\n\nSET foo 'hello world'\nGET foo\n"))
+	for _, want := range []string{"+PONG\r\n", "+OK\r\n", "$11\r\nhello world\r\n"} {
+		reply, err := ReadMessage(client)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(reply.Redis()))
+	}
+}
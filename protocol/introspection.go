@@ -0,0 +1,296 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// aclCategories are the ACL categories in the order Redis shows them.
+var aclCategories = []string{
+	"@keyspace", "@read", "@write", "@set", "@sortedset", "@list", "@hash", "@string", "@bitmap", "@hyperloglog",
+	"@geo", "@stream", "@pubsub", "@admin", "@fast", "@slow", "@blocking", "@dangerous", "@connection",
+	"@transaction", "@scripting",
+}
+
+// handleCommand handles COMMAND [COUNT|INFO [command ...]|DOCS [command ...]|GETKEYS command [arg ...]].
+func (h *Handler) handleCommand(args []string) error {
+	var reply Message
+	switch {
+	case len(args) == 0:
+		reply = NewNestedArray(commandInfos(sortedCommands()))
+
+	case strings.EqualFold(args[0], "COUNT"):
+		reply = NewInt(len(commands))
+
+	case strings.EqualFold(args[0], "INFO"):
+		if len(args) == 1 {
+			reply = NewNestedArray(commandInfos(sortedCommands()))
+			break
+		}
+
+		items := make([]Message, 0, len(args)-1)
+		for _, name := range args[1:] {
+			if cmd := findCommand(name); cmd != nil {
+				items = append(items, cmd.info())
+			} else {
+				items = append(items, NULL)
+			}
+		}
+		reply = NewNestedArray(items)
+
+	case strings.EqualFold(args[0], "DOCS"):
+		cmds := sortedCommands()
+		if len(args) > 1 {
+			cmds = cmds[:0]
+			for _, name := range args[1:] {
+				// unknown commands are skipped.
+				if cmd := findCommand(name); cmd != nil {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+
+		items := make([]Message, 0, 2*len(cmds))
+		for _, cmd := range cmds {
+			items = append(items, NewBulk(cmd.name), cmd.docs())
+		}
+		reply = NewMap(items)
+
+	case strings.EqualFold(args[0], "GETKEYS"):
+		cmd := lookupCommand(args[1])
+		if cmd != nil && cmd.subcommands != nil && len(args) > 2 {
+			cmd = cmd.subcommands[strings.ToLower(args[2])]
+		}
+		if cmd == nil {
+			return h.writeError("ERR Invalid command specified")
+		}
+		if !cmd.checkArity(len(args) - 1) {
+			return h.writeError("ERR Invalid number of arguments specified for command")
+		}
+
+		keys := cmd.keysOf(args[1:])
+		if len(keys) == 0 {
+			return h.writeError("ERR The command has no key arguments")
+		}
+		reply = NewArray(keys)
+
+	default:
+		return h.replyError(NewUnknownSubcommandError("command", args[0]))
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// findCommand returns the command of the given name, or the subcommand of a name like "config|get".
+func findCommand(name string) *command {
+	name, subName, found := strings.Cut(name, "|")
+
+	cmd := lookupCommand(name)
+	if cmd == nil || !found {
+		return cmd
+	}
+	return cmd.subcommands[strings.ToLower(subName)]
+}
+
+// sortedCommands returns the commands of the table sorted by name, so that COMMAND replies the same each time.
+func sortedCommands() []*command {
+	return sortCommands(commands)
+}
+
+func sortCommands(table map[string]*command) []*command {
+	cmds := make([]*command, 0, len(table))
+	for _, cmd := range table {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+func commandInfos(cmds []*command) []Message {
+	items := make([]Message, 0, len(cmds))
+	for _, cmd := range cmds {
+		items = append(items, cmd.info())
+	}
+	return items
+}
+
+// info returns the entry of COMMAND INFO: name, arity, flags, first key, last key, step, ACL categories, tips,
+// key specs and subcommands.
+func (cmd *command) info() Message {
+	first, last, step := cmd.legacyRange()
+
+	keySpecs := make([]Message, 0, len(cmd.keySpecs))
+	for _, spec := range cmd.keySpecs {
+		keySpecs = append(keySpecs, spec.info())
+	}
+
+	return NewNestedArray([]Message{
+		NewBulk(cmd.name),
+		NewInt(cmd.arity),
+		NewSet(simpleStrings(cmd.flagNames())),
+		NewInt(first),
+		NewInt(last),
+		NewInt(step),
+		NewSet(simpleStrings(cmd.aclCategories())),
+		NewSet([]Message{}),
+		NewNestedArray(keySpecs),
+		NewNestedArray(commandInfos(sortCommands(cmd.subcommands))),
+	})
+}
+
+// legacyRange returns the first key, the last key and the step of the keys before key specs, which only tell
+// the keys at fixed positions. They come from the first key spec with an index.
+func (cmd *command) legacyRange() (int, int, int) {
+	for _, spec := range cmd.keySpecs {
+		if spec.keyword != "" || spec.keyNum {
+			continue
+		}
+
+		last := spec.index + spec.lastKey
+		if spec.lastKey < 0 {
+			last = spec.lastKey
+		}
+		return spec.index, last, spec.keyStep
+	}
+	return 0, 0, 0
+}
+
+func (cmd *command) flagNames() []string {
+	names := make([]string, 0)
+	for _, f := range flagNames {
+		if cmd.flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if cmd.movableKeys() {
+		names = append(names, "movablekeys")
+	}
+	return names
+}
+
+// movableKeys returns true if the keys can't be told from the legacy key range, such as MIGRATE and EVAL.
+func (cmd *command) movableKeys() bool {
+	if cmd.getKeys != nil {
+		return true
+	}
+	for _, spec := range cmd.keySpecs {
+		if spec.keyword != "" || spec.keyNum {
+			return true
+		}
+	}
+	return false
+}
+
+// aclCategories returns the categories implied by the flags, like Redis does, and the ones of the table.
+func (cmd *command) aclCategories() []string {
+	has := make(map[string]bool)
+	for _, c := range cmd.categories {
+		has[c] = true
+	}
+	if cmd.flags&flagWrite != 0 {
+		has["@write"] = true
+	}
+	if cmd.flags&flagReadOnly != 0 {
+		has["@read"] = true
+	}
+	if cmd.flags&flagAdmin != 0 {
+		has["@admin"] = true
+		has["@dangerous"] = true
+	}
+	if cmd.flags&flagPubSub != 0 {
+		has["@pubsub"] = true
+	}
+	if cmd.flags&flagFast != 0 {
+		has["@fast"] = true
+	} else {
+		has["@slow"] = true
+	}
+
+	res := make([]string, 0, len(has))
+	for _, c := range aclCategories {
+		if has[c] {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// info returns the key spec as shown by COMMAND INFO.
+func (spec keySpec) info() Message {
+	beginSearch := NewMap([]Message{
+		NewBulk("type"), NewBulk("index"),
+		NewBulk("spec"), NewMap([]Message{NewBulk("index"), NewInt(spec.index)}),
+	})
+	if spec.keyword != "" {
+		beginSearch = NewMap([]Message{
+			NewBulk("type"), NewBulk("keyword"),
+			NewBulk("spec"), NewMap([]Message{
+				NewBulk("keyword"), NewBulk(spec.keyword),
+				NewBulk("startfrom"), NewInt(spec.startFrom),
+			}),
+		})
+	}
+
+	findKeys := NewMap([]Message{
+		NewBulk("type"), NewBulk("range"),
+		NewBulk("spec"), NewMap([]Message{
+			NewBulk("lastkey"), NewInt(spec.lastKey),
+			NewBulk("keystep"), NewInt(spec.keyStep),
+			NewBulk("limit"), NewInt(0),
+		}),
+	})
+	if spec.keyNum {
+		findKeys = NewMap([]Message{
+			NewBulk("type"), NewBulk("keynum"),
+			NewBulk("spec"), NewMap([]Message{
+				NewBulk("keynumidx"), NewInt(spec.keyNumIdx),
+				NewBulk("firstkey"), NewInt(spec.firstKey),
+				NewBulk("keystep"), NewInt(spec.keyStep),
+			}),
+		})
+	}
+
+	return NewMap([]Message{
+		NewBulk("flags"), NewSet(simpleStrings(spec.flags)),
+		NewBulk("begin_search"), beginSearch,
+		NewBulk("find_keys"), findKeys,
+	})
+}
+
+// docs returns the documentation shown by COMMAND DOCS. Empty fields are left out.
+func (cmd *command) docs() Message {
+	items := make([]Message, 0)
+	for _, field := range []struct{ name, value string }{
+		{"summary", cmd.summary},
+		{"since", cmd.since},
+		{"group", cmd.group},
+		{"complexity", cmd.complexity},
+	} {
+		if field.value != "" {
+			items = append(items, NewBulk(field.name), NewBulk(field.value))
+		}
+	}
+
+	if len(cmd.subcommands) > 0 {
+		subs := make([]Message, 0, 2*len(cmd.subcommands))
+		for _, sub := range sortCommands(cmd.subcommands) {
+			subs = append(subs, NewBulk(sub.name), sub.docs())
+		}
+		items = append(items, NewBulk("subcommands"), NewMap(subs))
+	}
+
+	return NewMap(items)
+}
+
+func simpleStrings(strs []string) []Message {
+	items := make([]Message, 0, len(strs))
+	for _, s := range strs {
+		items = append(items, NewSimple(s))
+	}
+	return items
+}
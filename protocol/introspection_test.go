@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Command(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	t.Run("count", func(t *testing.T) {
+		assert.Equal(t, fmt.Sprintf(":%d\r\n", len(commands)), request(t, client, "COMMAND", "COUNT"))
+	})
+
+	t.Run("info", func(t *testing.T) {
+		want := "*2\r\n" +
+			"*10\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n*3\r\n+@read\r\n+@string\r\n+@fast\r\n*0\r\n" +
+			"*1\r\n*6\r\n$5\r\nflags\r\n*2\r\n+RO\r\n+ACCESS\r\n" +
+			"$12\r\nbegin_search\r\n*4\r\n$4\r\ntype\r\n$5\r\nindex\r\n$4\r\nspec\r\n*2\r\n$5\r\nindex\r\n:1\r\n" +
+			"$9\r\nfind_keys\r\n*4\r\n$4\r\ntype\r\n$5\r\nrange\r\n$4\r\nspec\r\n*6\r\n$7\r\nlastkey\r\n:0\r\n$7\r\nkeystep\r\n:1\r\n$5\r\nlimit\r\n:0\r\n" +
+			"*0\r\n" +
+			"$-1\r\n"
+		assert.Equal(t, want, request(t, client, "COMMAND", "INFO", "get", "nope"))
+
+		// the legacy key range of MIGRATE only tells the single key form.
+		reply := request(t, client, "COMMAND", "INFO", "MIGRATE")
+		assert.Contains(t, reply, "+movablekeys\r\n:3\r\n:3\r\n:1\r\n")
+		assert.Contains(t, reply, "$7\r\nkeyword\r\n$4\r\nKEYS\r\n$9\r\nstartfrom\r\n:-2\r\n")
+
+		// subcommands are shown by their container, and can be asked directly.
+		reply = request(t, client, "COMMAND", "INFO", "config")
+		assert.Contains(t, reply, "$10\r\nconfig|get\r\n:-3\r\n*2\r\n+admin\r\n+noscript\r\n")
+		assert.True(t, strings.HasSuffix(reply, request(t, client, "COMMAND", "INFO", "config|get")))
+
+		all := request(t, client, "COMMAND")
+		assert.True(t, strings.HasPrefix(all, fmt.Sprintf("*%d\r\n", len(commands))), all[:10])
+	})
+
+	t.Run("docs", func(t *testing.T) {
+		want := "*2\r\n$4\r\necho\r\n*8\r\n$7\r\nsummary\r\n$25\r\nReturns the given string.\r\n$5\r\nsince\r\n$5\r\n1.0.0\r\n" +
+			"$5\r\ngroup\r\n$10\r\nconnection\r\n$10\r\ncomplexity\r\n$4\r\nO(1)\r\n"
+		assert.Equal(t, want, request(t, client, "COMMAND", "DOCS", "echo", "nope"))
+		assert.Contains(t, request(t, client, "COMMAND", "DOCS", "client"), "$11\r\nsubcommands\r\n*6\r\n$14\r\nclient|getname\r\n")
+	})
+
+	t.Run("getkeys", func(t *testing.T) {
+		tests := []struct {
+			args []string
+			want string
+		}{
+			{args: []string{"GET", "foo"}, want: "*1\r\n$3\r\nfoo\r\n"},
+			{args: []string{"del", "a", "b"}, want: "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+			{args: []string{"MIGRATE", "host", "6379", "", "0", "1000", "KEYS", "a", "b"}, want: "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+			{args: []string{"NOPE", "foo"}, want: "-ERR Invalid command specified\r\n"},
+			{args: []string{"GET", "a", "b"}, want: "-ERR Invalid number of arguments specified for command\r\n"},
+			{args: []string{"PING", "foo"}, want: "-ERR The command has no key arguments\r\n"},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, request(t, client, append([]string{"COMMAND", "GETKEYS"}, tt.args...)...), tt.args)
+		}
+	})
+
+	t.Run("subcommands", func(t *testing.T) {
+		assert.Equal(t, "-ERR unknown subcommand 'NOPE'. Try COMMAND HELP.\r\n", request(t, client, "COMMAND", "NOPE"))
+		assert.Equal(t, "-ERR wrong number of arguments for 'client|setname' command\r\n", request(t, client, "CLIENT", "SETNAME"))
+		assert.Equal(t, "-ERR wrong number of arguments for 'command|getkeys' command\r\n", request(t, client, "COMMAND", "GETKEYS"))
+	})
+
+	// RESP3 shows flags and categories as sets, and docs as maps.
+	require.Contains(t, request(t, client, "HELLO", "3"), "proto")
+	require.NoError(t, client.Write(NewArray([]string{"COMMAND", "INFO", "get"})))
+	reply, err := ReadMessage(client)
+	require.NoError(t, err)
+	assert.Contains(t, string(reply.(resp3Message).RESP3()), "~2\r\n+readonly\r\n+fast\r\n")
+}
@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -13,68 +15,100 @@ var (
 	PING = NewArray([]string{"PING"})
 	PONG = NewSimple("PONG")
 	NULL = NewNull()
+
+	// NULLARRAY is the null of RESP2 replies which are arrays otherwise, such as EXEC.
+	NULLARRAY = NewNullArray()
+
+	READONLY   = NewError("READONLY You can't write against a read only replica.")
+	NOREPLICAS = NewError("NOREPLICAS Not enough good replicas to write.")
+
+	SYNTAXERR  = NewError("ERR syntax error")
+	NOTINTEGER = NewError("ERR value is not an integer or out of range")
+	WRONGTYPE  = NewError("WRONGTYPE Operation against a key holding the wrong kind of value")
 )
 
 type Message interface {
-	// Redis returns REDIS string representation of the message.
-	Redis() string
+	// Redis returns the RESP encoding of the message.
+	Redis() []byte
 
 	// Propagatible returns a boolean value saying whether the message can be propagated to message.
 	Propagatible() bool
 }
 
-// Propagatible commands (or requests)
-var propagatible = map[string]bool{
-	"SET": true,
-}
-
+// ArrayMessage is an array of bulk strings, such as a request. The bulk strings can hold any bytes.
 type ArrayMessage struct {
-	msg          string
-	raw          []string
+	msg          []byte
+	args         [][]byte
 	propagatible bool
 }
 
 // NewArray returns an message, which is an array of bulk strings.
 func NewArray(tokens []string) *ArrayMessage {
-	if len(tokens) == 0 {
-		return &ArrayMessage{
-			msg:          "*0\r\n",
-			raw:          []string{},
-			propagatible: false,
-		}
+	args := make([][]byte, 0, len(tokens))
+	for _, token := range tokens {
+		args = append(args, []byte(token))
 	}
 
-	bulks := make([]string, 0, len(tokens))
-	for _, blk := range tokens {
-		bulks = append(bulks, fmt.Sprintf("$%d\r\n%s", len(blk), blk))
+	return NewArrayBytes(args)
+}
+
+// NewArrayBytes returns an array of the given bulk strings.
+func NewArrayBytes(args [][]byte) *ArrayMessage {
+	var buf bytes.Buffer
+	buf.WriteByte('*')
+	buf.WriteString(strconv.Itoa(len(args)))
+	buf.WriteString("\r\n")
+	for _, arg := range args {
+		writeBulk(&buf, arg)
 	}
-	result := fmt.Sprintf("*%d\r\n%s\r\n", len(tokens), strings.Join(bulks, "\r\n"))
 
-	return &ArrayMessage{
-		msg:          result,
-		raw:          tokens,
-		propagatible: propagatible[strings.ToUpper(tokens[0])],
+	am := &ArrayMessage{
+		msg:  buf.Bytes(),
+		args: args,
+	}
+	if len(args) > 0 {
+		// subcommands have their own flags, such as FUNCTION LOAD.
+		if cmd, em := lookupRequest(am); em == nil {
+			am.propagatible = cmd.propagatible()
+		}
 	}
+
+	return am
 }
 
-func (sm *ArrayMessage) Raw() []string {
-	return sm.raw
+// Raw returns the bulk strings as Go strings.
+func (am *ArrayMessage) Raw() []string {
+	raw := make([]string, 0, len(am.args))
+	for _, arg := range am.args {
+		raw = append(raw, string(arg))
+	}
+	return raw
+}
+
+// Args returns the bulk strings.
+func (am *ArrayMessage) Args() [][]byte {
+	return am.args
 }
 
-// At finds an string in raw array by idx
+// Token returns the bulk string at idx as a Go string.
 func (am *ArrayMessage) Token(idx int) string {
-	return am.raw[idx]
+	return string(am.args[idx])
+}
+
+// Arg returns the bulk string at idx.
+func (am *ArrayMessage) Arg(idx int) []byte {
+	return am.args[idx]
 }
 
 func (am *ArrayMessage) SliceFrom(idx int) []string {
-	return am.raw[idx:]
+	return am.Raw()[idx:]
 }
 
 func (am *ArrayMessage) Len() int {
-	return len(am.raw)
+	return len(am.args)
 }
 
-func (am *ArrayMessage) Redis() string {
+func (am *ArrayMessage) Redis() []byte {
 	return am.msg
 }
 
@@ -82,14 +116,47 @@ func (am *ArrayMessage) Propagatible() bool {
 	return am.propagatible
 }
 
+// NestedArrayMessage is an array of arbitrary messages, unlike ArrayMessage which is an array of bulk strings.
+type NestedArrayMessage struct {
+	msg   []byte
+	items []Message
+}
+
+func NewNestedArray(items []Message) *NestedArrayMessage {
+	var buf bytes.Buffer
+	buf.WriteByte('*')
+	buf.WriteString(strconv.Itoa(len(items)))
+	buf.WriteString("\r\n")
+	for _, item := range items {
+		buf.Write(item.Redis())
+	}
+
+	return &NestedArrayMessage{
+		msg:   buf.Bytes(),
+		items: items,
+	}
+}
+
+func (nm *NestedArrayMessage) Items() []Message {
+	return nm.items
+}
+
+func (nm *NestedArrayMessage) Redis() []byte {
+	return nm.msg
+}
+
+func (nm *NestedArrayMessage) Propagatible() bool {
+	return false
+}
+
 type IntMessage struct {
-	msg string
+	msg []byte
 	raw int
 }
 
 func NewInt(val int) *IntMessage {
 	return &IntMessage{
-		msg: fmt.Sprintf(":%d\r\n", val),
+		msg: []byte(":" + strconv.Itoa(val) + "\r\n"),
 		raw: val,
 	}
 }
@@ -98,7 +165,7 @@ func (im *IntMessage) Raw() int {
 	return im.raw
 }
 
-func (im *IntMessage) Redis() string {
+func (im *IntMessage) Redis() []byte {
 	return im.msg
 }
 
@@ -106,14 +173,15 @@ func (im *IntMessage) Propagatible() bool {
 	return false
 }
 
+// SimpleMessage is a RESP simple string, which cannot contain CR or LF.
 type SimpleMessage struct {
-	msg string
+	msg []byte
 	raw string
 }
 
 func NewSimple(str string) *SimpleMessage {
 	return &SimpleMessage{
-		msg: fmt.Sprintf("+%s\r\n", str),
+		msg: []byte("+" + str + "\r\n"),
 		raw: str,
 	}
 }
@@ -122,7 +190,7 @@ func (sm *SimpleMessage) Raw() string {
 	return sm.raw
 }
 
-func (sm *SimpleMessage) Redis() string {
+func (sm *SimpleMessage) Redis() []byte {
 	return sm.msg
 }
 
@@ -130,23 +198,96 @@ func (sm *SimpleMessage) Propagatible() bool {
 	return false
 }
 
-type BulkMessage struct {
-	msg string
+// ErrorMessage is a RESP error. The message starts with the error code, such as "READONLY You can't ...".
+type ErrorMessage struct {
+	msg []byte
 	raw string
 }
 
+func NewError(str string) *ErrorMessage {
+	return &ErrorMessage{
+		msg: []byte("-" + str + "\r\n"),
+		raw: str,
+	}
+}
+
+// NewArityError returns the error about a wrong number of arguments. The command is in lower case, like "get",
+// or "cluster|meet" for a subcommand.
+func NewArityError(cmd string) *ErrorMessage {
+	return NewError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+}
+
+// NewUnknownSubcommandError returns the error about an unknown subcommand of the container, like "config".
+func NewUnknownSubcommandError(container, sub string) *ErrorMessage {
+	str := fmt.Sprintf("ERR unknown subcommand '%.128s'. Try %s HELP.", sub, strings.ToUpper(container))
+	return NewError(strings.NewReplacer("\r", " ", "\n", " ").Replace(str))
+}
+
+// NewUnknownCommandError returns the error about an unknown command, showing the first arguments like Redis.
+func NewUnknownCommandError(args []string) *ErrorMessage {
+	var shown strings.Builder
+	for _, arg := range args[1:] {
+		if shown.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&shown, "'%.*s' ", 128-shown.Len(), arg)
+	}
+
+	str := fmt.Sprintf("ERR unknown command '%.128s', with args beginning with: %s", args[0], shown.String())
+
+	// an error is a single line.
+	return NewError(strings.NewReplacer("\r", " ", "\n", " ").Replace(str))
+}
+
+func (em *ErrorMessage) Raw() string {
+	return em.raw
+}
+
+// Code returns the first word of the error, such as ERR or WRONGTYPE.
+func (em *ErrorMessage) Code() string {
+	code, _, _ := strings.Cut(em.raw, " ")
+	return code
+}
+
+func (em *ErrorMessage) Redis() []byte {
+	return em.msg
+}
+
+func (em *ErrorMessage) Propagatible() bool {
+	return false
+}
+
+// BulkMessage is a RESP bulk string, which can hold any bytes.
+type BulkMessage struct {
+	msg []byte
+	raw []byte
+}
+
 func NewBulk(str string) *BulkMessage {
+	return NewBulkBytes([]byte(str))
+}
+
+func NewBulkBytes(b []byte) *BulkMessage {
+	var buf bytes.Buffer
+	writeBulk(&buf, b)
+
 	return &BulkMessage{
-		msg: fmt.Sprintf("$%d\r\n%s\r\n", len(str), str),
-		raw: str,
+		msg: buf.Bytes(),
+		raw: b,
 	}
 }
 
+// Raw returns the content as a Go string.
 func (bm *BulkMessage) Raw() string {
+	return string(bm.raw)
+}
+
+// Bytes returns the content.
+func (bm *BulkMessage) Bytes() []byte {
 	return bm.raw
 }
 
-func (bm *BulkMessage) Redis() string {
+func (bm *BulkMessage) Redis() []byte {
 	return bm.msg
 }
 
@@ -160,10 +301,34 @@ func NewNull() *NullMessage {
 	return &NullMessage{}
 }
 
-func (nm *NullMessage) Redis() string {
-	return "$-1\r\n"
+func (nm *NullMessage) Redis() []byte {
+	return []byte("$-1\r\n")
 }
 
 func (nm *NullMessage) Propagatible() bool {
 	return false
 }
+
+// NullArrayMessage is a null encoded as *-1 in RESP2. RESP3 has a single null.
+type NullArrayMessage struct{}
+
+func NewNullArray() *NullArrayMessage {
+	return &NullArrayMessage{}
+}
+
+func (nm *NullArrayMessage) Redis() []byte {
+	return []byte("*-1\r\n")
+}
+
+func (nm *NullArrayMessage) Propagatible() bool {
+	return false
+}
+
+// writeBulk writes b as a bulk string: $<length>\r\n<bytes>\r\n.
+func writeBulk(buf *bytes.Buffer, b []byte) {
+	buf.WriteByte('$')
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteString("\r\n")
+	buf.Write(b)
+	buf.WriteString("\r\n")
+}
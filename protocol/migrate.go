@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/storage"
+)
+
+var NOKEY = NewSimple("NOKEY")
+
+// defaultMigrateTimeout is used when MIGRATE is given a timeout of 0.
+const defaultMigrateTimeout = time.Second
+
+// migrateItem is a key to MIGRATE, with its value and expiration time.
+type migrateItem struct {
+	key      string
+	value    string
+	expireAt int64
+}
+
+// handleMigrate handles MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password]
+// [AUTH2 username password] [KEYS key ...]. The keys are sent to the target with RESTORE, and deleted here once
+// the target has accepted them, unless COPY is given.
+func (h *Handler) handleMigrate(args []string) error {
+	if len(args) < 5 {
+		return h.replyError(NewArityError("migrate"))
+	}
+
+	db, err := strconv.Atoi(args[3])
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+	if db != 0 {
+		return h.writeError("ERR Only DB 0 is supported as the destination DB")
+	}
+
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil {
+		return h.replyError(NOTINTEGER)
+	}
+
+	keys := make([]string, 0)
+	if args[2] != "" {
+		keys = append(keys, args[2])
+	}
+
+	var copyKeys, replace bool
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			copyKeys = true
+
+		case "REPLACE":
+			replace = true
+
+		case "AUTH":
+			if i+1 >= len(args) {
+				return h.replyError(SYNTAXERR)
+			}
+			auth = []string{"AUTH", args[i+1]}
+			i++
+
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return h.replyError(SYNTAXERR)
+			}
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+
+		case "KEYS":
+			if args[2] != "" {
+				return h.writeError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = append(keys, args[i+1:]...)
+			i = len(args)
+
+		default:
+			return h.replyError(SYNTAXERR)
+		}
+	}
+
+	items := make([]migrateItem, 0, len(keys))
+	for _, key := range keys {
+		if value, expireAt := h.cache.GetWithExpireAt(key); value != nil {
+			items = append(items, migrateItem{key: key, value: *value, expireAt: expireAt})
+		}
+	}
+
+	if len(items) == 0 {
+		if err := h.conn.Write(NOKEY); err != nil {
+			return fmt.Errorf("write response failed: %w", err)
+		}
+		return nil
+	}
+
+	deadline := defaultMigrateTimeout
+	if timeout > 0 {
+		deadline = time.Duration(timeout) * time.Millisecond
+	}
+
+	moved, reply := h.migrate(net.JoinHostPort(args[0], args[1]), deadline, auth, items, replace)
+
+	if !copyKeys && len(moved) > 0 {
+		h.cache.Delete(moved...)
+		// in a transaction, the DEL is propagated with the other writes of the transaction.
+		h.propagateEffects([]Message{NewArray(append([]string{"DEL"}, moved...))})
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// migrate sends the items to the target, and returns the keys the target accepted, and the reply to MIGRATE.
+func (h *Handler) migrate(addr string, timeout time.Duration, auth []string, items []migrateItem, replace bool) ([]string, Message) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, NewError("IOERR error or timeout connecting to the client")
+	}
+
+	target := NewConnection(c)
+	defer target.Close()
+
+	if err := target.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, NewError("IOERR error or timeout writing to target instance")
+	}
+
+	if auth != nil {
+		if err := target.Write(NewArray(auth)); err != nil {
+			return nil, NewError("IOERR error or timeout writing to target instance")
+		}
+
+		reply, err := ReadMessage(target)
+		if err != nil {
+			return nil, NewError("IOERR error or timeout reading to target instance")
+		}
+		if e, ok := reply.(*ErrorMessage); ok {
+			return nil, NewError("ERR Target instance replied with error: " + e.Raw())
+		}
+	}
+
+	// the node importing the slot only accepts the keys with ASKING.
+	cmd := "RESTORE"
+	if h.state.Cluster() != nil {
+		cmd = "RESTORE-ASKING"
+	}
+
+	now := time.Now().UnixMilli()
+	for _, item := range items {
+		payload, err := storage.DumpValue(item.value)
+		if err != nil {
+			return nil, NewError("ERR " + err.Error())
+		}
+
+		var ttl int64
+		if item.expireAt != 0 {
+			ttl = max(item.expireAt-now, 1)
+		}
+
+		restore := []string{cmd, item.key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+
+		if err := target.Write(NewArray(restore)); err != nil {
+			return nil, NewError("IOERR error or timeout writing to target instance")
+		}
+	}
+
+	moved := make([]string, 0, len(items))
+	var failure Message
+	for _, item := range items {
+		reply, err := ReadMessage(target)
+		if err != nil {
+			return moved, NewError("IOERR error or timeout reading to target instance")
+		}
+
+		if e, ok := reply.(*ErrorMessage); ok {
+			if failure == nil {
+				failure = NewError("ERR Target instance replied with error: " + e.Raw())
+			}
+			continue
+		}
+		moved = append(moved, item.key)
+	}
+
+	if failure != nil {
+		return moved, failure
+	}
+
+	return moved, OK
+}
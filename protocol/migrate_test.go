@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	_, sourcePort := startTestServer(t, &config.Opts{})
+	_, targetPort := startTestServer(t, &config.Opts{})
+	source, target := dialTestServer(t, sourcePort), dialTestServer(t, targetPort)
+	migrate := []string{"MIGRATE", "127.0.0.1", fmt.Sprint(targetPort), "", "0", "1000"}
+
+	tests := []struct {
+		client *Connection
+		args   []string
+		want   string
+	}{
+		{client: source, args: []string{"SET", "foo", "line1\r\nline2"}, want: "+OK\r\n"},
+		{client: source, args: []string{"SET", "bar", "2", "PX", "100000"}, want: "+OK\r\n"},
+		{client: target, args: []string{"SET", "bar", "old"}, want: "+OK\r\n"},
+
+		// bar exists in the target, so only foo is moved.
+		{client: source, args: append(migrate, "KEYS", "foo", "bar"), want: "-ERR Target instance replied with error: BUSYKEY Target key name already exists.\r\n"},
+		{client: source, args: []string{"GET", "foo"}, want: "$-1\r\n"},
+		{client: target, args: []string{"GET", "foo"}, want: "$12\r\nline1\r\nline2\r\n"},
+
+		{client: source, args: append(migrate, "COPY", "REPLACE", "KEYS", "bar"), want: "+OK\r\n"},
+		{client: source, args: []string{"GET", "bar"}, want: "$1\r\n2\r\n"},
+		{client: target, args: []string{"GET", "bar"}, want: "$1\r\n2\r\n"},
+
+		{client: source, args: append(migrate, "KEYS", "nokey"), want: "+NOKEY\r\n"},
+		{client: source, args: []string{"MIGRATE", "127.0.0.1", fmt.Sprint(targetPort), "foo", "1", "1000"}, want: "-ERR Only DB 0 is supported as the destination DB\r\n"},
+		{client: target, args: []string{"RESTORE", "baz", "0", "garbage"}, want: "-ERR DUMP payload version or checksum are wrong\r\n"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, request(t, tt.client, tt.args...), tt.args)
+	}
+}
+
+// startSlowTarget starts a MIGRATE target which replies slowly, so that requests can be sent while MIGRATE is in
+// progress. The channel is closed when the target has received the keys.
+func startSlowTarget(t *testing.T) (int, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	restored := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		conn := NewConnection(c)
+		if _, err := ReadMessage(conn); err != nil {
+			return
+		}
+		close(restored)
+		time.Sleep(300 * time.Millisecond)
+		_ = conn.Write(OK)
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port, restored
+}
+
+func TestMigrate_ConcurrentWrite(t *testing.T) {
+	_, sourcePort := startTestServer(t, &config.Opts{})
+	source, writer := dialTestServer(t, sourcePort), dialTestServer(t, sourcePort)
+	targetPort, restored := startSlowTarget(t)
+
+	require.Equal(t, "+OK\r\n", request(t, source, "SET", "foo", "old"))
+
+	migrate := []string{"MIGRATE", "127.0.0.1", fmt.Sprint(targetPort), "foo", "0", "1000"}
+	require.NoError(t, source.Write(NewArray(migrate)))
+	<-restored
+
+	// the write waits for MIGRATE to delete the moved key, instead of being deleted with it.
+	assert.Equal(t, "+OK\r\n", request(t, writer, "SET", "foo", "new"))
+	reply, err := ReadMessage(source)
+	require.NoError(t, err)
+	assert.Equal(t, "+OK\r\n", string(reply.Redis()))
+	assert.Equal(t, "$3\r\nnew\r\n", request(t, writer, "GET", "foo"))
+}
+
+func TestMigrate_Transaction(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+	_, targetPort := startTestServer(t, &config.Opts{})
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+	require.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "bar"))
+	require.Equal(t, "+QUEUED\r\n", request(t, client, "MIGRATE", "127.0.0.1", fmt.Sprint(targetPort), "foo", "0", "1000"))
+	require.Equal(t, "*2\r\n+OK\r\n+OK\r\n", execRequest(t, client, 2))
+
+	// the DEL of the moved key is propagated after the SET, as in the transaction.
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+	value, _ := replica.cache.Get("foo")
+	assert.Nil(t, value)
+	assert.Equal(t, "$-1\r\n", request(t, client, "GET", "foo"))
+}
@@ -0,0 +1,272 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLength is the longest bulk string accepted, like proto-max-bulk-len of Redis.
+	maxBulkLength = 512 * 1024 * 1024
+
+	// maxArrayLength is the longest array accepted.
+	maxArrayLength = 1024 * 1024 * 1024
+
+	// maxNesting is the deepest nesting of arrays accepted.
+	maxNesting = 64
+)
+
+// ErrProtocol matches the errors about malformed messages, as opposed to I/O errors.
+var ErrProtocol = errors.New("protocol error")
+
+// ProtocolError is a malformed message from the peer. Its message is replied to clients before closing the
+// connection, like "ERR Protocol error: invalid bulk length" of Redis.
+type ProtocolError struct {
+	msg string
+}
+
+func newProtocolError(format string, args ...any) error {
+	return &ProtocolError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// Is makes errors.Is(err, ErrProtocol) true.
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// ReadMessage reads one message of any type from the connection, such as a request, or the reply from another
+// server. Bulk strings are read by their length, so they can hold any bytes, including \r\n.
+// An array of bulk strings is returned as *ArrayMessage, and any other array as *NestedArrayMessage.
+// The RESP3 types are understood as well.
+func ReadMessage(c *Connection) (Message, error) {
+	return readMessage(c, 0)
+}
+
+func readMessage(c *Connection, depth int) (Message, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("c.readLine failed: %w", err)
+	}
+
+	if len(line) == 0 {
+		return nil, newProtocolError("empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return NewSimple(string(line[1:])), nil
+
+	case '-':
+		return NewError(string(line[1:])), nil
+
+	case ':':
+		val, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, newProtocolError("invalid integer")
+		}
+		return NewInt(val), nil
+
+	case '$':
+		b, err := readBulk(c, line)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			return NULL, nil
+		}
+		return NewBulkBytes(b), nil
+
+	case '*':
+		num, err := parseLength(line, maxArrayLength)
+		if err != nil {
+			return nil, newProtocolError("invalid multibulk length")
+		}
+		if num < 0 {
+			return NULL, nil
+		}
+		if depth >= maxNesting {
+			return nil, newProtocolError("too deeply nested arrays")
+		}
+
+		// the length is from the peer, so the memory is allocated as the items arrive.
+		items := make([]Message, 0, min(num, 1024))
+		bulks := make([][]byte, 0, min(num, 1024))
+		for i := 0; i < num; i++ {
+			item, err := readMessage(c, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+			if bulk, ok := item.(*BulkMessage); ok {
+				bulks = append(bulks, bulk.Bytes())
+			}
+		}
+
+		if len(bulks) == num {
+			return NewArrayBytes(bulks), nil
+		}
+		return NewNestedArray(items), nil
+
+	// RESP3 types, as replied to the clients after HELLO 3.
+	case '_':
+		if len(line) != 1 {
+			return nil, newProtocolError("invalid null")
+		}
+		return NULL, nil
+
+	case '#':
+		switch string(line[1:]) {
+		case "t":
+			return NewBoolean(true), nil
+		case "f":
+			return NewBoolean(false), nil
+		}
+		return nil, newProtocolError("invalid boolean")
+
+	case ',':
+		val, err := parseDouble(string(line[1:]))
+		if err != nil {
+			return nil, newProtocolError("invalid double")
+		}
+		return NewDouble(val), nil
+
+	case '(':
+		if _, ok := new(big.Int).SetString(string(line[1:]), 10); !ok {
+			return nil, newProtocolError("invalid big number")
+		}
+		return NewBigNumber(string(line[1:])), nil
+
+	case '!':
+		b, err := readBulk(c, line)
+		if err != nil {
+			return nil, err
+		}
+		// like Redis, newlines are replaced, as errors are single lines in RESP2.
+		return NewError(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(b))), nil
+
+	case '=':
+		b, err := readBulk(c, line)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 4 || b[3] != ':' {
+			return nil, newProtocolError("invalid verbatim string")
+		}
+		return NewVerbatim(string(b[:3]), b[4:]), nil
+
+	case '~', '>':
+		items, err := readItems(c, line, 1, depth)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '~' {
+			return NewSet(items), nil
+		}
+		return NewPush(items), nil
+
+	case '%', '|':
+		items, err := readItems(c, line, 2, depth)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '%' {
+			return NewMap(items), nil
+		}
+
+		// attributes come before the reply they are about.
+		msg, err := readMessage(c, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return NewAttribute(items, msg), nil
+	}
+
+	return nil, newProtocolError("unexpected type byte %q", line[0])
+}
+
+// readBulk reads the content of a bulk string, or a bulk string like RESP3 type, after its header line. The
+// returned content is nil for a null bulk string.
+func readBulk(c *Connection, line []byte) ([]byte, error) {
+	l, err := parseLength(line, maxBulkLength)
+	if err != nil {
+		return nil, newProtocolError("invalid bulk length")
+	}
+	if l < 0 {
+		return nil, nil
+	}
+
+	b, err := c.readFull(l + 2)
+	if err != nil {
+		return nil, fmt.Errorf("c.readFull failed: %w", err)
+	}
+	if b[l] != '\r' || b[l+1] != '\n' {
+		return nil, newProtocolError("bulk string not terminated by CRLF")
+	}
+
+	return b[:l], nil
+}
+
+// readItems reads the items of a RESP3 aggregate type after its header line. Maps and attributes have 2 items
+// per entry: the key and the value.
+func readItems(c *Connection, line []byte, perEntry int, depth int) ([]Message, error) {
+	num, err := parseLength(line, maxArrayLength/perEntry)
+	if err != nil || num < 0 {
+		return nil, newProtocolError("invalid aggregate length")
+	}
+	if depth >= maxNesting {
+		return nil, newProtocolError("too deeply nested arrays")
+	}
+
+	items := make([]Message, 0, min(num*perEntry, 1024))
+	for i := 0; i < num*perEntry; i++ {
+		item, err := readMessage(c, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// parseDouble parses a RESP3 double, which can also be inf, -inf or nan.
+func parseDouble(str string) (float64, error) {
+	switch str {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+
+	// strconv accepts forms like "Inf" and "0x1p-2", which RESP3 doesn't.
+	if strings.ContainsAny(str, "xXnN_") {
+		return 0, fmt.Errorf("invalid double: %s", str)
+	}
+
+	return strconv.ParseFloat(str, 64)
+}
+
+// parseLength parses the length after the type byte, such as $5 or *-1. Lengths below -1 or above max are rejected.
+func parseLength(line []byte, max int) (int, error) {
+	l, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return 0, fmt.Errorf("strconv.Atoi failed: %w", err)
+	}
+
+	if l < -1 || l > max {
+		return 0, fmt.Errorf("out of range: %d", l)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConnection returns a connection which reads the given data.
+func newTestConnection(data []byte) *Connection {
+	return &Connection{reader: bufio.NewReader(bytes.NewReader(data))}
+}
+
+func TestReadMessage(t *testing.T) {
+	binary := "line1\r\nline2\x00\xff"
+	long := strings.Repeat("x", 100000)
+
+	tests := []struct {
+		name string
+		data string
+		want Message
+	}{
+		{name: "simple", data: "+OK\r\n", want: OK},
+		{name: "error", data: "-ERR oops\r\n", want: NewError("ERR oops")},
+		{name: "integer", data: ":-42\r\n", want: NewInt(-42)},
+		{name: "bulk", data: "$3\r\nfoo\r\n", want: NewBulk("foo")},
+		{name: "empty bulk", data: "$0\r\n\r\n", want: NewBulk("")},
+		{name: "binary bulk", data: "$14\r\n" + binary + "\r\n", want: NewBulk(binary)},
+		{name: "long bulk", data: "$100000\r\n" + long + "\r\n", want: NewBulk(long)},
+		{name: "null bulk", data: "$-1\r\n", want: NULL},
+		{name: "null array", data: "*-1\r\n", want: NULL},
+		{name: "request", data: "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$14\r\n" + binary + "\r\n", want: NewArray([]string{"SET", "foo", binary})},
+		{name: "empty array", data: "*0\r\n", want: NewArray([]string{})},
+		{name: "nested", data: "*2\r\n:1\r\n*1\r\n$1\r\na\r\n", want: NewNestedArray([]Message{NewInt(1), NewArray([]string{"a"})})},
+		{name: "null", data: "_\r\n", want: NULL},
+		{name: "boolean", data: "#t\r\n", want: NewBoolean(true)},
+		{name: "double", data: ",-1.5e3\r\n", want: NewDouble(-1500)},
+		{name: "infinite double", data: ",-inf\r\n", want: NewDouble(math.Inf(-1))},
+		{name: "big number", data: "(3492890328409238509324850943850943825024385\r\n", want: NewBigNumber("3492890328409238509324850943850943825024385")},
+		{name: "blob error", data: "!10\r\nERR a\r\nb c\r\n", want: NewError("ERR a  b c")},
+		{name: "verbatim string", data: "=8\r\ntxt:a\r\nb\r\n", want: NewVerbatim("txt", []byte("a\r\nb"))},
+		{name: "map", data: "%1\r\n+key\r\n:1\r\n", want: NewMap([]Message{NewSimple("key"), NewInt(1)})},
+		{name: "set", data: "~2\r\n:1\r\n:2\r\n", want: NewSet([]Message{NewInt(1), NewInt(2)})},
+		{name: "push", data: ">2\r\n+message\r\n$1\r\na\r\n", want: NewPush([]Message{NewSimple("message"), NewBulk("a")})},
+		{name: "attribute", data: "|1\r\n+ttl\r\n:3\r\n$1\r\na\r\n", want: NewAttribute([]Message{NewSimple("ttl"), NewInt(3)}, NewBulk("a"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newTestConnection([]byte(tt.data))
+
+			msg, err := ReadMessage(conn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, msg)
+			assert.Equal(t, uint64(len(tt.data)), conn.Offset())
+		})
+	}
+}
+
+func TestReadMessage_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unknown type", data: "?3\r\n"},
+		{name: "invalid boolean", data: "#x\r\n"},
+		{name: "invalid double", data: ",0x1p-2\r\n"},
+		{name: "invalid big number", data: "(12a\r\n"},
+		{name: "invalid verbatim string", data: "=3\r\ntxt\r\n"},
+		{name: "negative map length", data: "%-1\r\n"},
+		{name: "empty line", data: "\r\n"},
+		{name: "LF only", data: "*1\n$4\nPING\n"},
+		{name: "invalid integer", data: ":abc\r\n"},
+		{name: "invalid bulk length", data: "$abc\r\n"},
+		{name: "negative bulk length", data: "$-2\r\n"},
+		{name: "bulk too long", data: "$536870913\r\n"},
+		{name: "bulk longer than its length", data: "$3\r\nfoobar\r\n"},
+		{name: "invalid multibulk length", data: "*x\r\n"},
+		{name: "too deeply nested", data: strings.Repeat("*1\r\n", maxNesting+1) + ":1\r\n"},
+		{name: "too long line", data: "+" + strings.Repeat("x", maxLineLength+1) + "\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadMessage(newTestConnection([]byte(tt.data)))
+			assert.True(t, errors.Is(err, ErrProtocol), "%v", err)
+		})
+	}
+
+	// a message cut in the middle is an I/O error.
+	_, err := ReadMessage(newTestConnection([]byte("$10\r\nfoo")))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrProtocol))
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, seed := range []string{
+		"+OK\r\n",
+		"-ERR oops\r\n",
+		":42\r\n",
+		"$5\r\nhello\r\n",
+		"$7\r\nfoo\r\nba\r\n",
+		"$-1\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n",
+		"*2\r\n:1\r\n*-1\r\n",
+		"*0\r\n",
+		"%1\r\n+k\r\n,1.5\r\n",
+		"|1\r\n+k\r\n#t\r\n>1\r\n(12\r\n",
+		"~1\r\n=7\r\ntxt:abc\r\n",
+		"!3\r\nERR\r\n",
+		"_\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := newTestConnection(data)
+
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if conn.Offset() > uint64(len(data)) {
+			t.Fatalf("consumed %d bytes of %d", conn.Offset(), len(data))
+		}
+
+		// the encoding of a parsed message parses back to the same message, in both protocol versions.
+		for _, proto := range []int{2, 3} {
+			encoded := Encode(msg, proto)
+			reparsed, err := ReadMessage(newTestConnection(encoded))
+			if err != nil {
+				t.Fatalf("couldn't parse the RESP%d encoding %q of %q: %v", proto, encoded, data, err)
+			}
+			if !bytes.Equal(encoded, Encode(reparsed, proto)) {
+				t.Fatalf("RESP%d encoding changed: %q != %q", proto, encoded, Encode(reparsed, proto))
+			}
+		}
+	})
+}
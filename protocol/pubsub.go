@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// PubSub keeps the subscribers of each channel of this server. Messages are delivered to the subscribers of
+// this server only: PUBLISH is not propagated to the slaves.
+type PubSub struct {
+	lock     sync.Mutex
+	channels map[string]map[*Connection]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Connection]struct{}),
+	}
+}
+
+// Subscribe registers the connection to the channel.
+func (ps *PubSub) Subscribe(conn *Connection, channel string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	subscribers, ok := ps.channels[channel]
+	if !ok {
+		subscribers = make(map[*Connection]struct{})
+		ps.channels[channel] = subscribers
+	}
+	subscribers[conn] = struct{}{}
+}
+
+// Unsubscribe unregisters the connection from the channel.
+func (ps *PubSub) Unsubscribe(conn *Connection, channel string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if subscribers, ok := ps.channels[channel]; ok {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(ps.channels, channel)
+		}
+	}
+}
+
+// Publish sends the message to the subscribers of the channel, and returns the number of the subscribers
+// that received it.
+func (ps *PubSub) Publish(channel, message string) int {
+	ps.lock.Lock()
+	subscribers := make([]*Connection, 0, len(ps.channels[channel]))
+	for conn := range ps.channels[channel] {
+		subscribers = append(subscribers, conn)
+	}
+	ps.lock.Unlock()
+
+	// a push frame for the RESP3 subscribers, and a plain array for the others.
+	msg := NewPush([]Message{NewBulk("message"), NewBulk(channel), NewBulk(message)})
+
+	var received int
+	for _, conn := range subscribers {
+		if err := conn.Write(msg); err != nil {
+			fmt.Fprintf(os.Stderr, "conn.Write failed: %v\n", err)
+			continue
+		}
+		received++
+	}
+
+	return received
+}
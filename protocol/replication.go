@@ -0,0 +1,547 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/info"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+)
+
+const (
+	// noReplicationID is reported as master_replid2 when there's no previous replication history.
+	noReplicationID = "0000000000000000000000000000000000000000"
+
+	// linkRetryInterval is the wait time before reconnecting to the master after the link is lost.
+	linkRetryInterval = time.Second
+
+	// cronInterval is how often replicationCron runs.
+	cronInterval = time.Second
+)
+
+// Replication is the replication state shared by all handlers of this server.
+// Unlike config.Opts, it can be changed at runtime with REPLICAOF.
+type Replication struct {
+	lock sync.RWMutex
+
+	opts  *config.Opts
+	cache *storage.Cache
+
+	// mc serves our slaves on both roles. A slave forwards the stream from its master as is, so the
+	// propagation offset of a slave follows its replicationOffset.
+	mc *MasterConfig
+
+	role       string
+	masterIP   net.IP
+	masterPort int
+
+	replicationID     string
+	replicationID2    string // the replication ID we were following before the last promotion.
+	replicationOffset uint64 // only for slaves. for masters, the MasterConfig tracks the offset.
+	secondReplOffset  int64  // the offset up to which replicationID2 is valid.
+
+	link *masterLink // only for slaves.
+
+	aof *storage.AOF // nil if appendonly is disabled.
+
+	diskless *disklessSync // used for full resyncs with repl-diskless-sync.
+
+	// state is given to the handler of the link to the master, like to the handlers of our clients.
+	state *State
+
+	lastPing time.Time // only for masters: the time we last sent PING to our slaves.
+}
+
+// NewReplication returns the replication state induced by the user-given options.
+// aof is the append-only file to track the fsynced offset with, which can be nil.
+func NewReplication(opts *config.Opts, cache *storage.Cache, aof *storage.AOF) *Replication {
+	return &Replication{
+		opts:             opts,
+		cache:            cache,
+		aof:              aof,
+		diskless:         newDisklessSync(time.Duration(opts.ReplDisklessSyncDelay) * time.Second),
+		mc:               NewMasterConfig(opts.ReplicaBufferLimit, opts.ReplBacklogSize),
+		role:             opts.Role,
+		masterIP:         opts.MasterIP,
+		masterPort:       opts.MasterPort,
+		replicationID:    opts.ReplicationID,
+		replicationID2:   noReplicationID,
+		secondReplOffset: -1,
+	}
+}
+
+// Start starts the link to the master if this server is a slave, and the periodic replication jobs. The state
+// is the one of the handlers of our clients.
+func (r *Replication) Start(state *State) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.state = state
+
+	if r.role == "slave" {
+		r.startLink()
+	}
+
+	go func() {
+		for range time.Tick(cronInterval) {
+			r.replicationCron()
+		}
+	}()
+}
+
+// replicationCron runs the periodic replication jobs: slaves ACK their offset to the master, masters PING
+// their slaves, and both sides drop the peer that stayed silent for longer than repl-timeout.
+func (r *Replication) replicationCron() {
+	r.lock.Lock()
+	role, link, offset := r.role, r.link, r.replicationOffset
+	// the cron can tick a little early, which shouldn't delay the PING by a whole tick.
+	ping := false
+	if role == "master" && r.opts.ReplPingReplicaPeriod > 0 &&
+		time.Since(r.lastPing) >= time.Duration(r.opts.ReplPingReplicaPeriod)*time.Second-cronInterval/2 {
+		ping = true
+		r.lastPing = time.Now()
+	}
+	r.lock.Unlock()
+
+	timeout := time.Duration(r.opts.ReplTimeout) * time.Second
+
+	// slaves serve sub-slaves as well, which ACK to us like to any master.
+	if timeout > 0 {
+		r.mc.DropTimedOutSlaves(timeout)
+	}
+
+	if role == "master" {
+		// PING goes through the replication stream, so slaves can tell an idle master from a dead one.
+		if ping && r.mc.SlaveNum() > 0 {
+			r.mc.Propagate(PING)
+		}
+		return
+	}
+
+	if link == nil {
+		return
+	}
+
+	if timeout > 0 && link.Up() && time.Since(link.LastInteraction()) > timeout {
+		fmt.Fprintln(os.Stderr, "[slave] MASTER timeout: no data nor PING received")
+		link.Disconnect()
+		return
+	}
+
+	if conn := link.Conn(); conn != nil {
+		if err := conn.Write(r.AckMessage(offset)); err != nil {
+			fmt.Fprintf(os.Stderr, "[slave] conn.Write failed: %v\n", err)
+		}
+	}
+}
+
+// MasterConfig returns the config shared by all master handlers.
+func (r *Replication) MasterConfig() *MasterConfig {
+	return r.mc
+}
+
+// ScheduleDisklessSync queues the slave for the next diskless RDB transfer. The returned channel receives
+// the result of the transfer.
+func (r *Replication) ScheduleDisklessSync(conn *Connection, listeningPort int) <-chan error {
+	return r.diskless.Schedule(r, conn, listeningPort)
+}
+
+// AOF returns the append-only file, or nil if appendonly is disabled.
+func (r *Replication) AOF() *storage.AOF {
+	return r.aof
+}
+
+// AckMessage returns REPLCONF ACK for the given offset. If appendonly is enabled, the fsynced offset is
+// reported as well with FACK.
+func (r *Replication) AckMessage(offset uint64) Message {
+	ack := []string{"REPLCONF", "ACK", strconv.FormatUint(offset, 10)}
+	if r.aof != nil {
+		ack = append(ack, "FACK", strconv.FormatUint(r.aof.FsyncedOffset(), 10))
+	}
+
+	return NewArray(ack)
+}
+
+func (r *Replication) Role() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.role
+}
+
+func (r *Replication) ID() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.replicationID
+}
+
+// SetMaster records the replication ID and the offset that the master gave us with FULLRESYNC,
+// and marks the link to the master as up. Our sub-slaves are disconnected, as the data set they've synced with
+// is replaced: they resync from scratch with the new replication ID and offset.
+func (r *Replication) SetMaster(id string, offset uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.mc.RemoveAllSlaves()
+	r.mc.ResetPropagation(offset)
+
+	r.replicationID = id
+	r.replicationOffset = offset
+	if r.link != nil {
+		r.link.SetUp()
+	}
+}
+
+// SetOffset records the replication offset processed by this slave. As we've just heard from the master,
+// the master is considered alive.
+func (r *Replication) SetOffset(offset uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.replicationOffset = offset
+	if r.link != nil {
+		r.link.Touch()
+	}
+}
+
+// MasterLinkUp returns true if this server is a slave, and the link to its master is up.
+func (r *Replication) MasterLinkUp() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.role == "slave" && r.link != nil && r.link.Up()
+}
+
+// ReplicaOf makes this server a slave of the given master. The link to the previous master (if any) is torn down.
+// The returned boolean is false if we are already replicating from the given master.
+func (r *Replication) ReplicaOf(ip net.IP, port int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.role == "slave" && r.masterIP.Equal(ip) && r.masterPort == port {
+		return false
+	}
+
+	if r.link != nil {
+		r.link.Stop()
+		r.link = nil
+	}
+
+	// a master keeps its replication history, so that it can continue with PSYNC from the offset it has, as
+	// when the old master rejoins after a failover.
+	if r.role == "master" {
+		r.replicationOffset = r.mc.PropagationOffset()
+	}
+
+	r.role = "slave"
+	r.masterIP = ip
+	r.masterPort = port
+	r.startLink()
+
+	return true
+}
+
+// Promote turns this server into a master (REPLICAOF NO ONE). The replication ID we were following is kept
+// as the secondary ID, so that the slaves which followed it as well can continue with PSYNC from the backlog.
+func (r *Replication) Promote() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.role == "master" {
+		return nil
+	}
+
+	rid, err := config.NewReplicationID()
+	if err != nil {
+		return fmt.Errorf("config.NewReplicationID failed: %w", err)
+	}
+
+	if r.link != nil {
+		r.link.Stop()
+		r.link = nil
+	}
+
+	if r.replicationID != "" {
+		r.replicationID2 = r.replicationID
+		r.secondReplOffset = int64(r.replicationOffset) + 1
+	}
+	r.replicationID = rid
+	r.role = "master"
+	r.masterIP = nil
+	r.masterPort = 0
+
+	// the new replication history goes on from the offset we already have, which is the propagation offset of
+	// the stream forwarded to our sub-slaves (if any) as well.
+	return nil
+}
+
+// ContinueSlave registers the slave asking to continue with PSYNC from the replication ID and the offset it has.
+// The ID should be ours, or the one we followed before the last promotion up to where we left it. It returns our
+// replication ID, or "" if the slave should resync from scratch.
+func (r *Replication) ContinueSlave(conn *Connection, listeningPort int, id string, offset uint64) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if id == "" || (id != r.replicationID && (id != r.replicationID2 || int64(offset) >= r.secondReplOffset)) {
+		return ""
+	}
+
+	if !r.mc.ContinueSlave(conn, listeningPort, offset) {
+		return ""
+	}
+
+	return r.replicationID
+}
+
+// PsyncMessage returns PSYNC to send to the master: with the replication ID we have and the offset of the next
+// byte we need, or PSYNC ? -1 if we have no replication history to continue from.
+func (r *Replication) PsyncMessage() Message {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.replicationID == "" {
+		return NewArray([]string{"PSYNC", "?", "-1"})
+	}
+
+	return NewArray([]string{"PSYNC", r.replicationID, strconv.FormatUint(r.replicationOffset+1, 10)})
+}
+
+// Continue marks the link to the master as up after the master agreed to continue from our offset, and returns
+// the offset. If the master has another replication ID, as after a failover, the one we followed is kept as the
+// secondary ID, and our sub-slaves are disconnected to continue with the new one.
+func (r *Replication) Continue(id string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if id != "" && id != r.replicationID {
+		r.mc.RemoveAllSlaves()
+
+		r.replicationID2 = r.replicationID
+		r.secondReplOffset = int64(r.replicationOffset) + 1
+		r.replicationID = id
+	}
+
+	if r.link != nil {
+		r.link.SetUp()
+	}
+	return r.replicationOffset
+}
+
+// Info returns the replication section of INFO.
+func (r *Replication) Info() info.Replication {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	res := info.Replication{
+		Role:             r.role,
+		MasterReplID:     r.replicationID,
+		MasterReplID2:    r.replicationID2,
+		MasterReplOffset: int(r.replicationOffset),
+		SecondReplOffset: int(r.secondReplOffset),
+		Slaves:           r.mc.SlavesInfo(),
+	}
+
+	if r.role == "master" {
+		res.MasterReplOffset = int(r.mc.PropagationOffset())
+		if r.opts.MinReplicasToWrite > 0 {
+			res.MinSlavesEnabled = true
+			res.MinSlavesGoodSlaves = r.mc.GoodSlaveNum(time.Duration(r.opts.MinReplicasMaxLag) * time.Second)
+		}
+	} else {
+		res.MasterHost = r.masterIP.String()
+		res.MasterPort = r.masterPort
+		res.MasterLinkStatus = "down"
+		res.MasterLastIOSecondsAgo = -1
+		if r.link != nil && r.link.Up() {
+			res.MasterLinkStatus = "up"
+			res.MasterLastIOSecondsAgo = int(time.Since(r.link.LastInteraction()).Seconds())
+		}
+	}
+
+	return res
+}
+
+// startLink should be called with the lock held.
+func (r *Replication) startLink() {
+	link := newMasterLink()
+	r.link = link
+
+	go r.runLink(link, fmt.Sprintf("%s:%d", r.masterIP, r.masterPort))
+}
+
+// runLink keeps connecting to the master until the link is stopped.
+func (r *Replication) runLink(link *masterLink, addr string) {
+	for !link.Stopped() {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[slave] net.Dial failed: %v\n", err)
+			link.Sleep(linkRetryInterval)
+			continue
+		}
+
+		conn := NewConnection(c)
+		if !link.Attach(conn) {
+			conn.Close()
+			return
+		}
+
+		client := NewClient(conn, r.opts, r.cache, r, r.state)
+		if err = client.Handle(); err != nil && !link.Stopped() {
+			fmt.Fprintf(os.Stderr, "[slave] handler.Handle failed: %v\n", err)
+		}
+
+		link.Detach()
+		link.Sleep(linkRetryInterval)
+	}
+}
+
+// masterLink is the connection from a slave to its master.
+type masterLink struct {
+	lock            sync.Mutex
+	conn            *Connection
+	up              bool
+	lastInteraction time.Time // the time we last received something from the master.
+	stopped         chan struct{}
+}
+
+func newMasterLink() *masterLink {
+	return &masterLink{
+		stopped: make(chan struct{}),
+	}
+}
+
+// Attach registers the connection to the master. It returns false if the link is already stopped.
+func (l *masterLink) Attach(conn *Connection) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.Stopped() {
+		return false
+	}
+
+	l.conn = conn
+	return true
+}
+
+func (l *masterLink) Detach() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.conn = nil
+	l.up = false
+}
+
+// SetUp marks the link as up, which means the handshake with the master is done.
+func (l *masterLink) SetUp() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.up = true
+	l.lastInteraction = time.Now()
+}
+
+// Touch records that we've just received something from the master.
+func (l *masterLink) Touch() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lastInteraction = time.Now()
+}
+
+func (l *masterLink) LastInteraction() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.lastInteraction
+}
+
+// Disconnect closes the current connection to the master. Unlike Stop, the link reconnects afterwards.
+func (l *masterLink) Disconnect() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// Conn returns the connection to the master, if the link is up.
+func (l *masterLink) Conn() *Connection {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.up {
+		return nil
+	}
+	return l.conn
+}
+
+func (l *masterLink) Up() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.up
+}
+
+// Stop closes the connection to the master, and prevents reconnection.
+func (l *masterLink) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	close(l.stopped)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+func (l *masterLink) Stopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sleep waits for the given duration, or until the link is stopped.
+func (l *masterLink) Sleep(d time.Duration) {
+	select {
+	case <-l.stopped:
+	case <-time.After(d):
+	}
+}
+
+// parseFullResync parses "FULLRESYNC <replid> <offset>" reply.
+func parseFullResync(reply string) (string, uint64, error) {
+	tokens := strings.Fields(reply)
+	if len(tokens) != 3 {
+		return "", 0, fmt.Errorf("wrong FULLRESYNC reply: %s", reply)
+	}
+
+	offset, err := strconv.ParseUint(tokens[2], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("wrong offset in FULLRESYNC reply: %w", err)
+	}
+
+	return tokens[1], offset, nil
+}
+
+// parseContinue parses "CONTINUE [replid]" reply. The replication ID is given only by masters knowing PSYNC2.
+func parseContinue(reply string) (string, bool) {
+	tokens := strings.Fields(reply)
+	if len(tokens) == 0 || !strings.EqualFold(tokens[0], "CONTINUE") {
+		return "", false
+	}
+
+	if len(tokens) < 2 {
+		return "", true
+	}
+	return tokens[1], true
+}
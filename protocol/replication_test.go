@@ -0,0 +1,546 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/cluster"
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer runs a server on a random local port, and returns its replication state and port.
+func startTestServer(t testing.TB, opts *config.Opts) (*Replication, int) {
+	repl, _, port := startTestNode(t, opts)
+	return repl, port
+}
+
+// startTestNode is startTestServer, which returns the rest of the state of the server as well.
+func startTestNode(t testing.TB, opts *config.Opts) (*Replication, *State, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	opts.Port = l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, opts.Evaluate())
+
+	var aof *storage.AOF
+	if opts.AOFEnabled {
+		dir := opts.Dir
+		if dir == "" {
+			dir = t.TempDir()
+		}
+
+		var err error
+		aof, err = storage.OpenAOF(filepath.Join(dir, "appendonly.aof"), opts.AppendFsync)
+		require.NoError(t, err)
+	}
+
+	cache := storage.NewCache()
+	repl := NewReplication(opts, cache, aof)
+	state := NewState()
+
+	// the data set is loaded at startup, like the server does.
+	require.NoError(t, LoadData(opts, cache, repl, state))
+
+	if opts.ClusterMode {
+		c, err := cluster.New(opts)
+		require.NoError(t, err)
+		require.NoError(t, c.Start())
+		t.Cleanup(c.Close)
+		state.SetCluster(c)
+	}
+
+	repl.Start(state)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go NewServer(NewConnection(c), opts, cache, repl, state).Handle()
+		}
+	}()
+
+	return repl, state, opts.Port
+}
+
+func dialTestServer(t testing.TB, port int) *Connection {
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return NewConnection(c)
+}
+
+func TestReplication_OffsetsUnderMixedTraffic(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	require.Eventually(t, func() bool {
+		return master.MasterConfig().SlaveNum() == 1 && replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	commands := []Message{
+		NewArray([]string{"SET", "foo", "bar"}),
+		NewArray([]string{"SET", "long", strings.Repeat("x", 10000)}), // longer than the bufio buffer.
+		NewArray([]string{"SET", "baz", "qux", "PX", "100000"}),
+	}
+	for _, cmd := range commands {
+		require.NoError(t, client.Write(cmd))
+		reply, err := client.Read()
+		require.NoError(t, err)
+		require.Equal(t, "+OK", reply)
+	}
+
+	// heartbeats and commands that the slave doesn't execute should be counted as well.
+	master.MasterConfig().Propagate(PING)
+	master.MasterConfig().Propagate(NewArray([]string{"SELECT", "0"}))
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// WAIT sends REPLCONF GETACK, which should be counted on both sides.
+	require.NoError(t, client.Write(NewArray([]string{"WAIT", "1", "1000"})))
+	reply, err := client.Read()
+	require.NoError(t, err)
+	assert.Equal(t, ":1", reply)
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication_WaitAOF(t *testing.T) {
+	aofOpts := func(replicaOf string) *config.Opts {
+		return &config.Opts{ReplicaOf: replicaOf, AppendOnly: "yes", AppendFsync: "everysec"}
+	}
+
+	_, port := startTestServer(t, aofOpts(""))
+	replica, _ := startTestServer(t, aofOpts(fmt.Sprintf("127.0.0.1 %d", port)))
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	require.NoError(t, client.Write(NewArray([]string{"SET", "foo", "bar"})))
+	reply, err := client.Read()
+	require.NoError(t, err)
+	require.Equal(t, "+OK", reply)
+
+	// everysec fsync: both sides catch up within a couple of seconds.
+	require.NoError(t, client.Write(NewArray([]string{"WAITAOF", "1", "1", "3000"})))
+	for _, want := range []string{"*2", ":1", ":1"} {
+		reply, err := client.Read()
+		require.NoError(t, err)
+		assert.Equal(t, want, reply)
+	}
+}
+
+func TestReplication_DisklessSync(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{ReplDisklessSync: "yes", ReplDisklessSyncDelay: 1})
+	require.NoError(t, master.cache.Set("before", "sync", 0))
+
+	replicaOf := fmt.Sprintf("127.0.0.1 %d", port)
+	replica1, _ := startTestServer(t, &config.Opts{ReplicaOf: replicaOf})
+	replica2, _ := startTestServer(t, &config.Opts{ReplicaOf: replicaOf})
+
+	require.Eventually(t, func() bool {
+		return replica1.Info().MasterLinkStatus == "up" && replica2.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// both replicas share one transfer, which streams the data set before they attached.
+	for _, replica := range []*Replication{replica1, replica2} {
+		value, err := replica.cache.Get("before")
+		require.NoError(t, err)
+		require.NotNil(t, value)
+		assert.Equal(t, "sync", *value)
+	}
+
+	client := dialTestServer(t, port)
+	require.NoError(t, client.Write(NewArray([]string{"SET", "after", "sync"})))
+	reply, err := client.Read()
+	require.NoError(t, err)
+	require.Equal(t, "+OK", reply)
+
+	require.Eventually(t, func() bool {
+		value, _ := replica2.cache.Get("after")
+		return value != nil && replica2.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication_Chained(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	replica, replicaPort := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	subReplica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", replicaPort)})
+
+	require.Eventually(t, func() bool {
+		return subReplica.Info().MasterLinkStatus == "up" && replica.MasterConfig().SlaveNum() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	require.NoError(t, client.Write(NewArray([]string{"SET", "foo", "bar"})))
+	reply, err := client.Read()
+	require.NoError(t, err)
+	require.Equal(t, "+OK", reply)
+
+	// the whole tree shares the replication ID and the offsets of the master.
+	require.Eventually(t, func() bool {
+		value, _ := subReplica.cache.Get("foo")
+		return value != nil && subReplica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, master.ID(), replica.ID())
+	assert.Equal(t, master.ID(), subReplica.ID())
+	assert.Equal(t, replica.Info().MasterReplOffset, master.Info().MasterReplOffset)
+}
+
+func TestReplication_ReadOnlyReplica(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	replica, replicaPort := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// normal clients of the replica are refused, and the connection stays usable.
+	replicaClient := dialTestServer(t, replicaPort)
+	require.NoError(t, replicaClient.Write(NewArray([]string{"SET", "foo", "replica"})))
+	reply, err := replicaClient.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "-READONLY You can't write against a read only replica.", reply)
+
+	// writes from the master are applied silently.
+	client := dialTestServer(t, port)
+	require.NoError(t, client.Write(NewArray([]string{"SET", "foo", "master"})))
+	reply, err = client.Read()
+	require.NoError(t, err)
+	require.Equal(t, "+OK", reply)
+
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && *value == "master"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, replicaClient.Write(NewArray([]string{"GET", "foo"})))
+	for _, want := range []string{"$6", "master"} {
+		reply, err := replicaClient.Read()
+		require.NoError(t, err)
+		assert.Equal(t, want, reply)
+	}
+}
+
+func TestReplication_MinReplicasToWrite(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{MinReplicasToWrite: 1, MinReplicasMaxLag: 10})
+
+	client := dialTestServer(t, port)
+	set := NewArray([]string{"SET", "foo", "bar"})
+
+	require.NoError(t, client.Write(set))
+	reply, err := client.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "-NOREPLICAS Not enough good replicas to write.", reply)
+	assert.True(t, master.Info().MinSlavesEnabled)
+	assert.Equal(t, 0, master.Info().MinSlavesGoodSlaves)
+
+	// the refused write isn't propagated.
+	assert.Equal(t, 0, master.Info().MasterReplOffset)
+
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up" && master.Info().MinSlavesGoodSlaves == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Write(set))
+	reply, err = client.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "+OK", reply)
+}
+
+func TestReplication_ReplicaOf(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	server, serverPort := startTestServer(t, &config.Opts{})
+
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+
+	// the master becomes the master of a server running as a master.
+	serverClient := dialTestServer(t, serverPort)
+	assert.Equal(t, "+OK\r\n", request(t, serverClient, "REPLICAOF", "127.0.0.1", fmt.Sprint(port)))
+	assert.Equal(t, "+OK Already connected to specified master\r\n", request(t, serverClient, "REPLICAOF", "127.0.0.1", fmt.Sprint(port)))
+
+	require.Eventually(t, func() bool {
+		value, _ := server.cache.Get("foo")
+		return server.Info().MasterLinkStatus == "up" && value != nil && *value == "bar"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "slave", server.Role())
+	assert.Equal(t, master.ID(), server.ID())
+	assert.Equal(t, master.Info().MasterReplOffset, server.Info().MasterReplOffset)
+
+	// once promoted, the server has a new history, which continues the one of the master.
+	offset := server.Info().MasterReplOffset
+	assert.Equal(t, "+OK\r\n", request(t, serverClient, "REPLICAOF", "NO", "ONE"))
+
+	info := server.Info()
+	assert.Equal(t, "master", info.Role)
+	assert.NotEqual(t, master.ID(), info.MasterReplID)
+	assert.Equal(t, master.ID(), info.MasterReplID2)
+	assert.Equal(t, offset+1, info.SecondReplOffset)
+	assert.Equal(t, offset, info.MasterReplOffset)
+
+	// the writes of the master don't reach it anymore, and it takes writes of its own.
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "master"))
+	assert.Equal(t, "+OK\r\n", request(t, serverClient, "SET", "other", "promoted"))
+	assert.Equal(t, "$3\r\nbar\r\n", request(t, serverClient, "GET", "foo"))
+}
+
+func TestReplication_PartialResync(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{ReplBacklogSize: 1024})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a key only the replica has tells whether the replica resynced from scratch.
+	require.NoError(t, replica.cache.Set("local", "1", 0))
+
+	// the writes done while the link is lost are sent from the backlog once the replica reconnects.
+	replica.link.Disconnect()
+	require.Eventually(t, func() bool {
+		return master.MasterConfig().SlaveNum() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "baz"))
+
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && *value == "baz" && replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+	local, _ := replica.cache.Get("local")
+	assert.NotNil(t, local)
+
+	// without the writes in the backlog anymore, the replica resyncs from scratch.
+	replica.link.Disconnect()
+	require.Eventually(t, func() bool {
+		return master.MasterConfig().SlaveNum() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", strings.Repeat("x", 2048)))
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up" && replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+	local, _ = replica.cache.Get("local")
+	assert.Nil(t, local)
+}
+
+func TestReplication_PartialResyncAfterFailover(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	promoted, promotedPort := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port), ReplBacklogSize: 1024})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	client := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "bar"))
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && promoted.Info().MasterReplOffset == replica.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, replica.cache.Set("local", "1", 0))
+
+	// the other replica follows the promoted one, which has the same history up to the promotion.
+	promotedClient := dialTestServer(t, promotedPort)
+	require.Equal(t, "+OK\r\n", request(t, promotedClient, "REPLICAOF", "NO", "ONE"))
+	require.Equal(t, "+OK\r\n", request(t, promotedClient, "SET", "foo", "promoted"))
+	replica.ReplicaOf(net.ParseIP("127.0.0.1"), promotedPort)
+
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && *value == "promoted" && replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the replica continued without resyncing, and follows the new history.
+	local, _ := replica.cache.Get("local")
+	assert.NotNil(t, local)
+	info := replica.Info()
+	assert.Equal(t, promoted.ID(), info.MasterReplID)
+	assert.Equal(t, promoted.Info().MasterReplID2, info.MasterReplID2)
+	assert.Equal(t, promoted.Info().MasterReplOffset, info.MasterReplOffset)
+}
+
+func TestReplication_SlaveHealth(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{ReplTimeout: 1})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port), ReplTimeout: 1})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a slave which never ACKs after the full resync.
+	silent := dialTestServer(t, port)
+	require.Equal(t, "+OK\r\n", request(t, silent, "REPLCONF", "listening-port", "1"))
+	require.NoError(t, silent.Write(NewArray([]string{"PSYNC", "?", "-1"})))
+	reply, err := silent.Read()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(reply, "+FULLRESYNC "), reply)
+
+	require.Eventually(t, func() bool {
+		return master.MasterConfig().SlaveNum() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the silent slave is dropped after repl-timeout, while the replica keeps ACKing.
+	require.Eventually(t, func() bool {
+		return master.MasterConfig().SlaveNum() == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	assert.Regexp(t, `slave0:ip=127\.0\.0\.1,port=\d+,state=online,offset=\d+,lag=[01]\r\n`, request(t, client, "INFO", "replication"))
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 1, master.MasterConfig().SlaveNum())
+	assert.Equal(t, "up", replica.Info().MasterLinkStatus)
+}
+
+func TestReplication_MasterTimeout(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{ReplPingReplicaPeriod: 1})
+
+	// the replica goes through a proxy, which stops forwarding anything once frozen, like a master which hangs.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	frozen := make(chan struct{})
+	forward := func(dst, src net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case <-frozen:
+				return
+			default:
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				c.Close()
+				return
+			}
+			t.Cleanup(func() { c.Close(); m.Close() })
+			go forward(m, c)
+			go forward(c, m)
+		}
+	}()
+
+	proxyPort := l.Addr().(*net.TCPAddr).Port
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", proxyPort), ReplTimeout: 2})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an idle master keeps the link up with its PINGs, for longer than the timeout.
+	start := replica.Info().MasterReplOffset
+	for i := 1; i <= 3; i++ {
+		require.Eventually(t, func() bool {
+			return replica.Info().MasterReplOffset >= start+i*len(PING.Redis())
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, "up", replica.Info().MasterLinkStatus)
+	}
+
+	close(frozen)
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "down"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestReplication_PingPeriod(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{ReplPingReplicaPeriod: 1})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ping := func(sinceLastPing time.Duration) bool {
+		master.lock.Lock()
+		master.lastPing = time.Now().Add(-sinceLastPing)
+		master.lock.Unlock()
+
+		offset := master.MasterConfig().PropagationOffset()
+		master.replicationCron()
+		return master.MasterConfig().PropagationOffset() > offset
+	}
+
+	// a tick a little early still PINGs, instead of waiting for the next one.
+	assert.True(t, ping(time.Second-10*time.Millisecond))
+	assert.False(t, ping(100*time.Millisecond))
+}
+
+func TestReplication_FullResyncDuringWrite(t *testing.T) {
+	for _, opts := range []*config.Opts{{}, {ReplDisklessSync: "yes"}} {
+		t.Run(fmt.Sprintf("diskless=%s", opts.ReplDisklessSync), func(t *testing.T) {
+			master, port := startTestServer(t, opts)
+
+			// a write is applied but not propagated yet, while the replica asks for a full resync.
+			released := make(chan struct{})
+			applied := make(chan struct{})
+			go func() {
+				_ = master.cache.Run(func() error {
+					require.NoError(t, master.cache.Set("foo", "bar", 0))
+					close(applied)
+					<-released
+					master.MasterConfig().PropagateWrite(NewArray([]string{"SET", "foo", "bar"}), nil)
+					return nil
+				})
+			}()
+			<-applied
+
+			replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+			// the replica is registered only once the write is done, so it gets the write in the snapshot only.
+			time.Sleep(300 * time.Millisecond)
+			assert.Equal(t, "down", replica.Info().MasterLinkStatus)
+			close(released)
+
+			require.Eventually(t, func() bool {
+				return replica.Info().MasterLinkStatus == "up"
+			}, 5*time.Second, 10*time.Millisecond)
+
+			value, _ := replica.cache.Get("foo")
+			require.NotNil(t, value)
+			assert.Equal(t, "bar", *value)
+			assert.Equal(t, master.Info().MasterReplOffset, replica.Info().MasterReplOffset)
+		})
+	}
+}
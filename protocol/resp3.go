@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+)
+
+// resp3Message is a message encoded differently in RESP3. Redis() of such a message is its RESP2 fallback.
+type resp3Message interface {
+	RESP3() []byte
+}
+
+// Encode returns the encoding of the message in the given protocol version, 2 or 3.
+func Encode(msg Message, proto int) []byte {
+	if proto == 3 {
+		if m, ok := msg.(resp3Message); ok {
+			return m.RESP3()
+		}
+	}
+
+	return msg.Redis()
+}
+
+// encodeAggregate encodes the items with the given type byte and count, such as *<n> or %<n>.
+func encodeAggregate(typ byte, n int, items []Message, proto int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(typ)
+	buf.WriteString(strconv.Itoa(n))
+	buf.WriteString("\r\n")
+	for _, item := range items {
+		buf.Write(Encode(item, proto))
+	}
+
+	return buf.Bytes()
+}
+
+func (nm *NestedArrayMessage) RESP3() []byte {
+	return encodeAggregate('*', len(nm.items), nm.items, 3)
+}
+
+func (nm *NullMessage) RESP3() []byte {
+	return []byte("_\r\n")
+}
+
+func (nm *NullArrayMessage) RESP3() []byte {
+	return []byte("_\r\n")
+}
+
+// MapMessage is a RESP3 map. In RESP2, it's an array of the keys and values.
+type MapMessage struct {
+	items []Message // keys and values, alternately.
+}
+
+// NewMap returns a map of the given keys and values, alternately.
+func NewMap(items []Message) *MapMessage {
+	return &MapMessage{items: items}
+}
+
+func (mm *MapMessage) Items() []Message {
+	return mm.items
+}
+
+func (mm *MapMessage) Redis() []byte {
+	return encodeAggregate('*', len(mm.items), mm.items, 2)
+}
+
+func (mm *MapMessage) RESP3() []byte {
+	return encodeAggregate('%', len(mm.items)/2, mm.items, 3)
+}
+
+func (mm *MapMessage) Propagatible() bool {
+	return false
+}
+
+// SetMessage is a RESP3 set. In RESP2, it's an array.
+type SetMessage struct {
+	items []Message
+}
+
+func NewSet(items []Message) *SetMessage {
+	return &SetMessage{items: items}
+}
+
+func (sm *SetMessage) Items() []Message {
+	return sm.items
+}
+
+func (sm *SetMessage) Redis() []byte {
+	return encodeAggregate('*', len(sm.items), sm.items, 2)
+}
+
+func (sm *SetMessage) RESP3() []byte {
+	return encodeAggregate('~', len(sm.items), sm.items, 3)
+}
+
+func (sm *SetMessage) Propagatible() bool {
+	return false
+}
+
+// PushMessage is a RESP3 push frame, such as a message from a subscribed channel. In RESP2, it's an array.
+type PushMessage struct {
+	items []Message
+}
+
+func NewPush(items []Message) *PushMessage {
+	return &PushMessage{items: items}
+}
+
+func (pm *PushMessage) Items() []Message {
+	return pm.items
+}
+
+func (pm *PushMessage) Redis() []byte {
+	return encodeAggregate('*', len(pm.items), pm.items, 2)
+}
+
+func (pm *PushMessage) RESP3() []byte {
+	return encodeAggregate('>', len(pm.items), pm.items, 3)
+}
+
+func (pm *PushMessage) Propagatible() bool {
+	return false
+}
+
+// AttributeMessage is a RESP3 reply with attributes, which are auxiliary data about the reply.
+// In RESP2, the attributes are dropped.
+type AttributeMessage struct {
+	attrs []Message // keys and values, alternately.
+	msg   Message
+}
+
+func NewAttribute(attrs []Message, msg Message) *AttributeMessage {
+	return &AttributeMessage{attrs: attrs, msg: msg}
+}
+
+func (am *AttributeMessage) Attributes() []Message {
+	return am.attrs
+}
+
+func (am *AttributeMessage) Message() Message {
+	return am.msg
+}
+
+func (am *AttributeMessage) Redis() []byte {
+	return am.msg.Redis()
+}
+
+func (am *AttributeMessage) RESP3() []byte {
+	return append(encodeAggregate('|', len(am.attrs)/2, am.attrs, 3), Encode(am.msg, 3)...)
+}
+
+func (am *AttributeMessage) Propagatible() bool {
+	return false
+}
+
+// DoubleMessage is a RESP3 double. In RESP2, it's a bulk string.
+type DoubleMessage struct {
+	raw float64
+}
+
+func NewDouble(val float64) *DoubleMessage {
+	return &DoubleMessage{raw: val}
+}
+
+func (dm *DoubleMessage) Raw() float64 {
+	return dm.raw
+}
+
+func (dm *DoubleMessage) String() string {
+	switch {
+	case math.IsInf(dm.raw, 1):
+		return "inf"
+	case math.IsInf(dm.raw, -1):
+		return "-inf"
+	case math.IsNaN(dm.raw):
+		return "nan"
+	}
+
+	return strconv.FormatFloat(dm.raw, 'g', -1, 64)
+}
+
+func (dm *DoubleMessage) Redis() []byte {
+	return NewBulk(dm.String()).Redis()
+}
+
+func (dm *DoubleMessage) RESP3() []byte {
+	return []byte("," + dm.String() + "\r\n")
+}
+
+func (dm *DoubleMessage) Propagatible() bool {
+	return false
+}
+
+// BooleanMessage is a RESP3 boolean. In RESP2, it's the integer 1 or 0.
+type BooleanMessage struct {
+	raw bool
+}
+
+func NewBoolean(val bool) *BooleanMessage {
+	return &BooleanMessage{raw: val}
+}
+
+func (bm *BooleanMessage) Raw() bool {
+	return bm.raw
+}
+
+func (bm *BooleanMessage) Redis() []byte {
+	if bm.raw {
+		return []byte(":1\r\n")
+	}
+	return []byte(":0\r\n")
+}
+
+func (bm *BooleanMessage) RESP3() []byte {
+	if bm.raw {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
+}
+
+func (bm *BooleanMessage) Propagatible() bool {
+	return false
+}
+
+// BigNumberMessage is a RESP3 big number, given in decimal. In RESP2, it's a bulk string.
+type BigNumberMessage struct {
+	raw string
+}
+
+func NewBigNumber(val string) *BigNumberMessage {
+	return &BigNumberMessage{raw: val}
+}
+
+func (bm *BigNumberMessage) Raw() string {
+	return bm.raw
+}
+
+func (bm *BigNumberMessage) Redis() []byte {
+	return NewBulk(bm.raw).Redis()
+}
+
+func (bm *BigNumberMessage) RESP3() []byte {
+	return []byte("(" + bm.raw + "\r\n")
+}
+
+func (bm *BigNumberMessage) Propagatible() bool {
+	return false
+}
+
+// VerbatimMessage is a RESP3 verbatim string, with a 3-character format such as txt or mkd.
+// In RESP2, it's a bulk string of the text.
+type VerbatimMessage struct {
+	format string
+	raw    []byte
+}
+
+func NewVerbatim(format string, text []byte) *VerbatimMessage {
+	return &VerbatimMessage{format: format, raw: text}
+}
+
+func (vm *VerbatimMessage) Format() string {
+	return vm.format
+}
+
+func (vm *VerbatimMessage) Bytes() []byte {
+	return vm.raw
+}
+
+func (vm *VerbatimMessage) Redis() []byte {
+	return NewBulkBytes(vm.raw).Redis()
+}
+
+func (vm *VerbatimMessage) RESP3() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('=')
+	buf.WriteString(strconv.Itoa(len(vm.raw) + 4))
+	buf.WriteString("\r\n")
+	buf.WriteString(vm.format)
+	buf.WriteByte(':')
+	buf.Write(vm.raw)
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func (vm *VerbatimMessage) Propagatible() bool {
+	return false
+}
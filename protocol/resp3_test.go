@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   Message
+		resp2 string
+		resp3 string
+	}{
+		{name: "null", msg: NULL, resp2: "$-1\r\n", resp3: "_\r\n"},
+		{name: "bulk", msg: NewBulk("a"), resp2: "$1\r\na\r\n", resp3: "$1\r\na\r\n"},
+		{name: "boolean", msg: NewBoolean(false), resp2: ":0\r\n", resp3: "#f\r\n"},
+		{name: "double", msg: NewDouble(3.25), resp2: "$4\r\n3.25\r\n", resp3: ",3.25\r\n"},
+		{name: "infinite double", msg: NewDouble(math.Inf(1)), resp2: "$3\r\ninf\r\n", resp3: ",inf\r\n"},
+		{name: "big number", msg: NewBigNumber("12345678901234567890"), resp2: "$20\r\n12345678901234567890\r\n", resp3: "(12345678901234567890\r\n"},
+		{name: "verbatim string", msg: NewVerbatim("txt", []byte("a\r\nb")), resp2: "$4\r\na\r\nb\r\n", resp3: "=8\r\ntxt:a\r\nb\r\n"},
+		{name: "map", msg: NewMap([]Message{NewBulk("k"), NULL}), resp2: "*2\r\n$1\r\nk\r\n$-1\r\n", resp3: "%1\r\n$1\r\nk\r\n_\r\n"},
+		{name: "set", msg: NewSet([]Message{NewInt(1)}), resp2: "*1\r\n:1\r\n", resp3: "~1\r\n:1\r\n"},
+		{name: "push", msg: NewPush([]Message{NewBulk("message")}), resp2: "*1\r\n$7\r\nmessage\r\n", resp3: ">1\r\n$7\r\nmessage\r\n"},
+		{name: "attribute", msg: NewAttribute([]Message{NewBulk("k"), NewInt(1)}, NewInt(2)), resp2: ":2\r\n", resp3: "|1\r\n$1\r\nk\r\n:1\r\n:2\r\n"},
+		{name: "nested", msg: NewNestedArray([]Message{NULL, NewBoolean(true)}), resp2: "*2\r\n$-1\r\n:1\r\n", resp3: "*2\r\n_\r\n#t\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.resp2, string(Encode(tt.msg, 2)))
+			assert.Equal(t, tt.resp3, string(Encode(tt.msg, 3)))
+		})
+	}
+}
+
+func TestHello(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	// RESP2 until HELLO 3.
+	require.Equal(t, "$-1\r\n", request(t, client, "GET", "foo"))
+	require.Equal(t, "-NOPROTO unsupported protocol version\r\n", request(t, client, "HELLO", "4"))
+	require.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n",
+		request(t, client, "HELLO", "3", "AUTH", "someone", "secret"))
+
+	require.NoError(t, client.Write(NewArray([]string{"HELLO", "3", "AUTH", "default", "secret", "SETNAME", "myclient"})))
+	reply, err := ReadMessage(client)
+	require.NoError(t, err)
+	require.IsType(t, &MapMessage{}, reply)
+
+	props := map[string]string{}
+	items := reply.(*MapMessage).Items()
+	for i := 0; i < len(items); i += 2 {
+		props[items[i].(*BulkMessage).Raw()] = string(Encode(items[i+1], 3))
+	}
+	assert.Equal(t, "$5\r\nredis\r\n", props["server"])
+	assert.Equal(t, ":3\r\n", props["proto"])
+	assert.Equal(t, "$10\r\nstandalone\r\n", props["mode"])
+	assert.Equal(t, "$6\r\nmaster\r\n", props["role"])
+	assert.Equal(t, "*0\r\n", props["modules"])
+
+	// RESP3 from now on.
+	require.NoError(t, client.Write(NewArray([]string{"GET", "foo"})))
+	reply, err = ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, "_\r\n", string(Encode(reply, 3)))
+	assert.Equal(t, "$8\r\nmyclient\r\n", request(t, client, "CLIENT", "GETNAME"))
+
+	// messages of subscribed channels are push frames.
+	require.NoError(t, client.Write(NewArray([]string{"SUBSCRIBE", "ch"})))
+	reply, err = ReadMessage(client)
+	require.NoError(t, err)
+	assert.IsType(t, &PushMessage{}, reply)
+
+	publisher := dialTestServer(t, port)
+	require.Equal(t, ":1\r\n", request(t, publisher, "PUBLISH", "ch", "hi"))
+
+	reply, err = ReadMessage(client)
+	require.NoError(t, err)
+	assert.Equal(t, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", string(Encode(reply, 3)))
+
+	// and back to RESP2, where the map is a flat array.
+	assert.Regexp(t, `^\*14\r\n\$6\r\nserver\r\n`, request(t, client, "HELLO", "2"))
+	assert.Equal(t, "$-1\r\n", request(t, client, "GET", "foo"))
+}
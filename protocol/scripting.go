@@ -0,0 +1,695 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	NOSCRIPT     = NewError("NOSCRIPT No matching script. Please use EVAL.")
+	NOTBUSY      = NewError("NOTBUSY No scripts in execution right now.")
+	UNKILLABLE   = NewError("UNKILLABLE Sorry the script already executed write commands against the dataset. You can only wait for the script termination.")
+	BUSYSCRIPT   = NewError("BUSY Redis is busy running a script. You can only call SCRIPT KILL.")
+	BUSYFUNCTION = NewError("BUSY Redis is busy running a script. You can only call FUNCTION KILL.")
+)
+
+// ScriptCache is the scripts given to EVAL and SCRIPT LOAD, compiled, by their SHA1, and the Lua states to run
+// them in.
+type ScriptCache struct {
+	lock    sync.RWMutex
+	scripts map[string]*lua.FunctionProto
+
+	// states are *scriptState, reused by the next scripts.
+	states sync.Pool
+}
+
+func NewScriptCache() *ScriptCache {
+	return &ScriptCache{
+		scripts: make(map[string]*lua.FunctionProto),
+		states:  sync.Pool{New: func() any { return newScriptState() }},
+	}
+}
+
+// Load compiles the script and caches it. It returns the SHA1 of the script, and the compiled script.
+func (sc *ScriptCache) Load(body string) (string, *lua.FunctionProto, error) {
+	sha := sha1hex(body)
+
+	sc.lock.RLock()
+	proto, ok := sc.scripts[sha]
+	sc.lock.RUnlock()
+	if ok {
+		return sha, proto, nil
+	}
+
+	proto, err := compileLua(body, "user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("compileLua failed: %w", err)
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.scripts[sha] = proto
+	return sha, proto, nil
+}
+
+// Get returns the compiled script of the SHA1, nil if it's not cached.
+func (sc *ScriptCache) Get(sha string) *lua.FunctionProto {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	return sc.scripts[strings.ToLower(sha)]
+}
+
+// Flush forgets all the scripts.
+func (sc *ScriptCache) Flush() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.scripts = make(map[string]*lua.FunctionProto)
+}
+
+func compileLua(body, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), name)
+	if err != nil {
+		return nil, fmt.Errorf("parse.Parse failed: %w", err)
+	}
+
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("lua.Compile failed: %w", err)
+	}
+
+	return proto, nil
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptArgs splits numkeys key [key ...] arg [arg ...] of EVAL and FCALL into the keys and the args.
+func scriptArgs(args []string) ([]string, []string, *ErrorMessage) {
+	num, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, NOTINTEGER
+	}
+	if num < 0 {
+		return nil, nil, NewError("ERR Number of keys can't be negative")
+	}
+	if num > len(args)-1 {
+		return nil, nil, NewError("ERR Number of keys can't be greater than number of args")
+	}
+
+	return args[1 : 1+num], args[1+num:], nil
+}
+
+// evalCommand handles EVAL script numkeys [key ...] [arg ...]. The script is cached, as SCRIPT LOAD does.
+func (h *Handler) evalCommand(msg *ArrayMessage) error {
+	keys, args, em := scriptArgs(msg.SliceFrom(2))
+	if em != nil {
+		return h.replyError(em)
+	}
+
+	_, proto, err := h.state.Scripts().Load(msg.Token(1))
+	if err != nil {
+		return h.replyError(compileError(err))
+	}
+
+	return h.runScript(proto, keys, args)
+}
+
+// evalshaCommand handles EVALSHA sha1 numkeys [key ...] [arg ...].
+func (h *Handler) evalshaCommand(msg *ArrayMessage) error {
+	keys, args, em := scriptArgs(msg.SliceFrom(2))
+	if em != nil {
+		return h.replyError(em)
+	}
+
+	proto := h.state.Scripts().Get(msg.Token(1))
+	if proto == nil {
+		return h.replyError(NOSCRIPT)
+	}
+
+	return h.runScript(proto, keys, args)
+}
+
+// scriptCommand handles SCRIPT LOAD|EXISTS|FLUSH|KILL.
+func (h *Handler) scriptCommand(msg *ArrayMessage) error {
+	var reply Message
+	switch strings.ToUpper(msg.Token(1)) {
+	case "LOAD":
+		sha, _, err := h.state.Scripts().Load(msg.Token(2))
+		if err != nil {
+			return h.replyError(compileError(err))
+		}
+		reply = NewBulk(sha)
+
+	case "EXISTS":
+		items := make([]Message, 0, msg.Len()-2)
+		for _, sha := range msg.SliceFrom(2) {
+			exists := 0
+			if h.state.Scripts().Get(sha) != nil {
+				exists = 1
+			}
+			items = append(items, NewInt(exists))
+		}
+		reply = NewNestedArray(items)
+
+	case "FLUSH":
+		if msg.Len() == 3 && !strings.EqualFold(msg.Token(2), "SYNC") && !strings.EqualFold(msg.Token(2), "ASYNC") {
+			return h.writeError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+		if msg.Len() > 3 {
+			return h.replyError(SYNTAXERR)
+		}
+		h.state.Scripts().Flush()
+		reply = OK
+
+	case "KILL":
+		reply = h.killScript(false)
+
+	default:
+		return h.replyError(NewUnknownSubcommandError("script", msg.Token(1)))
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// runScript runs the script with the keys and the args in KEYS and ARGV.
+func (h *Handler) runScript(proto *lua.FunctionProto, keys, args []string) error {
+	sc := h.state.Scripts()
+	s := sc.states.Get().(*scriptState)
+	defer sc.states.Put(s)
+
+	L := s.L
+	return h.runLua(L, false, false, func(run *scriptRun) (lua.LValue, error) {
+		s.run = run
+		defer func() { s.run = nil }()
+		defer L.SetTop(0)
+
+		L.G.Global.RawSetString("KEYS", luaStrings(L, keys))
+		L.G.Global.RawSetString("ARGV", luaStrings(L, args))
+
+		L.Push(L.NewFunctionFromProto(proto))
+		if err := L.PCall(0, 1, nil); err != nil {
+			return nil, err
+		}
+		return L.Get(-1), nil
+	})
+}
+
+// runLua runs Lua code in L while no other command runs, and replies what it returns. The writes of the code are
+// propagated instead of the code, so that the slaves don't have to run it. With readOnly, the code can't call
+// write commands. function tells whether the code is a function called by FCALL, rather than a script.
+func (h *Handler) runLua(L *lua.LState, function, readOnly bool, f func(run *scriptRun) (lua.LValue, error)) error {
+	var reply Message
+	err := h.runExclusive(func() error {
+		script := h.startScript(function)
+		defer h.endScript(script)
+
+		L.SetContext(script.ctx)
+		defer L.RemoveContext()
+
+		run := newScriptRun(h, script, readOnly)
+		lv, err := f(run)
+		switch {
+		case err != nil && script.isKilled():
+			reply = script.killedError()
+		case err != nil:
+			reply = scriptError(err)
+		default:
+			reply = luaToRedis(lv)
+		}
+
+		h.propagateEffects(run.writes)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(reply); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// scriptRun is a run of Lua code. The commands called from the code are run by a copy of the handler which
+// replies to a buffer, and the replies are read back from it.
+type scriptRun struct {
+	h        *Handler
+	sub      *Handler
+	script   *runningScript
+	readOnly bool
+
+	// writes are the writes done by the code, to be propagated.
+	writes []Message
+}
+
+func newScriptRun(h *Handler, script *runningScript, readOnly bool) *scriptRun {
+	sub := *h
+	sub.conn = NewConnection(&bufferConn{})
+	sub.proto = 2
+	sub.multi = nil
+	sub.effects = nil
+
+	return &scriptRun{h: h, sub: &sub, script: script, readOnly: readOnly}
+}
+
+// runningScript is the Lua code running. Once it has run for longer than lua-time-limit, the other clients are
+// refused with -BUSY instead of waiting for it. It can be killed, until it writes.
+type runningScript struct {
+	function bool // called by FCALL and killed by FUNCTION KILL, rather than by EVAL and SCRIPT KILL.
+
+	// ctx is the context of the Lua state running the code, canceled to kill it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// busy is closed once lua-time-limit has passed, and done once the code has returned.
+	busy  chan struct{}
+	done  chan struct{}
+	timer *time.Timer
+
+	lock   sync.Mutex
+	wrote  bool
+	killed bool
+}
+
+// startScript makes the Lua code about to run the running one of this server.
+func (h *Handler) startScript(function bool) *runningScript {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &runningScript{
+		function: function,
+		ctx:      ctx,
+		cancel:   cancel,
+		busy:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if limit := time.Duration(h.opts.LuaTimeLimit) * time.Millisecond; limit > 0 {
+		s.timer = time.AfterFunc(limit, func() { close(s.busy) })
+	}
+
+	h.state.script.Store(s)
+	return s
+}
+
+// endScript lets the clients waiting for the Lua code go on.
+func (h *Handler) endScript(s *runningScript) {
+	h.state.script.CompareAndSwap(s, nil)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cancel()
+	close(s.done)
+}
+
+// waitScript waits for the Lua code running, if any. It returns -BUSY if the code runs for longer than
+// lua-time-limit.
+func (h *Handler) waitScript() *ErrorMessage {
+	for {
+		s := h.state.script.Load()
+		if s == nil {
+			return nil
+		}
+
+		select {
+		case <-s.done:
+		case <-s.busy:
+			select {
+			case <-s.done:
+			default:
+				return s.busyError()
+			}
+		}
+	}
+}
+
+// killScript handles SCRIPT KILL, and FUNCTION KILL with function.
+func (h *Handler) killScript(function bool) Message {
+	s := h.state.script.Load()
+	switch {
+	case s == nil:
+		return NOTBUSY
+	case s.function != function:
+		// the code is killed by the other command.
+		return s.busyError()
+	case !s.kill():
+		return UNKILLABLE
+	}
+	return OK
+}
+
+// write marks the code as having written, after which it can't be killed. It returns false if the code was
+// killed already.
+func (s *runningScript) write() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.killed {
+		return false
+	}
+	s.wrote = true
+	return true
+}
+
+// kill cancels the code, unless it has written. The Lua state raises an error at the next instruction.
+func (s *runningScript) kill() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.wrote {
+		return false
+	}
+	s.killed = true
+	s.cancel()
+	return true
+}
+
+func (s *runningScript) isKilled() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.killed
+}
+
+func (s *runningScript) busyError() *ErrorMessage {
+	if s.function {
+		return BUSYFUNCTION
+	}
+	return BUSYSCRIPT
+}
+
+func (s *runningScript) killedError() *ErrorMessage {
+	if s.function {
+		return NewError("ERR Script killed by user with FUNCTION KILL...")
+	}
+	return NewError("ERR Script killed by user with SCRIPT KILL...")
+}
+
+// newLuaState returns a Lua state with the libraries scripts can use.
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// scripts can't touch the file system, or run code which isn't theirs.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	return L
+}
+
+// scriptState is a Lua state to run scripts in, with the redis library. It's reused by the next scripts, so
+// like Redis, scripts can't create global variables, or read ones which don't exist.
+type scriptState struct {
+	L *lua.LState
+
+	// run is the run using the state, while one does.
+	run *scriptRun
+}
+
+func newScriptState() *scriptState {
+	s := &scriptState{L: newLuaState()}
+	L := s.L
+	setRedisLib(L, func() *scriptRun { return s.run })
+
+	// KEYS and ARGV are set by each run.
+	L.SetGlobal("KEYS", L.NewTable())
+	L.SetGlobal("ARGV", L.NewTable())
+
+	mt := L.NewTable()
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.Get(2).String())
+		return 0
+	}))
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.Get(2).String())
+		return 0
+	}))
+	mt.RawSetString("__metatable", lua.LFalse)
+	L.SetMetatable(L.G.Global, mt)
+
+	return s
+}
+
+// setRedisLib sets the redis library. current returns the run calling the library, as a state of a function
+// library is kept across runs.
+func setRedisLib(L *lua.LState, current func() *scriptRun) {
+	L.SetGlobal("redis", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return current().call(L, true) },
+		"pcall":        func(L *lua.LState) int { return current().call(L, false) },
+		"sha1hex":      luaSha1hex,
+		"error_reply":  luaErrorReply,
+		"status_reply": luaStatusReply,
+	}))
+}
+
+// call handles redis.call and redis.pcall. An error reply raises a Lua error with redis.call, and is returned
+// as a table with pcall.
+func (run *scriptRun) call(L *lua.LState, raise bool) int {
+	if L.GetTop() == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+
+	args := make([]string, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args = append(args, string(v))
+		case lua.LNumber:
+			args = append(args, v.String())
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	reply := run.exec(NewArray(args))
+	if em, ok := reply.(*ErrorMessage); ok && raise {
+		L.Error(luaErrorTable(L, em.Raw()), 0)
+	}
+
+	L.Push(redisToLua(L, reply))
+	return 1
+}
+
+// exec runs a command called from the script, and returns its reply.
+func (run *scriptRun) exec(msg *ArrayMessage) Message {
+	cmd, em := lookupRequest(msg)
+	if em != nil {
+		return em
+	}
+	if cmd.flags&flagNoScript != 0 {
+		return NewError("ERR This Redis command is not allowed from script")
+	}
+	if cmd.flags&flagWrite != 0 && run.readOnly {
+		return NewError("ERR Write commands are not allowed from read-only scripts.")
+	}
+	if cmd.flags&flagWrite != 0 && run.h.opts.ReadOnlyReplica && run.h.repl.Role() == "slave" {
+		return READONLY
+	}
+	if cmd.flags&flagWrite != 0 && run.h.tooFewReplicas() {
+		return NOREPLICAS
+	}
+	if cmd.flags&flagWrite != 0 && !run.script.write() {
+		return run.script.killedError()
+	}
+
+	dirty, err := run.sub.call(cmd, msg)
+	if err != nil {
+		return NewError("ERR " + err.Error())
+	}
+
+	reply, err := ReadMessage(run.sub.conn)
+	if err != nil {
+		return NewError(fmt.Sprintf("ERR %s didn't reply: %v", cmd.name, err))
+	}
+
+	if dirty && msg.Propagatible() {
+		run.writes = append(run.writes, msg)
+	}
+
+	return reply
+}
+
+// redisToLua converts a reply to a Lua value, like Redis does: integers to numbers, bulk strings to strings,
+// arrays to tables, nulls to false, and status and error replies to tables with the ok and err fields.
+func redisToLua(L *lua.LState, msg Message) lua.LValue {
+	switch m := msg.(type) {
+	case *IntMessage:
+		return lua.LNumber(m.Raw())
+	case *BulkMessage:
+		return lua.LString(m.Raw())
+	case *SimpleMessage:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(m.Raw()))
+		return t
+	case *ErrorMessage:
+		return luaErrorTable(L, m.Raw())
+	case *ArrayMessage:
+		t := L.NewTable()
+		for _, token := range m.Raw() {
+			t.Append(lua.LString(token))
+		}
+		return t
+	case *NestedArrayMessage:
+		t := L.NewTable()
+		for _, item := range m.Items() {
+			t.Append(redisToLua(L, item))
+		}
+		return t
+	default:
+		return lua.LFalse
+	}
+}
+
+// luaToRedis converts the value a script returns to a reply, like Redis does: numbers to integers, strings to
+// bulk strings, tables to arrays up to the first nil, true to 1 and false to null. A table with the err or ok
+// field is an error or status reply.
+func luaToRedis(lv lua.LValue) Message {
+	switch v := lv.(type) {
+	case lua.LString:
+		return NewBulk(string(v))
+	case lua.LNumber:
+		return NewInt(int(v))
+	case lua.LBool:
+		if v {
+			return NewInt(1)
+		}
+		return NULL
+	case *lua.LTable:
+		if e, ok := v.RawGetString("err").(lua.LString); ok {
+			return NewError(singleLine(string(e)))
+		}
+		if s, ok := v.RawGetString("ok").(lua.LString); ok {
+			return NewSimple(singleLine(string(s)))
+		}
+
+		items := make([]Message, 0, v.Len())
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, luaToRedis(item))
+		}
+		return NewNestedArray(items)
+	default:
+		return NULL
+	}
+}
+
+func luaStrings(L *lua.LState, strs []string) *lua.LTable {
+	t := L.CreateTable(len(strs), 0)
+	for _, s := range strs {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+func luaErrorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(msg))
+	return t
+}
+
+func luaSha1hex(L *lua.LState) int {
+	L.Push(lua.LString(sha1hex(L.CheckString(1))))
+	return 1
+}
+
+func luaErrorReply(L *lua.LState) int {
+	L.Push(luaErrorTable(L, L.CheckString(1)))
+	return 1
+}
+
+func luaStatusReply(L *lua.LState) int {
+	t := L.NewTable()
+	t.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(t)
+	return 1
+}
+
+// scriptError returns the error reply of a script which failed. The error replies raised by redis.call are
+// replied as they are.
+func scriptError(err error) *ErrorMessage {
+	var ae *lua.ApiError
+	if errors.As(err, &ae) {
+		if t, ok := ae.Object.(*lua.LTable); ok {
+			if e, ok := t.RawGetString("err").(lua.LString); ok {
+				return NewError(singleLine(string(e)))
+			}
+		}
+		return NewError(singleLine("ERR Error running script: " + ae.Object.String()))
+	}
+
+	return NewError(singleLine("ERR Error running script: " + err.Error()))
+}
+
+func compileError(err error) *ErrorMessage {
+	var pe *parse.Error
+	if errors.As(err, &pe) {
+		return NewError(singleLine("ERR Error compiling script (new function): " + pe.Error()))
+	}
+
+	return NewError(singleLine("ERR Error compiling script (new function): " + err.Error()))
+}
+
+// singleLine replaces newlines, as an error or status reply is a single line.
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// bufferConn is a net.Conn whose reads return what was written, for the replies to the commands scripts call.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (bc *bufferConn) Read(b []byte) (int, error) {
+	if bc.Len() == 0 {
+		return 0, io.EOF
+	}
+	return bc.Buffer.Read(b)
+}
+
+func (bc *bufferConn) Close() error                       { return nil }
+func (bc *bufferConn) LocalAddr() net.Addr                { return nil }
+func (bc *bufferConn) RemoteAddr() net.Addr               { return nil }
+func (bc *bufferConn) SetDeadline(t time.Time) error      { return nil }
+func (bc *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (bc *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
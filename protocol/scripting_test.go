@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScripting(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "keys and args", args: []string{"EVAL", "return {KEYS[1], ARGV[1], #KEYS, #ARGV}", "1", "k", "a"}, want: "*4\r\n$1\r\nk\r\n$1\r\na\r\n:1\r\n:1\r\n"},
+		{name: "call", args: []string{"EVAL", "redis.call('SET', KEYS[1], ARGV[1]); return redis.call('GET', KEYS[1])", "1", "foo", "bar"}, want: "$3\r\nbar\r\n"},
+		{name: "status", args: []string{"EVAL", "return redis.call('SET', 'x', 1)", "0"}, want: "+OK\r\n"},
+		{name: "null is false", args: []string{"EVAL", "return redis.call('GET', 'missing') == false", "0"}, want: ":1\r\n"},
+		{name: "numbers are truncated", args: []string{"EVAL", "return 3.99", "0"}, want: ":3\r\n"},
+		{name: "arrays stop at nil", args: []string{"EVAL", "return {1, 'a', nil, 2}", "0"}, want: "*2\r\n:1\r\n$1\r\na\r\n"},
+		{name: "false is null", args: []string{"EVAL", "return false", "0"}, want: "$-1\r\n"},
+		{name: "status reply", args: []string{"EVAL", "return redis.status_reply('FINE')", "0"}, want: "+FINE\r\n"},
+		{name: "error reply", args: []string{"EVAL", "return redis.error_reply('MY error')", "0"}, want: "-MY error\r\n"},
+		{name: "sha1hex", args: []string{"EVAL", "return redis.sha1hex('')", "0"}, want: "$40\r\nda39a3ee5e6b4b0d3255bfef95601890afd80709\r\n"},
+		{name: "call raises errors", args: []string{"EVAL", "redis.call('SET', 'a'); return 1", "0"}, want: "-ERR wrong number of arguments for 'set' command\r\n"},
+		{name: "pcall returns errors", args: []string{"EVAL", "return redis.pcall('NOPE')['err']", "0"}, want: "$54\r\nERR unknown command 'NOPE', with args beginning with: \r\n"},
+		{name: "no script commands", args: []string{"EVAL", "return redis.call('EVAL', 'return 1', '0')", "0"}, want: "-ERR This Redis command is not allowed from script\r\n"},
+		{name: "runtime error", args: []string{"EVAL", "local t; return t.x", "0"}, want: "-ERR Error running script: user_script:1: attempt to index a non-table object(nil) with key 'x'\r\n"},
+		{name: "no new globals", args: []string{"EVAL", "x = 1", "0"}, want: "-ERR Error running script: user_script:1: Script attempted to create global variable 'x'\r\n"},
+		{name: "no missing globals", args: []string{"EVAL", "return nope", "0"}, want: "-ERR Error running script: user_script:1: Script attempted to access nonexistent global variable 'nope'\r\n"},
+		{name: "globals protected", args: []string{"EVAL", "setmetatable(_G, nil)", "0"}, want: "-ERR Error running script: user_script:1: cannot change a protected metatable\r\n"},
+		{name: "no loadstring", args: []string{"EVAL", "return loadstring('return 1')()", "0"}, want: "-ERR Error running script: user_script:1: Script attempted to access nonexistent global variable 'loadstring'\r\n"},
+		{name: "too many keys", args: []string{"EVAL", "return 1", "2", "a"}, want: "-ERR Number of keys can't be greater than number of args\r\n"},
+		{name: "negative keys", args: []string{"EVAL", "return 1", "-1"}, want: "-ERR Number of keys can't be negative\r\n"},
+		{name: "unknown sha", args: []string{"EVALSHA", "0000000000000000000000000000000000000000", "0"}, want: "-NOSCRIPT No matching script. Please use EVAL.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, request(t, client, tt.args...))
+		})
+	}
+
+	t.Run("compile error", func(t *testing.T) {
+		assert.Contains(t, request(t, client, "EVAL", "return (", "0"), "-ERR Error compiling script (new function): ")
+	})
+
+	t.Run("script cache", func(t *testing.T) {
+		sha := sha1hex("return ARGV[1]")
+		assert.Equal(t, "$40\r\n"+sha+"\r\n", request(t, client, "SCRIPT", "LOAD", "return ARGV[1]"))
+		assert.Equal(t, "$2\r\nhi\r\n", request(t, client, "EVALSHA", sha, "0", "hi"))
+		assert.Equal(t, "*2\r\n:1\r\n:0\r\n", request(t, client, "SCRIPT", "EXISTS", sha, "nope"))
+
+		// EVAL caches the script too.
+		assert.Equal(t, ":1\r\n", request(t, client, "EVAL", "return 1", "0"))
+		assert.Equal(t, ":1\r\n", request(t, client, "EVALSHA", sha1hex("return 1"), "0"))
+
+		assert.Equal(t, "+OK\r\n", request(t, client, "SCRIPT", "FLUSH"))
+		assert.Equal(t, "*1\r\n:0\r\n", request(t, client, "SCRIPT", "EXISTS", sha))
+	})
+
+	t.Run("in a transaction", func(t *testing.T) {
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "EVAL", "return redis.call('SET', KEYS[1], 'tx')", "1", "foo"))
+		assert.Equal(t, "*1\r\n+OK\r\n", execRequest(t, client, 1))
+	})
+}
+
+func TestScripting_Effects(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	replica, replicaState, _ := startTestNode(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the replica applies the writes of the script, the SET and the DEL, instead of running it.
+	client := dialTestServer(t, port)
+	script := "redis.call('SET', KEYS[1], ARGV[1]); redis.call('GET', KEYS[1]); redis.call('DEL', KEYS[2]); return 1"
+	assert.Equal(t, ":1\r\n", request(t, client, "EVAL", script, "2", "foo", "bar", "value"))
+
+	require.Eventually(t, func() bool {
+		value, _ := replica.cache.Get("foo")
+		return value != nil && *value == "value" && replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the replica never saw the script.
+	assert.Nil(t, replicaState.Scripts().Get(sha1hex(script)))
+}
+
+func TestScripting_MinReplicasToWrite(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{MinReplicasToWrite: 1, MinReplicasMaxLag: 10})
+	client := dialTestServer(t, port)
+
+	// the writes of the script are refused like the ones of clients, and aren't propagated.
+	assert.Equal(t, "-NOREPLICAS Not enough good replicas to write.\r\n", request(t, client, "EVAL", "return redis.call('SET', KEYS[1], 'bar')", "1", "foo"))
+	assert.Equal(t, "$-1\r\n", request(t, client, "EVAL", "return redis.call('GET', KEYS[1])", "1", "foo"))
+	assert.Equal(t, 0, master.Info().MasterReplOffset)
+}
+
+func TestScripting_Kill(t *testing.T) {
+	_, state, port := startTestNode(t, &config.Opts{LuaTimeLimit: 100})
+	runner, client := dialTestServer(t, port), dialTestServer(t, port)
+
+	running := func() bool { return state.script.Load() != nil }
+	require.Equal(t, "-NOTBUSY No scripts in execution right now.\r\n", request(t, client, "SCRIPT", "KILL"))
+
+	require.NoError(t, runner.Write(NewArray([]string{"EVAL", "while true do end", "0"})))
+	require.Eventually(t, running, 5*time.Second, 10*time.Millisecond)
+
+	// the other clients wait for the script until lua-time-limit, and are refused after.
+	assert.Equal(t, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.\r\n", request(t, client, "GET", "foo"))
+	assert.Equal(t, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.\r\n", request(t, client, "PING"))
+	assert.Equal(t, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.\r\n", request(t, client, "FUNCTION", "KILL"))
+	assert.Equal(t, "+OK\r\n", request(t, client, "SCRIPT", "KILL"))
+
+	reply, err := ReadMessage(runner)
+	require.NoError(t, err)
+	assert.Equal(t, "-ERR Script killed by user with SCRIPT KILL...\r\n", string(reply.Redis()))
+	assert.Equal(t, "+PONG\r\n", request(t, client, "PING"))
+
+	// a script which wrote can't be killed, as its writes can't be undone.
+	require.NoError(t, runner.Write(NewArray([]string{"EVAL", "redis.call('SET', 'foo', 'bar'); while true do end", "0"})))
+	require.Eventually(t, running, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "-UNKILLABLE Sorry the script already executed write commands against the dataset. You can only wait for the script termination.\r\n", request(t, client, "SCRIPT", "KILL"))
+
+	state.script.Load().cancel()
+	reply, err = ReadMessage(runner)
+	require.NoError(t, err)
+	assert.Contains(t, string(reply.Redis()), "-ERR Error running script: ")
+
+	// the Lua state is reused by the next script.
+	assert.Equal(t, "$3\r\nbar\r\n", request(t, runner, "EVAL", "return redis.call('GET', 'foo')", "0"))
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"sync/atomic"
+
+	"github.com/codecrafters-io/redis-starter-go/cluster"
+)
+
+// State is the state shared by all handlers of this server which isn't about replication, such as the channel
+// subscribers and our view of the cluster.
+type State struct {
+	pubsub *PubSub
+
+	// scripts is the script cache of EVAL, and functions the function libraries of FUNCTION LOAD.
+	scripts   *ScriptCache
+	functions *FunctionEngine
+
+	// script is the Lua code running, nil if none.
+	script atomic.Pointer[runningScript]
+
+	// cluster is our view of the cluster in cluster mode, nil otherwise.
+	cluster *cluster.Cluster
+}
+
+func NewState() *State {
+	return &State{
+		pubsub:    NewPubSub(),
+		scripts:   NewScriptCache(),
+		functions: NewFunctionEngine(),
+	}
+}
+
+// PubSub returns the channel subscribers of this server.
+func (s *State) PubSub() *PubSub {
+	return s.pubsub
+}
+
+// Scripts returns the script cache of this server.
+func (s *State) Scripts() *ScriptCache {
+	return s.scripts
+}
+
+// Functions returns the function libraries of this server.
+func (s *State) Functions() *FunctionEngine {
+	return s.functions
+}
+
+// SetCluster sets our view of the cluster. It should be called before the handlers start.
+func (s *State) SetCluster(c *cluster.Cluster) {
+	s.cluster = c
+}
+
+// Cluster returns our view of the cluster, or nil if cluster mode is disabled.
+func (s *State) Cluster() *cluster.Cluster {
+	return s.cluster
+}
@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var (
+	QUEUED    = NewSimple("QUEUED")
+	EXECABORT = NewError("EXECABORT Transaction discarded because of previous errors.")
+)
+
+// transaction is the commands queued after MULTI.
+type transaction struct {
+	cmds []queuedCommand
+
+	// aborted is true if a command was rejected while queuing, such as an unknown command. EXEC fails then.
+	aborted bool
+}
+
+type queuedCommand struct {
+	cmd *command
+	msg *ArrayMessage
+}
+
+// arrayHeader is the header of an array whose items are written as separate messages, like the reply of EXEC.
+type arrayHeader int
+
+func (ah arrayHeader) Redis() []byte {
+	return []byte("*" + strconv.Itoa(int(ah)) + "\r\n")
+}
+
+func (ah arrayHeader) Propagatible() bool {
+	return false
+}
+
+// TransactionMessage is the writes of a transaction, propagated at once wrapped in MULTI and EXEC so that the
+// slaves apply them atomically too.
+type TransactionMessage struct {
+	msgs []Message
+}
+
+func NewTransaction(msgs []Message) *TransactionMessage {
+	return &TransactionMessage{msgs: msgs}
+}
+
+func (tm *TransactionMessage) Redis() []byte {
+	b := NewArray([]string{"MULTI"}).Redis()
+	for _, msg := range tm.msgs {
+		b = append(b, msg.Redis()...)
+	}
+	return append(b, NewArray([]string{"EXEC"}).Redis()...)
+}
+
+func (tm *TransactionMessage) Propagatible() bool {
+	return true
+}
+
+// queue queues the command until EXEC.
+func (h *Handler) queue(cmd *command, msg *ArrayMessage) error {
+	h.multi.cmds = append(h.multi.cmds, queuedCommand{cmd: cmd, msg: msg})
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(QUEUED); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) multiCommand(msg *ArrayMessage) error {
+	// MULTI in a transaction is refused by flagNoMulti.
+	h.multi = &transaction{}
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) discardCommand(msg *ArrayMessage) error {
+	if h.multi == nil {
+		return h.writeError("ERR DISCARD without MULTI")
+	}
+
+	h.multi = nil
+	h.unwatch()
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// execCommand runs the queued commands while no other command runs. The reply is an array of their replies, or
+// a null array if a watched key was modified.
+func (h *Handler) execCommand(msg *ArrayMessage) error {
+	if h.multi == nil {
+		return h.writeError("ERR EXEC without MULTI")
+	}
+
+	tx := h.multi
+	h.multi = nil
+	defer h.unwatch()
+
+	if tx.aborted {
+		return h.replyError(EXECABORT)
+	}
+
+	return h.runExclusive(func() error {
+		for key, version := range h.watched {
+			if h.cache.Modified(key, version) {
+				if !h.server {
+					return nil
+				}
+				if err := h.conn.Write(NULLARRAY); err != nil {
+					return fmt.Errorf("write response failed: %w", err)
+				}
+				return nil
+			}
+		}
+
+		if h.server {
+			if err := h.conn.Write(arrayHeader(len(tx.cmds))); err != nil {
+				return fmt.Errorf("write response failed: %w", err)
+			}
+		}
+
+		// the writes of scripts in the transaction are its writes too.
+		writes := make([]Message, 0)
+		h.effects = &writes
+		defer func() { h.effects = nil }()
+
+		for _, q := range tx.cmds {
+			dirty, err := h.call(q.cmd, q.msg)
+			if err != nil {
+				return err
+			}
+
+			if dirty && q.msg.Propagatible() {
+				writes = append(writes, q.msg)
+			}
+		}
+
+		h.effects = nil
+		h.propagateEffects(writes)
+		return nil
+	})
+}
+
+// runExclusive runs f while no other command runs, like a transaction or a script. f can be nested, such as a
+// script in a transaction.
+func (h *Handler) runExclusive(f func() error) error {
+	if h.exclusive {
+		return f()
+	}
+
+	return h.cache.Exec(func() error {
+		h.exclusive = true
+		defer func() { h.exclusive = false }()
+
+		return f()
+	})
+}
+
+// propagateEffects propagates the writes of a transaction or a script. More than one write are wrapped in
+// MULTI and EXEC, so that the slaves apply them atomically too. In a transaction, they are propagated with
+// the other writes of the transaction.
+func (h *Handler) propagateEffects(writes []Message) {
+	if h.effects != nil {
+		*h.effects = append(*h.effects, writes...)
+		return
+	}
+
+	if !h.server || h.repl.Role() != "master" {
+		return
+	}
+
+	switch len(writes) {
+	case 0:
+	case 1:
+		h.propagate(writes[0])
+	default:
+		h.propagate(NewTransaction(writes))
+	}
+}
+
+// watchCommand handles WATCH key [key ...]. EXEC fails if any of the keys is modified before it.
+func (h *Handler) watchCommand(msg *ArrayMessage) error {
+	// WATCH in a transaction is refused by flagNoMulti.
+	for _, key := range msg.SliceFrom(1) {
+		if _, ok := h.watched[key]; ok {
+			continue
+		}
+		h.watched[key] = h.cache.Watch(key)
+	}
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+func (h *Handler) unwatchCommand(msg *ArrayMessage) error {
+	h.unwatch()
+
+	if !h.server {
+		return nil
+	}
+
+	if err := h.conn.Write(OK); err != nil {
+		return fmt.Errorf("write response failed: %w", err)
+	}
+
+	return nil
+}
+
+// unwatch forgets all the watched keys.
+func (h *Handler) unwatch() {
+	for key := range h.watched {
+		h.cache.Unwatch(key)
+		delete(h.watched, key)
+	}
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	_, port := startTestServer(t, &config.Opts{})
+	client := dialTestServer(t, port)
+	other := dialTestServer(t, port)
+
+	t.Run("exec", func(t *testing.T) {
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "bar"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "GET", "foo"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "bar", "NOPE"))
+
+		// nothing is run before EXEC.
+		assert.Equal(t, "$-1\r\n", request(t, other, "GET", "foo"))
+
+		// errors of the commands run are in the reply, and don't stop the others.
+		assert.Equal(t, "*3\r\n+OK\r\n$3\r\nbar\r\n-ERR syntax error\r\n", execRequest(t, client, 3))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "aborted"))
+		assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", request(t, client, "GET"))
+		assert.Equal(t, "-ERR Command not allowed inside a transaction\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", request(t, client, "EXEC"))
+		assert.Equal(t, "$3\r\nbar\r\n", request(t, client, "GET", "foo"))
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		assert.Equal(t, "-ERR EXEC without MULTI\r\n", request(t, client, "EXEC"))
+		assert.Equal(t, "-ERR DISCARD without MULTI\r\n", request(t, client, "DISCARD"))
+
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "discarded"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "DISCARD"))
+		assert.Equal(t, "$3\r\nbar\r\n", request(t, client, "GET", "foo"))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		// a watched key modified by another client fails EXEC.
+		assert.Equal(t, "+OK\r\n", request(t, client, "WATCH", "foo", "missing"))
+		assert.Equal(t, "+OK\r\n", request(t, other, "SET", "foo", "changed"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "watched"))
+		assert.Equal(t, "*-1", rawRequest(t, client, "EXEC"))
+		assert.Equal(t, "$7\r\nchanged\r\n", request(t, client, "GET", "foo"))
+
+		// EXEC forgets the watched keys.
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "watched"))
+		assert.Equal(t, "*1\r\n+OK\r\n", execRequest(t, client, 1))
+
+		// the modification of a key not watched doesn't matter.
+		assert.Equal(t, "+OK\r\n", request(t, client, "WATCH", "foo"))
+		assert.Equal(t, "+OK\r\n", request(t, other, "SET", "bar", "changed"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "-ERR Command not allowed inside a transaction\r\n", request(t, client, "WATCH", "foo"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "DISCARD"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "+QUEUED\r\n", request(t, client, "GET", "foo"))
+		assert.Equal(t, "*1\r\n$7\r\nwatched\r\n", execRequest(t, client, 1))
+
+		// UNWATCH forgets them too, and so does the expiration of a key noticed.
+		assert.Equal(t, "+OK\r\n", request(t, client, "WATCH", "foo"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "UNWATCH"))
+		assert.Equal(t, "+OK\r\n", request(t, other, "SET", "foo", "changed"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "*0\r\n", request(t, client, "EXEC"))
+
+		assert.Equal(t, "+OK\r\n", request(t, client, "SET", "foo", "expiring", "PX", "50"))
+		assert.Equal(t, "+OK\r\n", request(t, client, "WATCH", "foo"))
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+		assert.Equal(t, "*-1", rawRequest(t, client, "EXEC"))
+	})
+}
+
+// rawRequest sends the request and returns the first line of the reply, for replies which ReadMessage doesn't
+// tell from others, such as the null array.
+func rawRequest(t *testing.T, c *Connection, args ...string) string {
+	t.Helper()
+
+	require.NoError(t, c.Write(NewArray(args)))
+	reply, err := c.Read()
+	require.NoError(t, err)
+	return reply
+}
+
+// execRequest sends EXEC and returns the RESP2 encoding of the reply, an array of n replies.
+func execRequest(t *testing.T, c *Connection, n int) string {
+	t.Helper()
+
+	require.NoError(t, c.Write(NewArray([]string{"EXEC"})))
+	header, err := c.Read()
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("*%d", n), header)
+
+	reply := header + "\r\n"
+	for i := 0; i < n; i++ {
+		msg, err := ReadMessage(c)
+		require.NoError(t, err)
+		reply += string(msg.Redis())
+	}
+	return reply
+}
+
+func TestTransaction_Propagation(t *testing.T) {
+	master, port := startTestServer(t, &config.Opts{})
+	replica, _ := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", port)})
+
+	require.Eventually(t, func() bool {
+		return replica.Info().MasterLinkStatus == "up"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	client := dialTestServer(t, port)
+	assert.Equal(t, "+OK\r\n", request(t, client, "MULTI"))
+	assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "foo", "1"))
+	assert.Equal(t, "+QUEUED\r\n", request(t, client, "GET", "foo"))
+	assert.Equal(t, "+QUEUED\r\n", request(t, client, "SET", "bar", "2"))
+	assert.Equal(t, "*3\r\n+OK\r\n$1\r\n1\r\n+OK\r\n", execRequest(t, client, 3))
+
+	// only the writes are propagated, wrapped in MULTI and EXEC.
+	want := NewTransaction([]Message{NewArray([]string{"SET", "foo", "1"}), NewArray([]string{"SET", "bar", "2"})})
+	assert.Equal(t, "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$1\r\n1\r\n*3\r\n$3\r\nSET\r\n$3\r\nbar\r\n$1\r\n2\r\n*1\r\n$4\r\nEXEC\r\n", string(want.Redis()))
+
+	require.Eventually(t, func() bool {
+		foo, _ := replica.cache.Get("foo")
+		bar, _ := replica.cache.Get("bar")
+		return foo != nil && bar != nil && replica.Info().MasterReplOffset == master.Info().MasterReplOffset
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,317 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+)
+
+// instance is a master or a slave monitored by the sentinel. Each instance has its own goroutine sending PING,
+// INFO and hello messages, and another one receiving the hello messages of the other sentinels.
+type instance struct {
+	addr string // host:port
+
+	lock        sync.Mutex
+	pingPending time.Time // the time we sent the oldest PING not replied yet, zero if none.
+	lastInfo    time.Time // the time the instance last replied to INFO.
+	info        instanceInfo
+	sub         *protocol.Connection // the connection subscribed to the hello channel, if any.
+
+	stopped chan struct{}
+}
+
+// instanceInfo is what we read from INFO replication.
+type instanceInfo struct {
+	role         string
+	masterHost   string // only for slaves.
+	masterPort   int    // only for slaves.
+	masterLinkUp bool   // only for slaves.
+	offset       int
+	slaves       []string // only for masters: the host:port of the slaves.
+}
+
+func newInstance(addr string) *instance {
+	return &instance{
+		addr:    addr,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Stop stops the goroutines of the instance.
+func (i *instance) Stop() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	close(i.stopped)
+	if i.sub != nil {
+		i.sub.Close()
+	}
+}
+
+func (i *instance) Stopped() bool {
+	select {
+	case <-i.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Down returns true if the instance hasn't replied to PING within the given period (SDOWN).
+func (i *instance) Down(downAfter time.Duration) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return !i.pingPending.IsZero() && time.Since(i.pingPending) > downAfter
+}
+
+// Info returns the last INFO of the instance, and when we got it.
+func (i *instance) Info() (instanceInfo, time.Time) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.info, i.lastInfo
+}
+
+// run sends PING, INFO and hello messages periodically until the instance is stopped.
+func (i *instance) run(s *Sentinel, name string) {
+	go i.runSubscriber(s)
+
+	var conn *protocol.Connection
+	var lastPing, lastInfo, lastHello time.Time
+
+	ticker := time.NewTicker(cronInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.stopped:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+
+		pingNow := time.Since(lastPing) >= s.pingPeriod()
+		if pingNow {
+			// an instance we cannot even connect to counts as not replying to PING.
+			lastPing = time.Now()
+			i.lock.Lock()
+			if i.pingPending.IsZero() {
+				i.pingPending = lastPing
+			}
+			i.lock.Unlock()
+		}
+
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", i.addr, commandTimeout)
+			if err != nil {
+				continue
+			}
+			conn = protocol.NewConnection(c)
+		}
+
+		var err error
+		switch {
+		case pingNow:
+			err = i.ping(conn)
+		case time.Since(lastInfo) >= s.infoPeriod(name):
+			lastInfo = time.Now()
+			err = i.refreshInfo(s, name, conn)
+		case time.Since(lastHello) >= helloPeriod:
+			lastHello = time.Now()
+			err = i.sendHello(s, name, conn)
+		}
+
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (i *instance) ping(conn *protocol.Connection) error {
+	reply, err := command(conn, "PING")
+	if err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+
+	if simple, ok := reply.(*protocol.SimpleMessage); ok && simple.Raw() == "PONG" {
+		i.lock.Lock()
+		i.pingPending = time.Time{}
+		i.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (i *instance) refreshInfo(s *Sentinel, name string, conn *protocol.Connection) error {
+	reply, err := command(conn, "INFO", "replication")
+	if err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+
+	bulk, ok := reply.(*protocol.BulkMessage)
+	if !ok {
+		return fmt.Errorf("unexpected reply to INFO: %q", reply.Redis())
+	}
+
+	info := parseInfo(bulk.Raw())
+
+	i.lock.Lock()
+	i.info = info
+	i.lastInfo = time.Now()
+	i.lock.Unlock()
+
+	s.onInfo(name, i, info)
+	return nil
+}
+
+func (i *instance) sendHello(s *Sentinel, name string, conn *protocol.Connection) error {
+	hello, ok := s.hello(name, conn.LocalAddr())
+	if !ok {
+		return nil
+	}
+
+	if _, err := command(conn, "PUBLISH", helloChannel, hello); err != nil {
+		return fmt.Errorf("command failed: %w", err)
+	}
+
+	return nil
+}
+
+// runSubscriber receives the hello messages published to the instance until the instance is stopped.
+func (i *instance) runSubscriber(s *Sentinel) {
+	for !i.Stopped() {
+		if err := i.subscribe(s); err != nil && !i.Stopped() {
+			fmt.Fprintf(os.Stderr, "[sentinel] subscription to %s failed: %v\n", i.addr, err)
+		}
+
+		select {
+		case <-i.stopped:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (i *instance) subscribe(s *Sentinel) error {
+	c, err := net.DialTimeout("tcp", i.addr, commandTimeout)
+	if err != nil {
+		return fmt.Errorf("net.DialTimeout failed: %w", err)
+	}
+
+	conn := protocol.NewConnection(c)
+	defer conn.Close()
+
+	i.lock.Lock()
+	if i.Stopped() {
+		i.lock.Unlock()
+		return nil
+	}
+	i.sub = conn
+	i.lock.Unlock()
+
+	if err := conn.Write(protocol.NewArray([]string{"SUBSCRIBE", helloChannel})); err != nil {
+		return fmt.Errorf("conn.Write failed: %w", err)
+	}
+
+	for {
+		reply, err := protocol.ReadMessage(conn)
+		if err != nil {
+			return fmt.Errorf("protocol.ReadMessage failed: %w", err)
+		}
+
+		// message <channel> <payload>
+		msg, ok := reply.(*protocol.ArrayMessage)
+		if !ok || msg.Len() != 3 || !protocol.CommandEquals(msg.Token(0), "message") {
+			continue
+		}
+
+		s.onHello(msg.Token(2))
+	}
+}
+
+// command sends the command to the connection and reads the reply, within commandTimeout.
+func command(conn *protocol.Connection, args ...string) (protocol.Message, error) {
+	if err := conn.SetDeadline(time.Now().Add(commandTimeout)); err != nil {
+		return nil, fmt.Errorf("conn.SetDeadline failed: %w", err)
+	}
+
+	if err := conn.Write(protocol.NewArray(args)); err != nil {
+		return nil, fmt.Errorf("conn.Write failed: %w", err)
+	}
+
+	reply, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.ReadMessage failed: %w", err)
+	}
+
+	return reply, nil
+}
+
+// commandTo sends one command to the given address on a new connection.
+func commandTo(addr string, args ...string) (protocol.Message, error) {
+	c, err := net.DialTimeout("tcp", addr, commandTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("net.DialTimeout failed: %w", err)
+	}
+
+	conn := protocol.NewConnection(c)
+	defer conn.Close()
+
+	return command(conn, args...)
+}
+
+// parseInfo parses the fields of INFO replication that the sentinel cares about.
+func parseInfo(text string) instanceInfo {
+	var info instanceInfo
+	for _, line := range strings.Split(text, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		switch {
+		case key == "role":
+			info.role = value
+		case key == "master_host":
+			info.masterHost = value
+		case key == "master_port":
+			info.masterPort, _ = strconv.Atoi(value)
+		case key == "master_link_status":
+			info.masterLinkUp = value == "up"
+		case key == "master_repl_offset":
+			info.offset, _ = strconv.Atoi(value)
+		case strings.HasPrefix(key, "slave") && isNumber(key[len("slave"):]):
+			// slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0
+			var ip, port string
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				switch k {
+				case "ip":
+					ip = v
+				case "port":
+					port = v
+				}
+			}
+
+			if ip != "" && port != "" {
+				info.slaves = append(info.slaves, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+
+	return info
+}
+
+func isNumber(str string) bool {
+	_, err := strconv.Atoi(str)
+	return err == nil
+}
@@ -0,0 +1,617 @@
+package sentinel
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/info"
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+)
+
+const (
+	// helloChannel is the channel of the monitored instances where the sentinels announce themselves.
+	helloChannel = "__sentinel__:hello"
+
+	// cronInterval is how often the sentinel checks its masters and the instances send their periodic commands.
+	cronInterval = 100 * time.Millisecond
+
+	// commandTimeout bounds connecting to, and waiting for the reply from an instance or another sentinel.
+	commandTimeout = time.Second
+
+	pingPeriod         = time.Second
+	infoPeriod         = 10 * time.Second
+	infoPeriodFailover = time.Second // INFO period while the master is down, to follow the failover closely.
+	helloPeriod        = 2 * time.Second
+	askPeriod          = time.Second // how often to ask the other sentinels whether the master is down.
+
+	// peerTimeout is how long a sentinel is considered alive after its last hello.
+	peerTimeout = 5 * helloPeriod
+
+	// maxDesync is the maximum random delay before starting an election, so that the sentinels
+	// detecting ODOWN at the same time don't split the votes every time.
+	maxDesync = time.Second
+)
+
+// Sentinel monitors masters and their slaves, and fails over a master which is objectively down (ODOWN),
+// that is, considered down by at least quorum sentinels.
+type Sentinel struct {
+	lock sync.Mutex
+
+	opts         *config.Opts
+	runID        string
+	currentEpoch uint64
+	masters      map[string]*master
+
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+}
+
+// master is a monitored master, with its slaves and the other sentinels monitoring it.
+type master struct {
+	name        string
+	quorum      int
+	addr        string // host:port
+	configEpoch uint64 // the epoch of the failover which made addr the master.
+
+	inst     *instance
+	replicas map[string]*instance // by host:port.
+	peers    map[string]*peer     // by run ID.
+
+	odown   bool
+	lastAsk time.Time // the time we last asked the other sentinels about the master.
+
+	// our vote for the failover leader of leaderEpoch.
+	leader      string
+	leaderEpoch uint64
+
+	failingOver   bool
+	failoverStart time.Time // the time we last started (or voted for) a failover.
+}
+
+// peer is another sentinel monitoring the same master.
+type peer struct {
+	addr      string
+	runID     string
+	lastHello time.Time
+
+	masterDown   bool // the last reply to SENTINEL IS-MASTER-DOWN-BY-ADDR.
+	lastDownTime time.Time
+}
+
+func New(opts *config.Opts) (*Sentinel, error) {
+	runID, err := config.NewReplicationID()
+	if err != nil {
+		return nil, fmt.Errorf("config.NewReplicationID failed: %w", err)
+	}
+
+	s := &Sentinel{
+		opts:            opts,
+		runID:           runID,
+		masters:         make(map[string]*master),
+		downAfter:       time.Duration(opts.SentinelDownAfter) * time.Millisecond,
+		failoverTimeout: time.Duration(opts.SentinelFailoverTimeout) * time.Millisecond,
+	}
+
+	for _, m := range opts.Monitors {
+		s.masters[m.Name] = &master{
+			name:     m.Name,
+			quorum:   m.Quorum,
+			addr:     net.JoinHostPort(m.IP.String(), strconv.Itoa(m.Port)),
+			replicas: make(map[string]*instance),
+			peers:    make(map[string]*peer),
+		}
+	}
+
+	return s, nil
+}
+
+// Start starts monitoring the masters.
+func (s *Sentinel) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, m := range s.masters {
+		m.inst = newInstance(m.addr)
+		go m.inst.run(s, name)
+	}
+
+	go func() {
+		for range time.Tick(cronInterval) {
+			s.cron()
+		}
+	}()
+}
+
+func (s *Sentinel) pingPeriod() time.Duration {
+	return min(pingPeriod, s.downAfter)
+}
+
+func (s *Sentinel) infoPeriod(name string) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok := s.masters[name]; ok && (m.failingOver || m.inst.Down(s.downAfter)) {
+		return infoPeriodFailover
+	}
+	return infoPeriod
+}
+
+// cron checks whether the masters are down, and starts failovers.
+func (s *Sentinel) cron() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, m := range s.masters {
+		for runID, p := range m.peers {
+			if time.Since(p.lastHello) > peerTimeout {
+				delete(m.peers, runID)
+			}
+		}
+
+		if !m.inst.Down(s.downAfter) {
+			m.odown = false
+			continue
+		}
+
+		if time.Since(m.lastAsk) >= askPeriod {
+			m.lastAsk = time.Now()
+			go s.askMasterDown(name)
+		}
+
+		votes := 1 // ours.
+		for _, p := range m.peers {
+			if p.masterDown && time.Since(p.lastDownTime) < 5*askPeriod {
+				votes++
+			}
+		}
+
+		if odown := votes >= m.quorum; odown != m.odown {
+			fmt.Fprintf(os.Stderr, "[sentinel] master %s %s: odown=%v\n", name, m.addr, odown)
+			m.odown = odown
+		}
+
+		if m.odown && !m.failingOver && time.Since(m.failoverStart) > s.failoverTimeout {
+			m.failingOver = true
+			m.failoverStart = time.Now()
+			go s.failover(name)
+		}
+	}
+}
+
+// askMasterDown asks the other sentinels whether they consider the master down as well.
+func (s *Sentinel) askMasterDown(name string) {
+	s.lock.Lock()
+	m, ok := s.masters[name]
+	if !ok {
+		s.lock.Unlock()
+		return
+	}
+	host, port, _ := net.SplitHostPort(m.addr)
+	peers := m.peerAddrs()
+	epoch := s.currentEpoch
+	s.lock.Unlock()
+
+	for runID, addr := range peers {
+		reply, err := commandTo(addr, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatUint(epoch, 10), "*")
+		if err != nil {
+			continue
+		}
+
+		down, _, _, err := parseMasterDownReply(reply)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[sentinel] parseMasterDownReply failed: %v\n", err)
+			continue
+		}
+
+		s.lock.Lock()
+		if p, ok := m.peers[runID]; ok {
+			p.masterDown = down
+			p.lastDownTime = time.Now()
+		}
+		s.lock.Unlock()
+	}
+}
+
+// failover is started when the master is ODOWN. We get elected as the leader by the majority of the sentinels
+// first, and then promote the best slave and make the other slaves replicate from it.
+func (s *Sentinel) failover(name string) {
+	defer func() {
+		s.lock.Lock()
+		if m, ok := s.masters[name]; ok {
+			m.failingOver = false
+		}
+		s.lock.Unlock()
+	}()
+
+	time.Sleep(randomDuration(maxDesync))
+
+	s.lock.Lock()
+	m, ok := s.masters[name]
+	if !ok || !m.odown || (m.leader != "" && m.leader != s.runID && m.leaderEpoch == s.currentEpoch) {
+		// the master is back, or we've just voted for another sentinel.
+		s.lock.Unlock()
+		return
+	}
+
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	m.leader, m.leaderEpoch = s.runID, epoch
+	host, port, _ := net.SplitHostPort(m.addr)
+	peers := m.peerAddrs()
+	quorum := m.quorum
+	s.lock.Unlock()
+
+	fmt.Fprintf(os.Stderr, "[sentinel] master %s: starting the election for epoch %d\n", name, epoch)
+
+	votes := 1 // ours.
+	for _, addr := range peers {
+		reply, err := commandTo(addr, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatUint(epoch, 10), s.runID)
+		if err != nil {
+			continue
+		}
+
+		_, leader, leaderEpoch, err := parseMasterDownReply(reply)
+		if err == nil && leader == s.runID && leaderEpoch == epoch {
+			votes++
+		}
+	}
+
+	if needed := max(quorum, (len(peers)+1)/2+1); votes < needed {
+		fmt.Fprintf(os.Stderr, "[sentinel] master %s: not elected for epoch %d: %d/%d votes\n", name, epoch, votes, needed)
+		return
+	}
+
+	promoted, err := s.promoteReplica(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[sentinel] master %s: failover failed: %v\n", name, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok := s.masters[name]; ok {
+		fmt.Fprintf(os.Stderr, "[sentinel] master %s: switched from %s to %s\n", name, m.addr, promoted)
+		s.switchMaster(m, promoted, epoch)
+	}
+}
+
+// promoteReplica turns the best slave into the master, and makes the other slaves replicate from it.
+// It returns the host:port of the new master.
+func (s *Sentinel) promoteReplica(name string) (string, error) {
+	s.lock.Lock()
+	m, ok := s.masters[name]
+	if !ok {
+		s.lock.Unlock()
+		return "", fmt.Errorf("unknown master")
+	}
+
+	best := m.bestReplica(s.downAfter)
+	others := make([]string, 0, len(m.replicas))
+	for addr := range m.replicas {
+		if best == nil || addr != best.addr {
+			others = append(others, addr)
+		}
+	}
+	s.lock.Unlock()
+
+	if best == nil {
+		return "", fmt.Errorf("no good slave to promote")
+	}
+
+	if _, err := commandTo(best.addr, "REPLICAOF", "NO", "ONE"); err != nil {
+		return "", fmt.Errorf("REPLICAOF NO ONE failed: %w", err)
+	}
+
+	// wait until the slave reports itself as the master.
+	deadline := time.Now().Add(s.failoverTimeout)
+	for {
+		reply, err := commandTo(best.addr, "INFO", "replication")
+		if bulk, ok := reply.(*protocol.BulkMessage); err == nil && ok && parseInfo(bulk.Raw()).role == "master" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("the promoted slave %s didn't turn into the master", best.addr)
+		}
+		time.Sleep(cronInterval)
+	}
+
+	host, port, _ := net.SplitHostPort(best.addr)
+	for _, addr := range others {
+		if _, err := commandTo(addr, "REPLICAOF", host, port); err != nil {
+			// the slave is reconfigured later, when it reports the wrong master in INFO.
+			fmt.Fprintf(os.Stderr, "[sentinel] REPLICAOF to %s failed: %v\n", addr, err)
+		}
+	}
+
+	return best.addr, nil
+}
+
+// switchMaster makes addr the master of the given name. The old master is kept as a slave, so that it is
+// reconfigured once it's back. It should be called with the lock held.
+func (s *Sentinel) switchMaster(m *master, addr string, epoch uint64) {
+	replicas := []string{m.addr}
+	for a, inst := range m.replicas {
+		inst.Stop()
+		if a != addr {
+			replicas = append(replicas, a)
+		}
+	}
+	m.inst.Stop()
+
+	m.addr = addr
+	m.configEpoch = epoch
+	m.odown = false
+	for _, p := range m.peers {
+		p.masterDown = false
+	}
+
+	m.inst = newInstance(addr)
+	go m.inst.run(s, m.name)
+
+	m.replicas = make(map[string]*instance)
+	for _, a := range replicas {
+		m.addReplica(s, a)
+	}
+}
+
+// onInfo is called whenever an instance replies to INFO.
+func (s *Sentinel) onInfo(name string, inst *instance, info instanceInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.masters[name]
+	if !ok || inst.Stopped() {
+		return
+	}
+
+	if inst == m.inst {
+		// discover the slaves of the master.
+		for _, addr := range info.slaves {
+			if _, ok := m.replicas[addr]; !ok && addr != m.addr {
+				m.addReplica(s, addr)
+			}
+		}
+		return
+	}
+
+	// a slave reporting a wrong master (such as the old master coming back after a failover) is reconfigured,
+	// as long as the master we know is healthy.
+	if m.failingOver || m.inst.Down(s.downAfter) {
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(m.addr)
+	if info.role == "master" || (info.role == "slave" && net.JoinHostPort(info.masterHost, strconv.Itoa(info.masterPort)) != m.addr) {
+		fmt.Fprintf(os.Stderr, "[sentinel] reconfiguring %s as a slave of %s\n", inst.addr, m.addr)
+		go func() {
+			if _, err := commandTo(inst.addr, "REPLICAOF", host, port); err != nil {
+				fmt.Fprintf(os.Stderr, "[sentinel] REPLICAOF to %s failed: %v\n", inst.addr, err)
+			}
+		}()
+	}
+}
+
+// hello returns the hello message announcing this sentinel and its config of the master:
+// <ip>,<port>,<run id>,<current epoch>,<master name>,<master ip>,<master port>,<master config epoch>.
+func (s *Sentinel) hello(name string, local net.Addr) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.masters[name]
+	if !ok {
+		return "", false
+	}
+
+	ip := "127.0.0.1"
+	if tcp, ok := local.(*net.TCPAddr); ok {
+		ip = tcp.IP.String()
+	}
+	host, port, _ := net.SplitHostPort(m.addr)
+
+	return strings.Join([]string{
+		ip, strconv.Itoa(s.opts.Port), s.runID, strconv.FormatUint(s.currentEpoch, 10),
+		m.name, host, port, strconv.FormatUint(m.configEpoch, 10),
+	}, ","), true
+}
+
+// onHello is called with the hello messages from the other sentinels.
+func (s *Sentinel) onHello(hello string) {
+	tokens := strings.Split(hello, ",")
+	if len(tokens) != 8 {
+		return
+	}
+
+	runID := tokens[2]
+	currentEpoch, err1 := strconv.ParseUint(tokens[3], 10, 64)
+	configEpoch, err2 := strconv.ParseUint(tokens[7], 10, 64)
+	if err1 != nil || err2 != nil || runID == s.runID {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.masters[tokens[4]]
+	if !ok {
+		return
+	}
+
+	addr := net.JoinHostPort(tokens[0], tokens[1])
+	for id, p := range m.peers {
+		if p.addr == addr && id != runID {
+			// the sentinel restarted with a new run ID.
+			delete(m.peers, id)
+		}
+	}
+
+	p, ok := m.peers[runID]
+	if !ok {
+		p = &peer{runID: runID}
+		m.peers[runID] = p
+	}
+	p.addr = addr
+	p.lastHello = time.Now()
+
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+	}
+
+	// the config with the greater epoch wins: another sentinel has failed over the master.
+	masterAddr := net.JoinHostPort(tokens[5], tokens[6])
+	if configEpoch > m.configEpoch {
+		if masterAddr != m.addr {
+			fmt.Fprintf(os.Stderr, "[sentinel] master %s: switched from %s to %s by epoch %d\n", m.name, m.addr, masterAddr, configEpoch)
+			s.switchMaster(m, masterAddr, configEpoch)
+		} else {
+			m.configEpoch = configEpoch
+		}
+	}
+}
+
+// isMasterDownByAddr answers SENTINEL IS-MASTER-DOWN-BY-ADDR. If runID is not "*", the sentinel asks for our vote
+// for the failover leader of the epoch. We vote for the first sentinel asking in each epoch.
+func (s *Sentinel) isMasterDownByAddr(addr string, epoch uint64, runID string) (bool, string, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.addr == addr {
+			m = candidate
+		}
+	}
+	if m == nil {
+		return false, "*", 0
+	}
+
+	down := m.inst.Down(s.downAfter)
+	if runID == "*" {
+		return down, "*", 0
+	}
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+
+	if m.leaderEpoch < epoch && epoch >= s.currentEpoch {
+		m.leader, m.leaderEpoch = runID, epoch
+		if runID != s.runID {
+			// give the leader time to fail over, before we try on our own.
+			m.failoverStart = time.Now()
+		}
+	}
+
+	return down, m.leader, m.leaderEpoch
+}
+
+// Info returns the sentinel section of INFO.
+func (s *Sentinel) Info() info.Sentinel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := info.Sentinel{}
+	for _, name := range s.masterNames() {
+		m := s.masters[name]
+
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.inst.Down(s.downAfter) {
+			status = "sdown"
+		}
+
+		res.Masters = append(res.Masters, info.SentinelMaster{
+			Name:      name,
+			Status:    status,
+			Address:   m.addr,
+			Slaves:    len(m.replicas),
+			Sentinels: len(m.peers) + 1,
+		})
+	}
+
+	return res
+}
+
+// masterNames returns the names of the masters in order. It should be called with the lock held.
+func (s *Sentinel) masterNames() []string {
+	return sortedKeys(s.masters)
+}
+
+// addReplica starts monitoring the slave. It should be called with the lock held.
+func (m *master) addReplica(s *Sentinel, addr string) {
+	inst := newInstance(addr)
+	m.replicas[addr] = inst
+	go inst.run(s, m.name)
+}
+
+// peerAddrs returns the addresses of the other sentinels by their run IDs. It should be called with the lock held.
+func (m *master) peerAddrs() map[string]string {
+	addrs := make(map[string]string, len(m.peers))
+	for runID, p := range m.peers {
+		addrs[runID] = p.addr
+	}
+
+	return addrs
+}
+
+// bestReplica returns the slave to promote: the one alive with the greatest replication offset. It should be
+// called with the lock held.
+func (m *master) bestReplica(downAfter time.Duration) *instance {
+	var best *instance
+	var bestOffset int
+	for _, addr := range sortedKeys(m.replicas) {
+		inst := m.replicas[addr]
+		info, lastInfo := inst.Info()
+		if inst.Down(downAfter) || info.role != "slave" || time.Since(lastInfo) > 3*infoPeriod {
+			continue
+		}
+
+		if best == nil || info.offset > bestOffset {
+			best, bestOffset = inst, info.offset
+		}
+	}
+
+	return best
+}
+
+// parseMasterDownReply parses the reply to SENTINEL IS-MASTER-DOWN-BY-ADDR: <down> <leader run id> <leader epoch>.
+func parseMasterDownReply(reply protocol.Message) (bool, string, uint64, error) {
+	arr, ok := reply.(*protocol.NestedArrayMessage)
+	if !ok || len(arr.Items()) != 3 {
+		return false, "", 0, fmt.Errorf("unexpected reply: %q", reply.Redis())
+	}
+
+	down, ok1 := arr.Items()[0].(*protocol.IntMessage)
+	leader, ok2 := arr.Items()[1].(*protocol.BulkMessage)
+	epoch, ok3 := arr.Items()[2].(*protocol.IntMessage)
+	if !ok1 || !ok2 || !ok3 {
+		return false, "", 0, fmt.Errorf("unexpected reply: %q", reply.Redis())
+	}
+
+	return down.Raw() == 1, leader.Raw(), uint64(epoch.Raw()), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// randomDuration returns a random duration in [0, d).
+func randomDuration(d time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(d)))
+}
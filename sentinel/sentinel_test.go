@@ -0,0 +1,156 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/config"
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+	"github.com/codecrafters-io/redis-starter-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is a data server on a random local port, which can be killed to simulate a crash.
+type testServer struct {
+	l    net.Listener
+	port int
+	repl *protocol.Replication
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func startTestServer(t *testing.T, opts *config.Opts) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	opts.Port = l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, opts.Evaluate())
+
+	cache := storage.NewCache()
+	ts := &testServer{l: l, port: opts.Port, repl: protocol.NewReplication(opts, cache, nil)}
+	state := protocol.NewState()
+	ts.repl.Start(state)
+	t.Cleanup(ts.Kill)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			ts.lock.Lock()
+			ts.conns = append(ts.conns, c)
+			ts.lock.Unlock()
+
+			go protocol.NewServer(protocol.NewConnection(c), opts, cache, ts.repl, state).Handle()
+		}
+	}()
+
+	return ts
+}
+
+// Kill stops accepting connections, and closes the ones accepted so far.
+func (ts *testServer) Kill() {
+	ts.l.Close()
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	for _, c := range ts.conns {
+		c.Close()
+	}
+}
+
+func startTestSentinel(t *testing.T, monitor string) *Sentinel {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	opts := &config.Opts{
+		Port:                    l.Addr().(*net.TCPAddr).Port,
+		Sentinel:                true,
+		SentinelMonitor:         []string{monitor},
+		SentinelDownAfter:       500,
+		SentinelFailoverTimeout: 3000,
+	}
+	require.NoError(t, opts.Evaluate())
+
+	s, err := New(opts)
+	require.NoError(t, err)
+	s.Start()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.Handle(protocol.NewConnection(c))
+		}
+	}()
+
+	return s
+}
+
+func TestSentinel_Failover(t *testing.T) {
+	master := startTestServer(t, &config.Opts{})
+	replica := startTestServer(t, &config.Opts{ReplicaOf: fmt.Sprintf("127.0.0.1 %d", master.port)})
+
+	monitor := fmt.Sprintf("mymaster 127.0.0.1 %d 2", master.port)
+	sentinels := []*Sentinel{startTestSentinel(t, monitor), startTestSentinel(t, monitor), startTestSentinel(t, monitor)}
+
+	// the sentinels discover the slave through INFO, and each other through the hello messages.
+	require.Eventually(t, func() bool {
+		for _, s := range sentinels {
+			m := s.Info().Masters[0]
+			if m.Slaves != 1 || m.Sentinels != 3 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+
+	master.Kill()
+
+	require.Eventually(t, func() bool {
+		return replica.repl.Role() == "master"
+	}, 20*time.Second, 100*time.Millisecond)
+
+	// every sentinel follows the new master, through the hello messages of the leader.
+	want := net.JoinHostPort("127.0.0.1", strconv.Itoa(replica.port))
+	require.Eventually(t, func() bool {
+		for _, s := range sentinels {
+			if s.Info().Masters[0].Address != want {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestParseInfo(t *testing.T) {
+	info := parseInfo("# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+		"slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0\r\n" +
+		"slave1:ip=127.0.0.1,port=6381,state=wait_bgsave,offset=0,lag=1\r\n" +
+		"master_repl_offset:42")
+
+	assert.Equal(t, "master", info.role)
+	assert.Equal(t, 42, info.offset)
+	assert.Equal(t, []string{"127.0.0.1:6380", "127.0.0.1:6381"}, info.slaves)
+
+	info = parseInfo("# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\n" +
+		"master_link_status:up\r\nconnected_slaves:0\r\nmaster_repl_offset:14")
+
+	assert.Equal(t, "slave", info.role)
+	assert.Equal(t, "127.0.0.1", info.masterHost)
+	assert.Equal(t, 6379, info.masterPort)
+	assert.True(t, info.masterLinkUp)
+	assert.Equal(t, 14, info.offset)
+}
@@ -0,0 +1,194 @@
+package sentinel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/protocol"
+)
+
+// Handle serves the commands of a client (or another sentinel) connected to the sentinel.
+func (s *Sentinel) Handle(conn *protocol.Connection) error {
+	defer conn.Close()
+
+	for {
+		request, err := protocol.ReadRequest(conn)
+		if err != nil {
+			var pe *protocol.ProtocolError
+			if errors.As(err, &pe) {
+				_ = conn.Write(protocol.NewError("ERR " + pe.Error()))
+			}
+			return fmt.Errorf("protocol.ReadRequest failed: %w", err)
+		}
+
+		msg, ok := request.(*protocol.ArrayMessage)
+		if !ok {
+			return fmt.Errorf("couldn't understand request: %v", request)
+		}
+		if msg.Len() == 0 {
+			// an empty inline command.
+			continue
+		}
+
+		if err := conn.Write(s.process(msg)); err != nil {
+			err = fmt.Errorf("conn.Write failed: %w", err)
+			fmt.Fprintln(os.Stderr, err.Error())
+			return err
+		}
+	}
+}
+
+// process returns the reply to the request.
+func (s *Sentinel) process(msg *protocol.ArrayMessage) protocol.Message {
+	switch strings.ToUpper(msg.Token(0)) {
+	case "PING":
+		return protocol.PONG
+
+	case "INFO":
+		return protocol.NewBulk(strings.Join(s.Info().Info(), "\r\n"))
+
+	case "SENTINEL":
+		if msg.Len() < 2 {
+			return protocol.NewArityError("sentinel")
+		}
+		return s.processSentinel(strings.ToUpper(msg.Token(1)), msg.SliceFrom(2))
+	}
+
+	return protocol.NewUnknownCommandError(msg.Raw())
+}
+
+func (s *Sentinel) processSentinel(cmd string, args []string) protocol.Message {
+	switch cmd {
+	case "MYID":
+		return protocol.NewBulk(s.runID)
+
+	case "MASTERS":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		masters := make([]protocol.Message, 0, len(s.masters))
+		for _, name := range s.masterNames() {
+			masters = append(masters, protocol.NewArray(s.masterFields(s.masters[name])))
+		}
+		return protocol.NewNestedArray(masters)
+
+	case "MASTER", "GET-MASTER-ADDR-BY-NAME", "REPLICAS", "SLAVES", "SENTINELS":
+		if len(args) != 1 {
+			return protocol.NewError(fmt.Sprintf("ERR wrong number of arguments for 'sentinel %s' command", strings.ToLower(cmd)))
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		m, ok := s.masters[args[0]]
+		if !ok {
+			if cmd == "GET-MASTER-ADDR-BY-NAME" {
+				return protocol.NULL
+			}
+			return protocol.NewError("ERR No such master with that name")
+		}
+
+		switch cmd {
+		case "MASTER":
+			return protocol.NewArray(s.masterFields(m))
+		case "GET-MASTER-ADDR-BY-NAME":
+			host, port, _ := net.SplitHostPort(m.addr)
+			return protocol.NewArray([]string{host, port})
+		case "REPLICAS", "SLAVES":
+			replicas := make([]protocol.Message, 0, len(m.replicas))
+			for _, addr := range sortedKeys(m.replicas) {
+				replicas = append(replicas, protocol.NewArray(s.replicaFields(m.replicas[addr])))
+			}
+			return protocol.NewNestedArray(replicas)
+		default: // SENTINELS
+			peers := make([]protocol.Message, 0, len(m.peers))
+			for _, runID := range sortedKeys(m.peers) {
+				p := m.peers[runID]
+				host, port, _ := net.SplitHostPort(p.addr)
+				peers = append(peers, protocol.NewArray([]string{"name", p.addr, "ip", host, "port", port, "runid", p.runID}))
+			}
+			return protocol.NewNestedArray(peers)
+		}
+
+	case "IS-MASTER-DOWN-BY-ADDR":
+		// IS-MASTER-DOWN-BY-ADDR <ip> <port> <current epoch> <run id>
+		if len(args) != 4 {
+			return protocol.NewArityError("sentinel|is-master-down-by-addr")
+		}
+
+		epoch, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return protocol.NewError("ERR invalid epoch")
+		}
+
+		down, leader, leaderEpoch := s.isMasterDownByAddr(net.JoinHostPort(args[0], args[1]), epoch, args[3])
+
+		var downInt int
+		if down {
+			downInt = 1
+		}
+		return protocol.NewNestedArray([]protocol.Message{
+			protocol.NewInt(downInt), protocol.NewBulk(leader), protocol.NewInt(int(leaderEpoch)),
+		})
+	}
+
+	return protocol.NewError(fmt.Sprintf("ERR unknown sentinel subcommand '%s'", cmd))
+}
+
+// masterFields returns the status of the master as field-value pairs. It should be called with the lock held.
+func (s *Sentinel) masterFields(m *master) []string {
+	host, port, _ := net.SplitHostPort(m.addr)
+
+	flags := "master"
+	if m.inst.Down(s.downAfter) {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failingOver {
+		flags += ",failover_in_progress"
+	}
+
+	return []string{
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.peers)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+	}
+}
+
+// replicaFields returns the status of the slave as field-value pairs. It should be called with the lock held.
+func (s *Sentinel) replicaFields(inst *instance) []string {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	info, _ := inst.Info()
+
+	flags := "slave"
+	if inst.Down(s.downAfter) {
+		flags += ",s_down"
+	}
+
+	linkStatus := "err"
+	if info.masterLinkUp {
+		linkStatus = "ok"
+	}
+
+	return []string{
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"master-host", info.masterHost,
+		"master-port", strconv.Itoa(info.masterPort),
+		"master-link-status", linkStatus,
+		"slave-repl-offset", strconv.Itoa(info.offset),
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AOF is the append-only file. Each appended command is tagged with the replication offset right after it,
+// so that we can tell up to which offset the data is fsynced. The file starts with the RDB of the data set it
+// was created from, like the RDB preamble of Redis, and the commands build on it.
+type AOF struct {
+	lock  sync.Mutex
+	path  string
+	f     *os.File
+	fsync string // always, everysec or no.
+	dirty bool   // true if something is written but not fsynced yet.
+
+	writtenOffset uint64
+	fsyncedOffset uint64
+
+	// synced is closed (and replaced) whenever fsyncedOffset advances.
+	synced chan struct{}
+}
+
+// OpenAOF opens the append-only file with the given fsync policy. With everysec, the file is fsynced
+// by a background goroutine.
+func OpenAOF(path, fsync string) (*AOF, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("file open failed: %w", err)
+	}
+
+	aof := &AOF{
+		path:   path,
+		f:      f,
+		fsync:  fsync,
+		synced: make(chan struct{}),
+	}
+
+	if fsync == "everysec" {
+		go func() {
+			for range time.Tick(time.Second) {
+				if err := aof.Sync(); err != nil {
+					fmt.Fprintf(os.Stderr, "aof.Sync failed: %v\n", err)
+				}
+			}
+		}()
+	}
+
+	return aof, nil
+}
+
+// Append writes the payload (which can be empty for the commands not changing the data) to the file, and records
+// the given replication offset as written. The written offset never goes backwards.
+func (a *AOF) Append(payload []byte, offset uint64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(payload) > 0 {
+		if _, err := a.f.Write(payload); err != nil {
+			return fmt.Errorf("f.Write failed: %w", err)
+		}
+		a.dirty = true
+	}
+	if offset > a.writtenOffset {
+		a.writtenOffset = offset
+	}
+
+	switch {
+	case !a.dirty:
+		// nothing to fsync: the offset is as durable as the previous one.
+		a.advance()
+	case a.fsync == "always":
+		return a.sync()
+	case a.fsync == "no":
+		// we leave fsync to the OS, so the data is considered durable once written.
+		a.advance()
+	}
+
+	return nil
+}
+
+// Rewrite replaces the file with the RDB of the cache, for the commands appended afterwards to build on. The
+// offsets start over from the given one, as the writes in the file may be of another replication history, such
+// as before a full resync. The new file is written aside first, so that a failure keeps the old one.
+func (a *AOF) Rewrite(cache *Cache, offset uint64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return fmt.Errorf("file create failed: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	if err := WriteRDB(w, cache); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("file write failed: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("file sync failed: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("file rename failed: %w", err)
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("file open failed: %w", err)
+	}
+	a.f.Close()
+	a.f = f
+
+	a.dirty = false
+	a.writtenOffset = offset
+	a.fsyncedOffset = offset
+	close(a.synced)
+	a.synced = make(chan struct{})
+
+	return nil
+}
+
+// Path returns the path of the file, to replay it at startup.
+func (a *AOF) Path() string {
+	return a.path
+}
+
+// Empty returns true if nothing is written to the file yet, such as when it's just created.
+func (a *AOF) Empty() (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	info, err := a.f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("file stat failed: %w", err)
+	}
+
+	return info.Size() == 0, nil
+}
+
+// Sync fsyncs the file.
+func (a *AOF) Sync() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.sync()
+}
+
+// FsyncedOffset returns the replication offset up to which the data is fsynced.
+func (a *AOF) FsyncedOffset() uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.fsyncedOffset
+}
+
+// WaitFsynced waits until the data up to the offset is fsynced, or the deadline passes. Zero deadline means
+// waiting forever. It returns true if the offset is fsynced.
+func (a *AOF) WaitFsynced(offset uint64, deadline time.Time) bool {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		a.lock.Lock()
+		fsynced, synced := a.fsyncedOffset, a.synced
+		a.lock.Unlock()
+
+		if fsynced >= offset {
+			return true
+		}
+
+		select {
+		case <-synced:
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// sync should be called with the lock held.
+func (a *AOF) sync() error {
+	if a.dirty {
+		if err := a.f.Sync(); err != nil {
+			return fmt.Errorf("f.Sync failed: %w", err)
+		}
+		a.dirty = false
+	}
+	a.advance()
+
+	return nil
+}
+
+// advance should be called with the lock held.
+func (a *AOF) advance() {
+	if a.fsyncedOffset >= a.writtenOffset {
+		return
+	}
+
+	a.fsyncedOffset = a.writtenOffset
+	close(a.synced)
+	a.synced = make(chan struct{})
+}
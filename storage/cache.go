@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"sync"
 	"time"
 )
 
@@ -15,7 +16,22 @@ func GetCache() *Cache {
 }
 
 type Cache struct {
+	lock    sync.Mutex
 	entries map[string]*entry
+
+	// watchers counts the clients watching each key, and modified is the version of the last modification of
+	// the watched keys. version is bumped by each modification of a watched key.
+	watchers map[string]int
+	modified map[string]uint64
+	version  uint64
+
+	// exec lets a transaction run while no other command does.
+	exec sync.RWMutex
+
+	// libraries are the code of the function libraries, by library name. They are saved in the RDB along with
+	// the keys. librariesVersion is bumped by each change of the libraries.
+	libraries        map[string]string
+	librariesVersion uint64
 }
 
 type entry struct {
@@ -25,12 +41,23 @@ type entry struct {
 
 func NewCache() *Cache {
 	return &Cache{
-		entries: make(map[string]*entry),
+		entries:   make(map[string]*entry),
+		watchers:  make(map[string]int),
+		modified:  make(map[string]uint64),
+		libraries: make(map[string]string),
 	}
 }
 
 func (c *Cache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.entries = make(map[string]*entry)
+	c.libraries = make(map[string]string)
+	c.librariesVersion++
+	for key := range c.watchers {
+		c.touch(key)
+	}
 }
 
 func (c *Cache) Set(key, value string, expireAfter int64) error {
@@ -43,19 +70,30 @@ func (c *Cache) Set(key, value string, expireAfter int64) error {
 		e.expireAt = time.Now().UnixMilli() + expireAfter
 	}
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.entries[key] = e
+	c.touch(key)
 	return nil
 }
 
 func (c *Cache) SetExpireAt(key, value string, expireAt int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.entries[key] = &entry{
 		value:    &value,
 		expireAt: expireAt,
 	}
+	c.touch(key)
 	return nil
 }
 
 func (c *Cache) Get(key string) (*string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	e, ok := c.entries[key]
 	if !ok {
 		return nil, nil
@@ -66,14 +104,213 @@ func (c *Cache) Get(key string) (*string, error) {
 	}
 
 	delete(c.entries, key)
+	c.touch(key)
 
 	return nil, nil
 }
 
+// GetWithExpireAt returns the value and its expiration time in unix milliseconds, 0 if the value doesn't expire.
+// The value is nil if the key doesn't exist.
+func (c *Cache) GetWithExpireAt(key string) (*string, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, 0
+	}
+
+	if e.expireAt != 0 && e.expireAt < time.Now().UnixMilli() {
+		delete(c.entries, key)
+		c.touch(key)
+		return nil, 0
+	}
+
+	return e.value, e.expireAt
+}
+
+// Delete removes the keys, and returns the number of the keys that existed.
+func (c *Cache) Delete(keys ...string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().UnixMilli()
+	deleted := 0
+	for _, key := range keys {
+		e, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+
+		delete(c.entries, key)
+		c.touch(key)
+		if e.expireAt == 0 || e.expireAt >= now {
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
 func (c *Cache) Keys() ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	result := make([]string, 0, len(c.entries))
 	for k := range c.entries {
 		result = append(result, k)
 	}
 	return result, nil
 }
+
+// Snapshot returns a point-in-time copy of the cache, without the expired entries.
+func (c *Cache) Snapshot() *Cache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().UnixMilli()
+	snapshot := NewCache()
+	for k, e := range c.entries {
+		if e.expireAt != 0 && e.expireAt < now {
+			continue
+		}
+		snapshot.entries[k] = e // entries are never modified in place, so they can be shared.
+	}
+	for name, code := range c.libraries {
+		snapshot.libraries[name] = code
+	}
+
+	return snapshot
+}
+
+// ForEach calls f for each entry. expireAt is 0 if the entry doesn't expire. f must not call other Cache methods.
+func (c *Cache) ForEach(f func(key, value string, expireAt int64)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for k, e := range c.entries {
+		f(k, *e.value, e.expireAt)
+	}
+}
+
+// Len returns the number of entries, including the expired ones not evicted yet.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.entries)
+}
+
+// Libraries returns a copy of the function libraries, by library name.
+func (c *Cache) Libraries() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	libraries := make(map[string]string, len(c.libraries))
+	for name, code := range c.libraries {
+		libraries[name] = code
+	}
+	return libraries
+}
+
+// SetLibraries replaces all the function libraries, and returns their new version.
+func (c *Cache) SetLibraries(libraries map[string]string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.libraries = make(map[string]string, len(libraries))
+	for name, code := range libraries {
+		c.libraries[name] = code
+	}
+	c.librariesVersion++
+	return c.librariesVersion
+}
+
+// SetLibrary adds or replaces the function library.
+func (c *Cache) SetLibrary(name, code string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.libraries[name] = code
+	c.librariesVersion++
+}
+
+// LibrariesVersion returns the version of the function libraries, which changes whenever they do.
+func (c *Cache) LibrariesVersion() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.librariesVersion
+}
+
+// Watch starts watching the keys for Modified, like WATCH of Redis. It returns the version to give to Modified.
+// Each Watch must be followed by Unwatch of the same keys.
+func (c *Cache) Watch(keys ...string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().UnixMilli()
+	for _, key := range keys {
+		// a key already expired is evicted first, so that it's not modified by expiring later.
+		if e, ok := c.entries[key]; ok && e.expireAt != 0 && e.expireAt < now {
+			delete(c.entries, key)
+			c.touch(key)
+		}
+		c.watchers[key]++
+	}
+	return c.version
+}
+
+// Unwatch stops watching the keys.
+func (c *Cache) Unwatch(keys ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range keys {
+		c.watchers[key]--
+		if c.watchers[key] <= 0 {
+			delete(c.watchers, key)
+			delete(c.modified, key)
+		}
+	}
+}
+
+// Modified returns true if the watched key was modified, or expired, after the given version from Watch.
+func (c *Cache) Modified(key string, version uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// a key which expires is modified when the expiration is noticed, like Redis does at EXEC.
+	if e, ok := c.entries[key]; ok && e.expireAt != 0 && e.expireAt < time.Now().UnixMilli() {
+		delete(c.entries, key)
+		c.touch(key)
+	}
+
+	return c.modified[key] > version
+}
+
+// touch records the modification of the key if it's watched. c.lock must be held.
+func (c *Cache) touch(key string) {
+	if c.watchers[key] == 0 {
+		return
+	}
+
+	c.version++
+	c.modified[key] = c.version
+}
+
+// Run runs a command. Commands run concurrently with each other, but not with a transaction.
+func (c *Cache) Run(f func() error) error {
+	c.exec.RLock()
+	defer c.exec.RUnlock()
+
+	return f()
+}
+
+// Exec runs a transaction, while no other command runs. f must not call Run.
+func (c *Cache) Exec(f func() error) error {
+	c.exec.Lock()
+	defer c.exec.Unlock()
+
+	return f()
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"hash/crc64"
+	"io"
+)
+
+// jonesTable is the table for the CRC-64-Jones polynomial (0xad93d23594c935a9, reflected), which Redis uses for
+// the RDB checksum. Unlike hash/crc64, Redis doesn't invert the CRC before and after the update.
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// CRC64 updates the given Redis-compatible CRC64 checksum with p.
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = jonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// crcWriter is a writer which calculates the CRC64 checksum of everything written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc = CRC64(cw.crc, p[:n])
+	return n, err
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// DumpValue serializes the value in the DUMP format: the value in the RDB object format (the value type followed by
+// the encoded value), then the RDB version in 2 bytes and the CRC64 of everything before in 8 bytes, little endian.
+func DumpValue(value string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// we currently support string values only.
+	buf.WriteByte(0x00)
+	if err := writeEncodedString(&buf, value); err != nil {
+		return nil, fmt.Errorf("couldn't write value: %w", err)
+	}
+
+	return appendFooter(buf.Bytes()), nil
+}
+
+// appendFooter appends the RDB version in 2 bytes and the CRC64 of everything before in 8 bytes, little endian.
+func appendFooter(b []byte) []byte {
+	footer := make([]byte, 10)
+	binary.LittleEndian.PutUint16(footer, rdbVersion)
+	b = append(b, footer[:2]...)
+	binary.LittleEndian.PutUint64(footer[2:], CRC64(0, b))
+	return append(b, footer[2:]...)
+}
+
+// checkFooter returns the payload without the footer appended by appendFooter. It fails if the payload is
+// corrupted, or serialized with a newer RDB version than ours.
+func checkFooter(payload []byte) ([]byte, error) {
+	if len(payload) < 10 {
+		return nil, fmt.Errorf("payload too short: %d bytes", len(payload))
+	}
+
+	body, footer := payload[:len(payload)-10], payload[len(payload)-10:]
+	if version := binary.LittleEndian.Uint16(footer); version > rdbVersion {
+		return nil, fmt.Errorf("unsupported RDB version: %d", version)
+	}
+
+	if crc := binary.LittleEndian.Uint64(footer[2:]); crc != CRC64(0, payload[:len(payload)-8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	return body, nil
+}
+
+// RestoreValue returns the value serialized by DumpValue. It fails if the payload is corrupted, or serialized with
+// a newer RDB version than ours.
+func RestoreValue(payload []byte) (string, error) {
+	body, err := checkFooter(payload)
+	if err != nil {
+		return "", fmt.Errorf("checkFooter failed: %w", err)
+	}
+
+	r := bytes.NewReader(body)
+	valueType, err := r.ReadByte()
+	if err != nil {
+		return "", fmt.Errorf("couldn't read value type: %w", err)
+	}
+
+	if valueType != 0x00 {
+		// we currently do not support value other than string.
+		return "", fmt.Errorf("unsupported value type: %d", valueType)
+	}
+
+	value, err := readEncodedString(r)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read value: %w", err)
+	}
+
+	if r.Len() != 0 {
+		return "", fmt.Errorf("%d trailing bytes after the value", r.Len())
+	}
+
+	return value, nil
+}
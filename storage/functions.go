@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// opcodeFunction is the RDB opcode of a function library, followed by the code of the library as a string, like
+// RDB_OPCODE_FUNCTION2 of Redis.
+const opcodeFunction = 0xF5
+
+// LibraryMetadata is the first line of the code of a function library, such as "#!lua name=mylib".
+type LibraryMetadata struct {
+	Engine string
+	Name   string
+}
+
+// ParseLibraryMetadata parses the first line of the code of a function library. The errors can be replied as
+// they are.
+func ParseLibraryMetadata(code string) (LibraryMetadata, error) {
+	line, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(line, "#!") {
+		return LibraryMetadata{}, errors.New("Missing library metadata")
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return LibraryMetadata{}, errors.New("Engine '' not found")
+	}
+
+	md := LibraryMetadata{Engine: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if key != "name" {
+			return LibraryMetadata{}, fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		md.Name = value
+	}
+
+	if md.Name == "" {
+		return LibraryMetadata{}, errors.New("Library name was not given")
+	}
+	if !ValidFunctionName(md.Name) {
+		return LibraryMetadata{}, errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	return md, nil
+}
+
+// ValidFunctionName returns true if the name is made of letters, numbers and underscores, as the names of
+// function libraries and functions must be.
+func ValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// DumpLibraries serializes the code of the libraries like FUNCTION DUMP of Redis: the function records of the RDB,
+// followed by the footer of DumpValue.
+func DumpLibraries(codes []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, code := range codes {
+		if err := writeFunction(&buf, code); err != nil {
+			return nil, fmt.Errorf("writeFunction failed: %w", err)
+		}
+	}
+
+	return appendFooter(buf.Bytes()), nil
+}
+
+// RestoreLibraries returns the code of the libraries serialized by DumpLibraries.
+func RestoreLibraries(payload []byte) ([]string, error) {
+	body, err := checkFooter(payload)
+	if err != nil {
+		return nil, fmt.Errorf("checkFooter failed: %w", err)
+	}
+
+	codes := make([]string, 0)
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		opcode, _ := r.ReadByte()
+		if opcode != opcodeFunction {
+			return nil, fmt.Errorf("unexpected opcode: %d", opcode)
+		}
+
+		code, err := readEncodedString(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read library code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+func writeFunction(w io.Writer, code string) error {
+	if _, err := w.Write([]byte{opcodeFunction}); err != nil {
+		return fmt.Errorf("couldn't write function opcode: %w", err)
+	}
+
+	if err := writeEncodedString(w, code); err != nil {
+		return fmt.Errorf("couldn't write library code: %w", err)
+	}
+
+	return nil
+}
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"time"
 
@@ -27,7 +31,7 @@ func EmptyRDBString() (string, error) {
 
 // ReadRDBToCache reads the contents of the RDB file to the given cache.
 func ReadRDBToCache(dir, filename string, cache *Cache) error {
-	path := fmt.Sprintf("%s/%s", dir, filename)
+	path := filepath.Join(dir, filename)
 
 	// empty the cache completely.
 	cache.Reset()
@@ -36,9 +40,46 @@ func ReadRDBToCache(dir, filename string, cache *Cache) error {
 	if err != nil {
 		return fmt.Errorf("file open failed: %w", err)
 	}
+	defer f.Close()
 
+	return ReadRDB(bufio.NewReader(f), cache)
+}
+
+// WriteRDBToFile writes the contents of the cache to the RDB file, which ReadRDBToCache reads at startup. The file
+// is written under a temporary name first, so that a failed write doesn't break the previous file.
+func WriteRDBToFile(dir, filename string, cache *Cache) error {
+	f, err := os.CreateTemp(dir, "temp-*.rdb")
+	if err != nil {
+		return fmt.Errorf("file create failed: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := WriteRDB(w, cache); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("file write failed: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("file sync failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("file close failed: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), filepath.Join(dir, filename)); err != nil {
+		return fmt.Errorf("file rename failed: %w", err)
+	}
+
+	return nil
+}
+
+// ReadRDB reads the RDB contents from the reader to the given cache.
+func ReadRDB(f io.Reader, cache *Cache) error {
 	// for now, we ignore the version number.
-	_, err = readHeader(f)
+	_, err := readHeader(f)
 	if err != nil {
 		return fmt.Errorf("couldn't read header: %w", err)
 	}
@@ -57,6 +98,18 @@ func ReadRDBToCache(dir, filename string, cache *Cache) error {
 				return fmt.Errorf("couldn't read AUX key-value pair: %w", err)
 			}
 
+		case opcodeFunction: // FUNCTION2
+			code, err := readEncodedString(f)
+			if err != nil {
+				return fmt.Errorf("couldn't read library code: %w", err)
+			}
+
+			md, err := ParseLibraryMetadata(code)
+			if err != nil {
+				return fmt.Errorf("couldn't parse library metadata: %w", err)
+			}
+			cache.SetLibrary(md.Name, code)
+
 		case 0xFB: // RESIZE DB
 			// read length-encoded int for the size of hash table
 			// read length-encoded int for the size of expire hash table
@@ -106,7 +159,7 @@ func ReadRDBToCache(dir, filename string, cache *Cache) error {
 						return fmt.Errorf("couldn't read 4 byte length: %w", err)
 					}
 
-					expiration = binary.LittleEndian.Uint64(length) * 1000 // second to millis
+					expiration = uint64(binary.LittleEndian.Uint32(length)) * 1000 // second to millis
 
 					fmt.Println("expiration = ", expiration)
 
@@ -146,25 +199,14 @@ func ReadRDBToCache(dir, filename string, cache *Cache) error {
 	}
 }
 
-func read(f *os.File, buf []byte) error {
-	toRead := len(buf)
-
-	for {
-		cnt, err := f.Read(buf)
-		if err != nil {
-			return fmt.Errorf("read failed: %w", err)
-
-		}
-
-		toRead = toRead - cnt
-		if toRead == 0 {
-			break
-		}
+func read(f io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return fmt.Errorf("read failed: %w", err)
 	}
 	return nil
 }
 
-func readHeader(f *os.File) (int, error) {
+func readHeader(f io.Reader) (int, error) {
 	buf := make([]byte, 9)
 	if err := read(f, buf); err != nil {
 		return 0, fmt.Errorf("couldn't read header: %w", err)
@@ -183,7 +225,7 @@ func readHeader(f *os.File) (int, error) {
 	return ver, nil
 }
 
-func readAux(f *os.File) (string, string, error) {
+func readAux(f io.Reader) (string, string, error) {
 	key, err := readEncodedString(f)
 	if err != nil {
 		return "", "", fmt.Errorf("couldn't read the key: %w", err)
@@ -201,7 +243,7 @@ func readAux(f *os.File) (string, string, error) {
 	return key, value, nil
 }
 
-func readDBNumber(f *os.File) (int, error) {
+func readDBNumber(f io.Reader) (int, error) {
 	number := make([]byte, 1)
 
 	if err := read(f, number); err != nil {
@@ -211,7 +253,7 @@ func readDBNumber(f *os.File) (int, error) {
 	return int(number[0]), nil
 }
 
-func readChecksum(f *os.File) (uint64, error) {
+func readChecksum(f io.Reader) (uint64, error) {
 	checksum := make([]byte, 8)
 
 	if err := read(f, checksum); err != nil {
@@ -223,7 +265,7 @@ func readChecksum(f *os.File) (uint64, error) {
 
 // readEncodedLength returns the encoded length. If further processing is needed,
 // information to determine the next step is returned as the first value, with second return value as true.
-func readEncodedLength(f *os.File) (uint64, bool, error) {
+func readEncodedLength(f io.Reader) (uint64, bool, error) {
 	first := make([]byte, 1)
 
 	if err := read(f, first); err != nil {
@@ -244,7 +286,7 @@ func readEncodedLength(f *os.File) (uint64, bool, error) {
 		if err := read(f, length); err != nil {
 			return 0, false, fmt.Errorf("couldn't read the second byte of length encoded int: %w", err)
 		}
-		return binary.LittleEndian.Uint64(length), false, nil
+		return uint64(binary.BigEndian.Uint32(length)), false, nil
 	case 3: // The most significant 2 bits: 11 - The remaining 6 bits determines the format. Maybe used to store numbers or strings.
 		return uint64(0x3f & first[0]), true /* further processing needed */, nil
 	}
@@ -252,7 +294,7 @@ func readEncodedLength(f *os.File) (uint64, bool, error) {
 	return 0, false, fmt.Errorf("case that shouldn't happen: %v", 0xC0&first[0])
 }
 
-func readEncodedString(f *os.File) (string, error) {
+func readEncodedString(f io.Reader) (string, error) {
 	length, more, err := readEncodedLength(f)
 	if err != nil {
 		return "", fmt.Errorf("couldn't read the value length: %w", err)
@@ -273,19 +315,19 @@ func readEncodedString(f *os.File) (string, error) {
 		if err := read(f, intg); err != nil {
 			return "", fmt.Errorf("cannot read 8bit integer: %w", err)
 		}
-		return string(intg), nil
+		return strconv.Itoa(int(int8(intg[0]))), nil
 	case 1: // 16bit integer follows
 		intg := make([]byte, 2)
 		if err := read(f, intg); err != nil {
 			return "", fmt.Errorf("cannot read 16bit integer: %w", err)
 		}
-		return string(intg), nil
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(intg)))), nil
 	case 2: // 32bit integer follows
 		intg := make([]byte, 4)
 		if err := read(f, intg); err != nil {
 			return "", fmt.Errorf("cannot read 32bit integer: %w", err)
 		}
-		return string(intg), nil
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(intg)))), nil
 	case 3: // compressed string follows
 		clen, more, err := readEncodedLength(f)
 		if err != nil {
@@ -322,7 +364,7 @@ func readEncodedString(f *os.File) (string, error) {
 	return "", fmt.Errorf("unexpected value in length: %d", length)
 }
 
-func readKeyValue(f *os.File, valueType byte) (string, string, error) {
+func readKeyValue(f io.Reader, valueType byte) (string, string, error) {
 	// key is always string.
 	key, err := readEncodedString(f)
 	if err != nil {
@@ -343,3 +385,161 @@ func readKeyValue(f *os.File, valueType byte) (string, string, error) {
 
 	return key, value, nil
 }
+
+// rdbVersion is the RDB version that WriteRDB writes.
+const rdbVersion = 11
+
+// WriteRDB writes the contents of the cache to the writer in the RDB format.
+func WriteRDB(w io.Writer, cache *Cache) error {
+	cw := &crcWriter{w: w}
+
+	if _, err := fmt.Fprintf(cw, "REDIS%04d", rdbVersion); err != nil {
+		return fmt.Errorf("couldn't write header: %w", err)
+	}
+
+	for _, aux := range [][2]string{{"redis-ver", "7.2.0"}, {"redis-bits", "64"}} {
+		if err := writeAux(cw, aux[0], aux[1]); err != nil {
+			return fmt.Errorf("couldn't write AUX key-value pair: %w", err)
+		}
+	}
+
+	// the function libraries come before the keys, like Redis.
+	libraries := cache.Libraries()
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeFunction(cw, libraries[name]); err != nil {
+			return fmt.Errorf("couldn't write function library: %w", err)
+		}
+	}
+
+	// SELECT DB 0
+	if _, err := cw.Write([]byte{0xFE, 0x00}); err != nil {
+		return fmt.Errorf("couldn't write DB number: %w", err)
+	}
+
+	var size, expires uint64
+	cache.ForEach(func(_, _ string, expireAt int64) {
+		size++
+		if expireAt != 0 {
+			expires++
+		}
+	})
+
+	// RESIZE DB
+	if _, err := cw.Write([]byte{0xFB}); err != nil {
+		return fmt.Errorf("couldn't write resize db opcode: %w", err)
+	}
+	if err := writeEncodedLength(cw, size); err != nil {
+		return fmt.Errorf("couldn't write hash table size: %w", err)
+	}
+	if err := writeEncodedLength(cw, expires); err != nil {
+		return fmt.Errorf("couldn't write expire hash table size: %w", err)
+	}
+
+	var err error
+	cache.ForEach(func(key, value string, expireAt int64) {
+		if err == nil {
+			err = writeKeyValue(cw, key, value, expireAt)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't write key and value: %w", err)
+	}
+
+	// EOF, followed by the checksum of everything before.
+	if _, err := cw.Write([]byte{0xFF}); err != nil {
+		return fmt.Errorf("couldn't write EOF: %w", err)
+	}
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, cw.crc)
+	if _, err := w.Write(checksum); err != nil {
+		return fmt.Errorf("couldn't write checksum: %w", err)
+	}
+
+	return nil
+}
+
+func writeAux(w io.Writer, key, value string) error {
+	if _, err := w.Write([]byte{0xFA}); err != nil {
+		return fmt.Errorf("couldn't write AUX opcode: %w", err)
+	}
+
+	if err := writeEncodedString(w, key); err != nil {
+		return fmt.Errorf("couldn't write the key: %w", err)
+	}
+
+	if err := writeEncodedString(w, value); err != nil {
+		return fmt.Errorf("couldn't write the value: %w", err)
+	}
+
+	return nil
+}
+
+func writeKeyValue(w io.Writer, key, value string, expireAt int64) error {
+	if expireAt != 0 {
+		// EXPIRE MILLISECONDS - 8 byte length follows
+		expiration := make([]byte, 9)
+		expiration[0] = 0xFC
+		binary.LittleEndian.PutUint64(expiration[1:], uint64(expireAt))
+		if _, err := w.Write(expiration); err != nil {
+			return fmt.Errorf("couldn't write expiration: %w", err)
+		}
+	}
+
+	// we currently support string values only.
+	if _, err := w.Write([]byte{0x00}); err != nil {
+		return fmt.Errorf("couldn't write value type: %w", err)
+	}
+
+	if err := writeEncodedString(w, key); err != nil {
+		return fmt.Errorf("couldn't write key: %w", err)
+	}
+
+	if err := writeEncodedString(w, value); err != nil {
+		return fmt.Errorf("couldn't write value: %w", err)
+	}
+
+	return nil
+}
+
+// writeEncodedLength writes the length in the length encoding, using the shortest form.
+func writeEncodedLength(w io.Writer, length uint64) error {
+	var buf []byte
+
+	switch {
+	case length < 1<<6: // 00 - The next 6 bit determines the length
+		buf = []byte{byte(length)}
+	case length < 1<<14: // 01 - The combined 14 bits represents the length
+		buf = []byte{0x40 | byte(length>>8), byte(length)}
+	case length <= 0xFFFFFFFF: // 10 - The next 4 bytes represent the length
+		buf = make([]byte, 5)
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	default:
+		return fmt.Errorf("length too large: %d", length)
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("couldn't write length: %w", err)
+	}
+
+	return nil
+}
+
+// writeEncodedString writes the string as a length-prefixed string.
+func writeEncodedString(w io.Writer, str string) error {
+	if err := writeEncodedLength(w, uint64(len(str))); err != nil {
+		return fmt.Errorf("couldn't write the string length: %w", err)
+	}
+
+	if _, err := io.WriteString(w, str); err != nil {
+		return fmt.Errorf("couldn't write the string: %w", err)
+	}
+
+	return nil
+}